@@ -0,0 +1,161 @@
+package analysis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	chess "github.com/garlicgarrison/go-chess"
+	"github.com/garlicgarrison/go-chess/uci"
+)
+
+/*
+	Anything that can search a position, e.g. a StockPool, a cache in front
+	of one, a remote pool or a recorded transcript
+*/
+type Analyzer interface {
+	Analyze(ctx context.Context, req Request) (*Result, error)
+}
+
+/*
+	Analyzers that hold processes or files implement Closer, ctx bounds how
+	long searches in flight are waited for
+*/
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+/*
+	SearchLimits of a single search, the engine stops at whichever limit it
+	reaches first. Mate searches for a mate in that many moves
+*/
+type SearchLimits struct {
+	Depth    int           `yaml:"depth"`
+	Nodes    int           `yaml:"nodes"`
+	MoveTime time.Duration `yaml:"movetime"`
+	Mate     int           `yaml:"mate"`
+}
+
+func (l SearchLimits) IsZero() bool {
+	return l == SearchLimits{}
+}
+
+/*
+	Engine is the label of the engine that should search, empty lets the
+	analyzer choose. FEN, if set, is searched instead of Position, for
+	positions go-chess cannot hold like the castling rights of Chess960.
+	Position then has the same pieces, see ParseFEN
+*/
+type Request struct {
+	Position *chess.Position
+	FEN      string
+	Limits   SearchLimits
+	MultiPV  int
+	Engine   string
+}
+
+// the FEN that is searched
+func (req Request) PositionFEN() string {
+	if req.FEN != "" {
+		return req.FEN
+	}
+	return req.Position.String()
+}
+
+/*
+	Reads fen like chess.FEN, castling rights go-chess cannot read, like the
+	rook files of Shredder-FEN, are dropped
+*/
+func ParseFEN(fen string) (*chess.Position, error) {
+	f, err := chess.FEN(fen)
+	if err == nil {
+		return chess.NewGame(f).Position(), nil
+	}
+
+	fields := strings.Fields(fen)
+	if len(fields) < 3 || fields[2] == "-" {
+		return nil, err
+	}
+	fields[2] = "-"
+
+	f, err = chess.FEN(strings.Join(fields, " "))
+	if err != nil {
+		return nil, err
+	}
+	return chess.NewGame(f).Position(), nil
+}
+
+/*
+	Mate is in moves, not plies, and negative if the side to move is
+	getting mated
+*/
+type Score struct {
+	CP   int
+	Mate int
+}
+
+type Line struct {
+	MultiPV int
+	Depth   int
+	Nodes   int
+	Score   Score
+	PV      []*chess.Move
+}
+
+/*
+	Lines are in multipv order, Engine is the label of the engine that
+	searched
+*/
+type Result struct {
+	BestMove *chess.Move
+	Ponder   *chess.Move
+	Lines    []Line
+	Engine   string
+}
+
+// Best is the principal line, or an empty line if there is none
+func (r *Result) Best() Line {
+	if len(r.Lines) == 0 {
+		return Line{}
+	}
+
+	return r.Lines[0]
+}
+
+// Clone copies the result so the lines can be reordered
+func (r *Result) Clone() *Result {
+	cp := *r
+	cp.Lines = append([]Line{}, r.Lines...)
+	return &cp
+}
+
+func FromSearchResults(res uci.SearchResults, engine string) *Result {
+	result := &Result{
+		BestMove: res.BestMove,
+		Ponder:   res.Ponder,
+		Lines:    []Line{},
+		Engine:   engine,
+	}
+
+	for _, info := range res.MultiPV {
+		result.Lines = append(result.Lines, fromInfo(info))
+	}
+	if len(res.MultiPV) == 0 && len(res.Info.PV) > 0 {
+		result.Lines = append(result.Lines, fromInfo(res.Info))
+	}
+
+	return result
+}
+
+func fromInfo(info uci.Info) Line {
+	return Line{
+		MultiPV: info.Multipv,
+		Depth:   info.Depth,
+		Nodes:   info.Nodes,
+		Score: Score{
+			CP:   info.Score.CP,
+			Mate: info.Score.Mate,
+		},
+		PV: info.PV,
+	}
+}
@@ -0,0 +1,34 @@
+package analysis
+
+import (
+	"testing"
+)
+
+func TestParseFEN(t *testing.T) {
+	pos, err := ParseFEN("bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w GEge - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if pos.String() != "bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w - - 0 1" {
+		t.Fatalf("expected the rights to be dropped, got %s", pos)
+	}
+
+	req := Request{Position: pos}
+	if req.PositionFEN() != pos.String() {
+		t.Fatalf("expected the position, got %s", req.PositionFEN())
+	}
+	req.FEN = "bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w GEge - 0 1"
+	if req.PositionFEN() != req.FEN {
+		t.Fatalf("expected the fen, got %s", req.PositionFEN())
+	}
+
+	pos, err = ParseFEN("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	if err != nil || pos.String() != "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1" {
+		t.Fatalf("expected the rights to be kept, got %s %v", pos, err)
+	}
+
+	_, err = ParseFEN("8/8 w - - 0 1")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+}
@@ -0,0 +1,295 @@
+package analysis
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Size is the number of positions kept in memory, Path is an optional file
+	every result is appended to and reloaded from on start
+*/
+type CacheConfig struct {
+	Size int
+	Path string
+}
+
+type CacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+/*
+	LRU of results in front of another analyzer, keyed by the position and
+	the search parameters. A result searched deeper than requested is
+	returned for shallower requests with the same other limits, and only the
+	deepest result for a key is kept
+*/
+type Cache struct {
+	next Analyzer
+
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+	file  *os.File
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	key   string
+	depth int
+	res   *Result
+}
+
+// one line of the cache file
+type cacheRecord struct {
+	FEN      string       `json:"fen"`
+	MultiPV  int          `json:"multipv"`
+	Engine   string       `json:"engine"`
+	Depth    int          `json:"depth"`
+	Nodes    int          `json:"nodes,omitempty"`
+	MoveTime int64        `json:"movetime,omitempty"`
+	Mate     int          `json:"mate,omitempty"`
+	BestMove string       `json:"bestmove"`
+	Ponder   string       `json:"ponder,omitempty"`
+	Searched string       `json:"searched,omitempty"`
+	Lines    []lineRecord `json:"lines"`
+}
+
+func NewCache(next Analyzer, cfg CacheConfig) (*Cache, error) {
+	c := &Cache{
+		next:  next,
+		size:  cfg.Size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+	if cfg.Path == "" {
+		return c, nil
+	}
+
+	err := c.load(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.file, err = os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Cache) Analyze(ctx context.Context, req Request) (*Result, error) {
+	fen := req.PositionFEN()
+	if res, ok := c.Get(fen, req.Limits, req.MultiPV, req.Engine); ok {
+		return res, nil
+	}
+
+	res, err := c.next.Analyze(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Put(fen, req.Limits, req.MultiPV, req.Engine, res)
+	return res, nil
+}
+
+/*
+	Returns a copy of the cached result if one was searched to at least the
+	depth of limits
+*/
+func (c *Cache) Get(fen string, limits SearchLimits, multiPV int, engine string) (*Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[cacheKey(fen, limits, multiPV, engine)]
+	if !ok || el.Value.(*cacheEntry).depth < limits.Depth {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheEntry).res.Clone(), true
+}
+
+func (c *Cache) Put(fen string, limits SearchLimits, multiPV int, engine string, res *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.put(cacheKey(fen, limits, multiPV, engine), limits.Depth, res.Clone()) {
+		return
+	}
+
+	if c.file != nil {
+		b, err := json.Marshal(toRecord(fen, limits, multiPV, engine, res))
+		if err != nil {
+			log.Printf("error -- encoding cache entry -- %s", err)
+			return
+		}
+
+		_, err = c.file.Write(append(b, '\n'))
+		if err != nil {
+			log.Printf("error -- writing cache entry -- %s", err)
+		}
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.ll.Len()
+	return stats
+}
+
+/*
+	Closes the cache file and then the analyzer behind the cache
+*/
+func (c *Cache) Close(ctx context.Context) error {
+	c.mu.Lock()
+	var err error
+	if c.file != nil {
+		err = c.file.Close()
+		c.file = nil
+	}
+	c.mu.Unlock()
+
+	if closer, ok := c.next.(Closer); ok {
+		if closeErr := closer.Close(ctx); closeErr != nil {
+			return closeErr
+		}
+	}
+
+	return err
+}
+
+/*
+	Adds the result unless a deeper one is already cached, returns whether
+	it was added
+*/
+func (c *Cache) put(key string, depth int, res *Result) bool {
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if entry.depth >= depth {
+			return false
+		}
+
+		entry.depth = depth
+		entry.res = res
+		c.ll.MoveToFront(el)
+		return true
+	}
+
+	c.items[key] = c.ll.PushFront(&cacheEntry{
+		key:   key,
+		depth: depth,
+		res:   res,
+	})
+
+	for c.size > 0 && c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+
+	return true
+}
+
+func (c *Cache) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record cacheRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			log.Printf("error -- skipping cache line -- %s", err)
+			continue
+		}
+
+		res, err := record.result()
+		if err != nil {
+			log.Printf("error -- skipping cache line -- %s", err)
+			continue
+		}
+
+		c.put(cacheKey(record.FEN, record.limits(), record.MultiPV, record.Engine), record.Depth, res)
+	}
+
+	return scanner.Err()
+}
+
+/*
+	Move counters do not change the search, so they are left out of the key.
+	Depth is compared on lookup instead of being part of the key
+*/
+func cacheKey(fen string, limits SearchLimits, multiPV int, engine string) string {
+	fields := strings.Fields(fen)
+	if len(fields) > 4 {
+		fields = fields[:4]
+	}
+
+	return fmt.Sprintf("%s|%d|%s|%d|%d|%d", strings.Join(fields, " "), multiPV, engine,
+		limits.Nodes, limits.MoveTime.Milliseconds(), limits.Mate)
+}
+
+func toRecord(fen string, limits SearchLimits, multiPV int, engine string, res *Result) cacheRecord {
+	record := cacheRecord{
+		FEN:      fen,
+		MultiPV:  multiPV,
+		Engine:   engine,
+		Depth:    limits.Depth,
+		Nodes:    limits.Nodes,
+		MoveTime: limits.MoveTime.Milliseconds(),
+		Mate:     limits.Mate,
+		Searched: res.Engine,
+		Lines:    toLineRecords(res.Lines),
+	}
+	if res.BestMove != nil {
+		record.BestMove = res.BestMove.String()
+	}
+	if res.Ponder != nil {
+		record.Ponder = res.Ponder.String()
+	}
+
+	return record
+}
+
+func (r cacheRecord) limits() SearchLimits {
+	return SearchLimits{
+		Depth:    r.Depth,
+		Nodes:    r.Nodes,
+		MoveTime: time.Duration(r.MoveTime) * time.Millisecond,
+		Mate:     r.Mate,
+	}
+}
+
+func (r cacheRecord) result() (*Result, error) {
+	return resultRecord{
+		BestMove: r.BestMove,
+		Ponder:   r.Ponder,
+		Engine:   r.Searched,
+		Lines:    r.Lines,
+	}.result()
+}
@@ -0,0 +1,149 @@
+package analysis
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+// answers every request with the same move and counts the searches
+type countingAnalyzer struct {
+	move     string
+	searches int
+}
+
+func (a *countingAnalyzer) Analyze(ctx context.Context, req Request) (*Result, error) {
+	a.searches++
+	m, err := chess.UCINotation{}.Decode(nil, a.move)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		BestMove: m,
+		Lines: []Line{{
+			MultiPV: 1,
+			Depth:   req.Limits.Depth,
+			Score:   Score{Mate: 1},
+			PV:      []*chess.Move{m},
+		}},
+		Engine: "counting",
+	}, nil
+}
+
+func result(t *testing.T, bestMove string, mate int) *Result {
+	res, err := (&countingAnalyzer{move: bestMove}).Analyze(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	res.Lines[0].Score.Mate = mate
+	return res
+}
+
+func position(t *testing.T, fen string) *chess.Position {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return chess.NewGame(f).Position()
+}
+
+func TestCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+	cache, err := NewCache(nil, CacheConfig{Size: 2, Path: path})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	fen := "6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1"
+	cache.Put(fen, SearchLimits{Depth: 12}, 2, "stockfish", result(t, "a1a8", 1))
+
+	// deeper results answer shallower requests, and move counters are ignored
+	res, ok := cache.Get("6k1/5ppp/8/8/8/8/8/R5K1 w - - 4 30", SearchLimits{Depth: 10}, 2, "stockfish")
+	if !ok || res.BestMove.String() != "a1a8" || res.Best().Score.Mate != 1 {
+		t.Fatalf("expected a hit")
+	}
+	if _, ok := cache.Get(fen, SearchLimits{Depth: 14}, 2, "stockfish"); ok {
+		t.Fatalf("expected a miss for a deeper request")
+	}
+	if _, ok := cache.Get(fen, SearchLimits{Depth: 12}, 3, "stockfish"); ok {
+		t.Fatalf("expected a miss for another multipv")
+	}
+	if _, ok := cache.Get(fen, SearchLimits{Depth: 12}, 2, "crystal"); ok {
+		t.Fatalf("expected a miss for another engine")
+	}
+	if _, ok := cache.Get(fen, SearchLimits{Depth: 12, Nodes: 1000}, 2, "stockfish"); ok {
+		t.Fatalf("expected a miss for a node limited search")
+	}
+
+	// shallower results do not replace deeper ones
+	cache.Put(fen, SearchLimits{Depth: 8}, 2, "stockfish", result(t, "a1a2", 0))
+	res, _ = cache.Get(fen, SearchLimits{Depth: 12}, 2, "stockfish")
+	if res.BestMove.String() != "a1a8" {
+		t.Fatalf("expected the deeper result to be kept")
+	}
+
+	cache.Put("8/8/8/8/8/8/k7/K7 w - - 0 1", SearchLimits{Depth: 1}, 2, "stockfish", result(t, "a1b1", 0))
+	cache.Put("8/8/8/8/8/8/k7/1K6 w - - 0 1", SearchLimits{Depth: 1}, 2, "stockfish", result(t, "b1c1", 0))
+	if _, ok := cache.Get(fen, SearchLimits{Depth: 12}, 2, "stockfish"); ok {
+		t.Fatalf("expected the least recently used entry to be evicted")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 5 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats -- %+v", stats)
+	}
+
+	err = cache.Close(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	// evicted entries are still on disk
+	cache, err = NewCache(nil, CacheConfig{Path: path})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer cache.Close(context.Background())
+
+	res, ok = cache.Get(fen, SearchLimits{Depth: 12}, 2, "stockfish")
+	if !ok || res.BestMove.String() != "a1a8" || len(res.Lines) != 1 || res.Best().Score.Mate != 1 || res.Engine != "counting" {
+		t.Fatalf("expected the persisted result")
+	}
+}
+
+func TestCacheAnalyze(t *testing.T) {
+	next := &countingAnalyzer{move: "a1a8"}
+	cache, err := NewCache(next, CacheConfig{})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	req := Request{
+		Position: position(t, "6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1"),
+		Limits:   SearchLimits{Depth: 10},
+		MultiPV:  2,
+	}
+	for i := 0; i < 3; i++ {
+		res, err := cache.Analyze(context.Background(), req)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		// results handed out are copies
+		res.Lines = nil
+	}
+
+	if next.searches != 1 {
+		t.Fatalf("expected one search, got %d", next.searches)
+	}
+
+	res, _ := cache.Analyze(context.Background(), req)
+	if len(res.Lines) != 1 {
+		t.Fatalf("expected the cached lines to be untouched")
+	}
+}
@@ -0,0 +1,122 @@
+package analysis
+
+import (
+	"encoding/json"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+/*
+	Results are encoded with moves in UCI notation, for the cache file and
+	for remote analyzers
+*/
+type resultRecord struct {
+	BestMove string       `json:"bestmove"`
+	Ponder   string       `json:"ponder,omitempty"`
+	Engine   string       `json:"engine,omitempty"`
+	Lines    []lineRecord `json:"lines"`
+}
+
+type lineRecord struct {
+	MultiPV int      `json:"multipv"`
+	Depth   int      `json:"depth"`
+	CP      int      `json:"cp"`
+	Mate    int      `json:"mate"`
+	Nodes   int      `json:"nodes"`
+	PV      []string `json:"pv"`
+}
+
+func (r *Result) MarshalJSON() ([]byte, error) {
+	record := resultRecord{
+		Engine: r.Engine,
+		Lines:  toLineRecords(r.Lines),
+	}
+	if r.BestMove != nil {
+		record.BestMove = r.BestMove.String()
+	}
+	if r.Ponder != nil {
+		record.Ponder = r.Ponder.String()
+	}
+
+	return json.Marshal(record)
+}
+
+func (r *Result) UnmarshalJSON(b []byte) error {
+	var record resultRecord
+	err := json.Unmarshal(b, &record)
+	if err != nil {
+		return err
+	}
+
+	res, err := record.result()
+	if err != nil {
+		return err
+	}
+
+	*r = *res
+	return nil
+}
+
+func toLineRecords(lines []Line) []lineRecord {
+	records := []lineRecord{}
+	for _, l := range lines {
+		record := lineRecord{
+			MultiPV: l.MultiPV,
+			Depth:   l.Depth,
+			CP:      l.Score.CP,
+			Mate:    l.Score.Mate,
+			Nodes:   l.Nodes,
+			PV:      []string{},
+		}
+		for _, m := range l.PV {
+			record.PV = append(record.PV, m.String())
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func (r resultRecord) result() (*Result, error) {
+	res := &Result{
+		Lines:  []Line{},
+		Engine: r.Engine,
+	}
+
+	var err error
+	if r.BestMove != "" {
+		res.BestMove, err = chess.UCINotation{}.Decode(nil, r.BestMove)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.Ponder != "" {
+		res.Ponder, err = chess.UCINotation{}.Decode(nil, r.Ponder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, l := range r.Lines {
+		line := Line{
+			MultiPV: l.MultiPV,
+			Depth:   l.Depth,
+			Nodes:   l.Nodes,
+			Score: Score{
+				CP:   l.CP,
+				Mate: l.Mate,
+			},
+		}
+
+		for _, s := range l.PV {
+			m, err := chess.UCINotation{}.Decode(nil, s)
+			if err != nil {
+				return nil, err
+			}
+			line.PV = append(line.PV, m)
+		}
+		res.Lines = append(res.Lines, line)
+	}
+
+	return res, nil
+}
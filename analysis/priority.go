@@ -0,0 +1,44 @@
+package analysis
+
+import "context"
+
+/*
+	Priority of a request when analyzers have to queue them, a free engine
+	goes to the highest priority waiting. Interactive work like scoring a
+	single puzzle should not wait behind batch generation
+*/
+type Priority int
+
+const (
+	PriorityBatch       Priority = -1
+	PriorityNormal      Priority = 0
+	PriorityInteractive Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBatch:
+		return "batch"
+	case PriorityNormal:
+		return "normal"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
+type priorityKey struct{}
+
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority set on ctx, PriorityNormal if there is none
+func PriorityFrom(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	if !ok {
+		return PriorityNormal
+	}
+	return p
+}
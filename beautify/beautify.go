@@ -1,9 +1,9 @@
 package beautify
 
 import (
+	"errors"
 	"log"
 	"math"
-	"math/rand"
 
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
 	"github.com/garlicgarrison/go-chess"
@@ -31,74 +31,78 @@ type AnnealConfig struct {
 	AcceptableScore float64
 
 	NumPieces int
+
+	// Mutations weighs the operators a step is drawn from, see
+	// puzzlegen.Mutations. Without weights every step is
+	// puzzlegen.MutationMaterial
+	Mutations map[puzzlegen.Mutation]float64
+
+	// Seed replays the annealing, 0 picks a random seed which is logged
+	Seed int64
 }
 
 type Annealer struct {
-	cfg AnnealConfig
-	g   puzzlegen.Generator[*chess.Position]
+	cfg   AnnealConfig
+	g     puzzlegen.Generator[*chess.Position]
+	seeds *puzzlegen.Seeds
 }
 
 func NewAnnealer(cfg AnnealConfig, g puzzlegen.Generator[*chess.Position]) *Annealer {
 	return &Annealer{
-		cfg: cfg,
-		g:   g,
+		cfg:   cfg,
+		g:     g,
+		seeds: puzzlegen.NewSeeds(cfg.Seed),
 	}
 }
 
+/*
+	Every mutation is drawn from its own seed, which is stored on the puzzle
+	with the operator that made it, and so is accepting a worse puzzle
+*/
 func (a *Annealer) Anneal(p *puzzlegen.Puzzle) *puzzlegen.Puzzle {
+	seed := a.seeds.Next()
+	log.Printf("annealing with seed %d", seed)
+	rng := puzzlegen.NewRand(seed)
+
 	temperature := a.cfg.InitTemp
 	currentScore := a.Score(*p)
 	nextScore := 0.0
 	for temperature >= a.cfg.FinalTemp {
 		for i := 0; i < a.cfg.Iterations; i++ {
-			nextFEN, err := puzzlegen.MutateFEN(p.Position, a.cfg.NumPieces)
-			if err != nil {
-				return nil
+			mutation := puzzlegen.MutationMaterial
+			if len(a.cfg.Mutations) > 0 {
+				mutation = puzzlegen.DrawMutation(a.cfg.Mutations, rng)
 			}
-			log.Printf("mutated fen: %s", nextFEN)
 
-			f, err := chess.FEN(nextFEN)
+			mutationSeed := rng.Int63()
+			nextFEN, err := puzzlegen.ApplyMutation(mutation, p.Position, a.cfg.NumPieces, puzzlegen.NewRand(mutationSeed))
+			if errors.Is(err, puzzlegen.ErrInvalidPosition) || errors.Is(err, puzzlegen.ErrNoMutation) {
+				log.Printf("error -- %s -- mutation: %s seed: %d", err, mutation, mutationSeed)
+				continue
+			}
 			if err != nil {
 				return nil
 			}
+			log.Printf("mutated fen: %s mutation: %s seed: %d", nextFEN, mutation, mutationSeed)
 
-			var puzzle *puzzlegen.Puzzle
-			game := chess.NewGame(f)
-			sol, res := a.g.Create(game.Position())
-			solution := []string{}
-			if sol != nil {
-				for _, m := range sol.Moves() {
-					solution = append(solution, m.String())
-				}
-			}
-
-			if res == nil {
-				puzzle = &puzzlegen.Puzzle{
-					Position: nextFEN,
-					Solution: solution,
-					MateIn:   0,
-					CP:       0,
-				}
-			} else {
-				puzzle = &puzzlegen.Puzzle{
-					Position: nextFEN,
-					Solution: solution,
-					MateIn:   res.Info.Score.Mate,
-					CP:       res.Info.Score.CP,
-				}
-			}
+			// Shredder rights are searched with the position
+			sol, res := a.g.CreateFEN(nextFEN, p.Chess960)
+			puzzle := puzzlegen.NewPuzzle(nextFEN, sol, res)
+			puzzle.Chess960 = p.Chess960
+			puzzle.Seed = mutationSeed
+			puzzle.Mutation = mutation
 
-			nextScore = a.Score(*puzzle)
+			nextScore = a.Score(puzzle)
 			log.Printf("nextScore: %f", nextScore)
 			log.Printf("currentScore: %f", currentScore)
 			if nextScore > currentScore {
-				p = puzzle
+				p = &puzzle
 				currentScore = nextScore
 			} else {
 				energy := energy(currentScore-nextScore, temperature)
 				log.Printf("energy: %f", energy)
-				if energy > rand.Float64() {
-					p = puzzle
+				if energy > rng.Float64() {
+					p = &puzzle
 					currentScore = nextScore
 				}
 			}
@@ -1,66 +1,170 @@
 package beautify
 
 import (
-	"io/ioutil"
 	"log"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
 	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
-	"github.com/garlicgarrison/go-chess"
-	"gopkg.in/yaml.v2"
 )
 
-func TestAnneal(t *testing.T) {
-	// initialize stockfish pool
-	pool, err := stockpool.NewStockPool("stockfish", 1, 8, 10)
-	if err != nil {
-		panic(err)
-	}
-
-	// get puzzle config
-	yamlConfig, err := ioutil.ReadFile("../config/pieces.yaml")
-	if err != nil {
-		panic(err)
-	}
+func TestMain(m *testing.M) {
+	fakeengine.Main()
+	os.Exit(m.Run())
+}
 
-	var config puzzlegen.PuzzleConfig
-	err = yaml.Unmarshal(yamlConfig, &config)
+func TestAnneal(t *testing.T) {
+	// initialize fake engine pool
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/anneal.json"), 1, 1)
 	if err != nil {
 		panic(err)
 	}
 
 	// initilialize mate generator
 	gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
-		puzzlegen.AnalysisConfig{
+		AnalysisConfig: puzzlegen.AnalysisConfig{
 			Depth:   10,
 			MultiPV: 2,
 		},
-		config,
-	}, pool, func(s string, i int, g *chess.Game) {}, 10)
+	}, pool, func(puzzlegen.Puzzle) {}, 10)
+	defer gen.Close()
 
 	beautify := NewAnnealer(AnnealConfig{
-		InitTemp:        500,
-		FinalTemp:       -1,
-		Alpha:           10,
+		InitTemp:        10,
+		FinalTemp:       1,
+		Alpha:           3,
 		Beta:            0,
 		Method:          LINEAR,
 		Iterations:      5,
 		AcceptableScore: 10,
 
-		NumPieces: 5,
+		NumPieces: 8,
+		Seed:      2,
 	}, gen)
 
+	// no mate, the seed adds the rook and pawn of a back rank mate first
 	controlPuzzle := puzzlegen.Puzzle{
-		Position: "R3nN2/8/Pk5P/3b4/7P/6r1/2pnN2p/2K5 b - - 0 1",
-		Solution: []string{"h2h1q", "e2g1", "h1g1", "c1c2", "d5b3", "c2d2"},
-		MateIn:   4,
+		Position: "6k1/5ppp/8/8/8/8/5PPP/6K1 w - - 0 1",
 	}
 
 	now := time.Now()
 	puzzle := beautify.Anneal(&controlPuzzle)
+	if puzzle == nil {
+		t.Fatalf("expected a puzzle")
+	}
 
 	log.Printf("puzzle fen: %s", puzzle.Position)
 	log.Printf("time: %d", time.Since(now))
+
+	if puzzle.Position != "6k1/5ppp/3R4/4P3/8/8/5PPP/6K1 w - - 0 1" || puzzle.MateIn != 1 || strings.Join(puzzle.Solution, " ") != "d6d8" {
+		t.Fatalf("expected the scripted mate in 1, got %+v", puzzle)
+	}
+	if score := beautify.Score(*puzzle); score != 261 || score <= beautify.Score(controlPuzzle) {
+		t.Fatalf("expected the mate to score 261 over the control puzzle, got %v", score)
+	}
+
+	// the same seed anneals to the same puzzle
+	replayed := NewAnnealer(beautify.cfg, gen).Anneal(&controlPuzzle)
+	if replayed == nil || replayed.Position != puzzle.Position || replayed.Seed != puzzle.Seed {
+		t.Fatalf("expected the seed to replay the annealing")
+	}
+}
+
+func TestAnnealMutations(t *testing.T) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/anneal.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
+		AnalysisConfig: puzzlegen.AnalysisConfig{
+			Depth:   10,
+			MultiPV: 2,
+		},
+	}, pool, func(puzzlegen.Puzzle) {}, 10)
+	defer gen.Close()
+
+	cfg := AnnealConfig{
+		InitTemp:   10,
+		FinalTemp:  1,
+		Alpha:      3,
+		Method:     LINEAR,
+		Iterations: 5,
+		NumPieces:  8,
+		Seed:       1,
+		Mutations: map[puzzlegen.Mutation]float64{
+			puzzlegen.MutationMove:   2,
+			puzzlegen.MutationSwap:   1,
+			puzzlegen.MutationMirror: 1,
+		},
+	}
+
+	// scored as given, the seed mirrors it to the scripted mate first
+	controlPuzzle := puzzlegen.Puzzle{
+		Position: "6k1/5ppp/8/8/3R4/8/5PPP/6K1 w - - 0 1",
+	}
+
+	annealer := NewAnnealer(cfg, gen)
+	puzzle := annealer.Anneal(&controlPuzzle)
+	if puzzle == nil || puzzle.Position != "1k6/ppp5/8/8/4R3/8/PPP5/1K6 w - - 0 1" {
+		t.Fatalf("expected the mirrored mate, got %+v", puzzle)
+	}
+	if puzzle.Mutation != puzzlegen.MutationMirror || puzzle.MateIn != 1 || strings.Join(puzzle.Solution, " ") != "e4e8" {
+		t.Fatalf("expected the scripted mate in 1 of the mirror operator, got %+v", puzzle)
+	}
+	if score := annealer.Score(*puzzle); score != 262.5 {
+		t.Fatalf("expected the mate to score 262.5, got %v", score)
+	}
+
+	replayed := NewAnnealer(cfg, gen).Anneal(&controlPuzzle)
+	if replayed == nil || replayed.Position != puzzle.Position || replayed.Mutation != puzzle.Mutation {
+		t.Fatalf("expected the seed to replay the annealing")
+	}
+}
+
+func TestAnnealChess960(t *testing.T) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/anneal.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
+		AnalysisConfig: puzzlegen.AnalysisConfig{
+			Depth:   10,
+			MultiPV: 2,
+		},
+	}, pool, func(puzzlegen.Puzzle) {}, 10)
+	defer gen.Close()
+
+	annealer := NewAnnealer(AnnealConfig{
+		InitTemp:   10,
+		FinalTemp:  1,
+		Alpha:      3,
+		Method:     LINEAR,
+		Iterations: 1,
+		NumPieces:  8,
+		Seed:       3,
+		Mutations: map[puzzlegen.Mutation]float64{
+			puzzlegen.MutationMaterial: 1,
+		},
+	}, gen)
+
+	// the mate is only scripted with the G rights, so it is found only if
+	// they reach the engine
+	controlPuzzle := puzzlegen.Puzzle{
+		Position: "6k1/5ppp/8/8/8/8/5PPP/5KR1 w G - 0 1",
+		Chess960: true,
+	}
+
+	puzzle := annealer.Anneal(&controlPuzzle)
+	if puzzle == nil || puzzle.Position != "6k1/1R3ppp/8/8/8/8/5PPP/5KR1 w G - 0 1" || !puzzle.Chess960 {
+		t.Fatalf("expected the Chess960 puzzle with its rights, got %+v", puzzle)
+	}
+	if puzzle.MateIn != 1 || strings.Join(puzzle.Solution, " ") != "b7b8" {
+		t.Fatalf("expected the scripted mate in 1, got %+v", puzzle)
+	}
 }
@@ -1,6 +1,7 @@
 package beautify
 
 import (
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
 	"github.com/garlicgarrison/go-chess"
 )
@@ -32,7 +33,13 @@ var PieceValueMap = map[chess.PieceType]int{
 //TODO: the more pieces the opponent has compared to you, the higher the score should be
 func (a *Annealer) Score(p puzzlegen.Puzzle) float64 {
 	score := 0.0
-	f, err := chess.FEN(p.Position)
+	// Shredder rights are dropped, the moves scored are the same
+	position, err := analysis.ParseFEN(p.Position)
+	if err != nil {
+		return -100
+	}
+
+	f, err := chess.FEN(position.String())
 	if err != nil {
 		return -100
 	}
@@ -1,42 +1,30 @@
 package beautify
 
 import (
-	"io/ioutil"
 	"log"
+	"math"
 	"testing"
 
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
 	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
 	"github.com/garlicgarrison/go-chess"
-	"gopkg.in/yaml.v2"
 )
 
 func TestScore(t *testing.T) {
-	pool, err := stockpool.NewStockPool("stockfish", 1, 8, 10)
-	if err != nil {
-		panic(err)
-	}
-
-	// get puzzle config
-	yamlConfig, err := ioutil.ReadFile("../config/pieces.yaml")
-	if err != nil {
-		panic(err)
-	}
-
-	var config puzzlegen.PuzzleConfig
-	err = yaml.Unmarshal(yamlConfig, &config)
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/anneal.json"), 1, 1)
 	if err != nil {
 		panic(err)
 	}
 
 	// initilialize mate generator
 	gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
-		puzzlegen.AnalysisConfig{
+		AnalysisConfig: puzzlegen.AnalysisConfig{
 			Depth:   10,
 			MultiPV: 2,
 		},
-		config,
-	}, pool, func(s string, i int, g *chess.Game) {}, 10)
+	}, pool, func(puzzlegen.Puzzle) {}, 10)
+	defer gen.Close()
 
 	beautify := NewAnnealer(AnnealConfig{
 		InitTemp:        500,
@@ -54,31 +42,59 @@ func TestScore(t *testing.T) {
 		MateIn:   4,
 	}
 
-	score := beautify.Score(controlPuzzle)
-	log.Printf("score: %f", score)
-
-	higherPuzzle := puzzlegen.Puzzle{
-		Position: "6k1/3b3r/1p1p4/p1n2p2/1PPNpP1q/P3Q1p1/1R1RB1P1/5K2 b - - 0 1",
-		Solution: []string{"h4f4", "e2f3", "f4e3", "f3h5", "h7h5", "d4f3", "h5h1", "f3g1", "h1g1"},
-		MateIn:   5,
+	tests := []struct {
+		puzzle puzzlegen.Puzzle
+		score  float64
+	}{
+		{controlPuzzle, 312},
+		{
+			puzzle: puzzlegen.Puzzle{
+				Position: "6k1/3b3r/1p1p4/p1n2p2/1PPNpP1q/P3Q1p1/1R1RB1P1/5K2 b - - 0 1",
+				Solution: []string{"h4f4", "e2f3", "f4e3", "f3h5", "h7h5", "d4f3", "h5h1", "f3g1", "h1g1"},
+				MateIn:   5,
+			},
+			score: 516,
+		},
+		{
+			puzzle: puzzlegen.Puzzle{
+				Position: "2q1nk1r/4Rp2/1ppp1P2/6Pp/3p1B2/3P3P/PPP1Q3/6K1 w - - 0 1",
+				Solution: []string{"e7e8", "c8e8", "f4d6", "e8e7", "e2e7", "f8g8", "e7e8", "g8h7", "e8f7"},
+				MateIn:   5,
+			},
+			score: 368.5,
+		},
+		{
+			puzzle: puzzlegen.Puzzle{
+				Position: "8/8/8/8/8/2B1p3/K7/2N4k w - - 0 1",
+				Solution: []string{},
+				MateIn:   0,
+				CP:       370,
+			},
+			score: -0.1,
+		},
 	}
-	score = beautify.Score(higherPuzzle)
-	log.Printf("score: %f", score)
 
-	higherPuzzle = puzzlegen.Puzzle{
-		Position: "2q1nk1r/4Rp2/1ppp1P2/6Pp/3p1B2/3P3P/PPP1Q3/6K1 w - - 0 1",
-		Solution: []string{"e7e8", "c8e8", "f4d6", "e8e7", "e2e7", "f8g8", "e7e8", "g8h7", "e8f7"},
-		MateIn:   5,
+	// a puzzle of the generator, from the scripted mate in 1
+	fen := "6k1/5ppp/3R4/4P3/8/8/5PPP/6K1 w - - 0 1"
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	sol, res := gen.Create(chess.NewGame(f).Position())
+	created := puzzlegen.NewPuzzle(fen, sol, res)
+	if created.MateIn != 1 || len(created.Solution) != 1 {
+		t.Fatalf("expected the scripted mate in 1, got %+v", created)
 	}
-	score = beautify.Score(higherPuzzle)
-	log.Printf("score: %f", score)
+	tests = append(tests, struct {
+		puzzle puzzlegen.Puzzle
+		score  float64
+	}{created, 261})
 
-	higherPuzzle = puzzlegen.Puzzle{
-		Position: "8/8/8/8/8/2B1p3/K7/2N4k w - - 0 1",
-		Solution: []string{},
-		MateIn:   0,
-		CP:       370,
+	for _, test := range tests {
+		score := beautify.Score(test.puzzle)
+		log.Printf("score: %f", score)
+		if math.Abs(score-test.score) > 1e-9 {
+			t.Fatalf("%s -- expected score %v, got %v", test.puzzle.Position, test.score, score)
+		}
 	}
-	score = beautify.Score(higherPuzzle)
-	log.Printf("score: %f", score)
 }
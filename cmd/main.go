@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
+	"github.com/garlicgarrison/chess-puzzle-gen/remote"
 	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
-	"github.com/garlicgarrison/go-chess"
 	"github.com/spf13/cobra"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -19,21 +24,87 @@ const (
 	STOCKFISHPATH = "stockfish"
 	CRYSTALPATH   = "./stockfish/crystal"
 
-	CONFIGPATH = "./config/pieces.yaml"
+	CONFIGPATH         = "./config/pieces.yaml"
+	ENGINECONFIGPATH   = "./config/engine.yaml"
+	ENGINESCONFIGPATH  = "./config/engines.yaml"
+	ANALYSISCONFIGPATH = "./config/analysis.yaml"
 )
 
 func main() {
-	var depth int
-	var multipv int
-	var threads int
+	var engines engineFlags
+	var cacheSize int
+	var cachePath string
+	var remotes []string
+	var token string
+	var listen string
+	var transcriptPath string
+	var replayPath string
+	var seed int64
+	var pgnConfig puzzlegen.PGNConfig
+	var epdConfig puzzlegen.EPDConfig
+	var inputOnly bool
+
+	// the analysis config is read first so flags override it
+	var analysisConfig puzzlegen.AnalysisConfig
+	if b, err := ioutil.ReadFile(ANALYSISCONFIGPATH); err == nil {
+		err = yaml.Unmarshal(b, &analysisConfig)
+		if err != nil {
+			log.Fatalf("Error -- %s", err)
+		}
+	}
 
 	rootCmd := &cobra.Command{
 		Use:   "puzzlegen",
 		Short: "Generate beautiful puzzles",
 		Long:  "Generate beautiful puzzles",
 		Run: func(cmd *cobra.Command, args []string) {
-			// initialize stockfish pool
-			pool, err := stockpool.NewStockPool(STOCKFISHPATH, 1, threads, 10)
+			// search on remote nodes when given, otherwise on local engines
+			var analyzer analysis.Analyzer
+			if replayPath != "" {
+				replay, err := stockpool.LoadReplay(replayPath)
+				if err != nil {
+					panic(err)
+				}
+				analyzer = replay
+			} else if len(remotes) > 0 {
+				nodes := []remote.Node{}
+				for _, addr := range remotes {
+					nodes = append(nodes, remote.Node{Addr: addr, Token: token})
+				}
+
+				pool, err := remote.NewPool(remote.PoolConfig{Nodes: nodes})
+				if err != nil {
+					panic(err)
+				}
+				analyzer = pool
+			} else {
+				pool, specs, err := newStockPool(engines)
+				if err != nil {
+					panic(err)
+				}
+				err = setEngineLabels(specs, &analysisConfig)
+				if err != nil {
+					pool.Close(context.Background())
+					panic(err)
+				}
+				analyzer = pool
+
+				// every line to and from the engines, for reproducing a run
+				if transcriptPath != "" {
+					transcript, err := stockpool.OpenTranscript(transcriptPath)
+					if err != nil {
+						panic(err)
+					}
+					defer transcript.Close()
+					pool.Record(transcript)
+				}
+			}
+
+			// analysis results are cached in front of the pool
+			cache, err := analysis.NewCache(analyzer, analysis.CacheConfig{
+				Size: cacheSize,
+				Path: cachePath,
+			})
 			if err != nil {
 				panic(err)
 			}
@@ -49,39 +120,313 @@ func main() {
 			if err != nil {
 				panic(err)
 			}
+			if engines.chess960 {
+				config.Chess960 = true
+			}
+
+			// puzzles written by earlier runs, or their mirror images, are skipped
+			dedup, err := loadDedup("puzzles.json")
+			if err != nil {
+				panic(err)
+			}
 
 			// initilialize mate generator
 			gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
-				puzzlegen.AnalysisConfig{
-					Depth:   depth,
-					MultiPV: multipv,
-				},
-				config,
-			}, pool, write, 10)
+				AnalysisConfig: analysisConfig,
+				PuzzleConfig:   config,
+				Seed:           seed,
+				PGN:            pgnConfig,
+				EPD:            epdConfig,
+				InputOnly:      inputOnly,
+				Dedup:          dedup,
+			}, cache, write, 10)
 			gen.Start()
 
-			defer gen.Close()
+			// closing operations, on a signal or once the input is searched
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+			done := make(chan struct{})
+			go func() {
+				gen.Wait()
+				close(done)
+			}()
+
+			select {
+			case <-sigChan:
+			case <-done:
+			}
+			log.Printf("exit")
+			gen.Close()
+
+			stats := cache.Stats()
+			log.Printf("analysis cache -- hits: %d misses: %d entries: %d", stats.Hits, stats.Misses, stats.Entries)
+		},
+	}
+
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the local engines to remote puzzle generators",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg := remote.ServerConfig{}
+			if token != "" {
+				cfg.Tokens = []string{token}
+			}
+			err := remote.CheckListen(listen, cfg)
+			if err != nil {
+				panic(err)
+			}
+
+			pool, specs, err := newStockPool(engines)
+			if err != nil {
+				panic(err)
+			}
+
+			for _, spec := range specs {
+				cfg.Capacity += spec.Count
+				cfg.Labels = append(cfg.Labels, spec.Label)
+			}
+			if engines.maxEngines > specs[0].Count {
+				cfg.Capacity += engines.maxEngines - specs[0].Count
+			}
+
+			srv := &http.Server{
+				Addr:    listen,
+				Handler: remote.NewServer(pool, cfg),
+			}
+			go func() {
+				err := srv.ListenAndServe()
+				if err != nil && err != http.ErrServerClosed {
+					log.Fatalf("Error -- %s", err)
+				}
+			}()
+			log.Printf("serving %d engines on %s", cfg.Capacity, listen)
 
-			// closing operations
 			sigChan := make(chan os.Signal, 1)
 			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 			<-sigChan
 			log.Printf("exit")
-			os.Exit(0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), puzzlegen.TIMEOUT*time.Millisecond)
+			defer cancel()
+			srv.Shutdown(ctx)
+			pool.Close(ctx)
 		},
 	}
+	serveCmd.Flags().StringVar(&listen, "listen", "127.0.0.1:7373", "The address engines are served on, any other than loopback needs a token")
+	rootCmd.AddCommand(serveCmd)
 
-	rootCmd.Flags().IntVarP(&depth, "depth", "d", 0, "The depth parameter")
-	rootCmd.Flags().IntVarP(&multipv, "multipv", "m", 0, "The multipv parameter")
-	rootCmd.Flags().IntVarP(&threads, "threads", "t", 0, "The threads parameter")
+	modelCmd := &cobra.Command{
+		Use:   "model [pgn] [out]",
+		Short: "Build a placement model from a PGN corpus, see placement_model in the piece config",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			f, err := os.Open(args[0])
+			if err != nil {
+				log.Fatalf("Error -- %s", err)
+			}
+			defer f.Close()
+
+			model, err := puzzlegen.BuildPlacementModel(f)
+			if err != nil {
+				log.Fatalf("Error -- %s", err)
+			}
+
+			err = model.Save(args[1])
+			if err != nil {
+				log.Fatalf("Error -- %s", err)
+			}
+			log.Printf("placement model of %d positions saved to %s", model.Positions, args[1])
+		},
+	}
+	rootCmd.AddCommand(modelCmd)
+
+	persistent := rootCmd.PersistentFlags()
+	persistent.IntVarP(&engines.threads, "threads", "t", 0, "The threads parameter")
+	persistent.IntVar(&engines.maxEngines, "max-engines", 0, "Add engines while searches are queued up to this many, and retire idle ones")
+	persistent.BoolVar(&engines.deterministic, "deterministic", false, "Reproducible searches, one thread and an empty hash for every search, combine with node limits")
+	persistent.BoolVar(&engines.chess960, "chess960", false, "Generate Chess960 positions and search with UCI_Chess960 set on the engines")
+	persistent.StringVar(&token, "token", "", "The token remote nodes and generators authenticate with")
+
+	flags := rootCmd.Flags()
+	flags.IntVarP(&analysisConfig.Depth, "depth", "d", analysisConfig.Depth, "The depth parameter")
+	flags.IntVarP(&analysisConfig.MultiPV, "multipv", "m", analysisConfig.MultiPV, "The multipv parameter")
+	flags.StringVar(&analysisConfig.MateEngine, "mate-engine", analysisConfig.MateEngine, "The engine label used to find mating moves")
+	flags.StringVar(&analysisConfig.EvalEngine, "eval-engine", analysisConfig.EvalEngine, "The engine label used to find defending replies")
+
+	// discovery searches new positions, verification the rest of the solution
+	discovery := &analysisConfig.Discovery
+	flags.IntVar(&discovery.Depth, "discovery-depth", discovery.Depth, "The depth limit when searching new positions")
+	flags.IntVar(&discovery.Nodes, "discovery-nodes", discovery.Nodes, "The node limit when searching new positions")
+	flags.DurationVar(&discovery.MoveTime, "discovery-movetime", discovery.MoveTime, "The time limit when searching new positions")
+	flags.IntVar(&discovery.Mate, "discovery-mate", discovery.Mate, "Search new positions for a mate in this many moves")
+	verification := &analysisConfig.Verification
+	flags.IntVar(&verification.Depth, "verify-depth", verification.Depth, "The depth limit when verifying a solution")
+	flags.IntVar(&verification.Nodes, "verify-nodes", verification.Nodes, "The node limit when verifying a solution")
+	flags.DurationVar(&verification.MoveTime, "verify-movetime", verification.MoveTime, "The time limit when verifying a solution")
+	flags.IntVar(&verification.Mate, "verify-mate", verification.Mate, "Verify solutions with a mate search of this many moves")
+	flags.StringVar(&analysisConfig.TablebasePath, "tablebase-path", analysisConfig.TablebasePath, "The directory of the Syzygy endgame tables")
+	flags.IntVar(&analysisConfig.TablebasePieces, "tablebase-pieces", analysisConfig.TablebasePieces, "Solve positions with up to this many pieces (at most 7) from endgame tables, 0 disables them")
+	flags.Int64Var(&seed, "seed", 0, "Replay the run of this seed, 0 picks a random one")
+	flags.StringSliceVar(&pgnConfig.Paths, "pgn", nil, "Search the positions of the games in these PGN files or directories before random ones")
+	flags.IntVar(&pgnConfig.MinPly, "pgn-min-ply", 0, "Skip the positions of each game before this ply")
+	flags.IntVar(&pgnConfig.Every, "pgn-every", 1, "Search every nth position of each game")
+	flags.IntVar(&pgnConfig.BlunderCP, "pgn-blunder-cp", 0, "Only search positions right after a move that lost this many centipawns, 0 searches by ply")
+	flags.StringSliceVar(&epdConfig.Paths, "epd", nil, "Search the positions of these EPD or FEN files or directories, one position a line")
+	flags.StringVar(&epdConfig.Report, "epd-report", "", "Append the result of every input line to this file and skip the lines it has")
+	flags.BoolVar(&inputOnly, "input-only", false, "Exit once the PGN and EPD input is searched instead of generating random positions")
+	flags.IntVar(&cacheSize, "cache-size", 100000, "The number of analysed positions kept in memory")
+	flags.StringVar(&cachePath, "cache-path", "", "The file analysed positions are persisted to")
+	flags.StringVar(&transcriptPath, "transcript", "", "The file every line to and from the engines is recorded to")
+	flags.StringVar(&replayPath, "replay", "", "Answer searches from a recorded transcript instead of engines")
+	flags.StringSliceVar(&remotes, "remote", nil, "Search on these remote nodes (host:port) instead of local engines")
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalf("Error -- %s", err)
 	}
 }
 
-func write(fen string, mateIn int, sol *chess.Game) {
+// flags shared by every command that runs local engines
+type engineFlags struct {
+	threads       int
+	deterministic bool
+	maxEngines    int
+	chess960      bool
+}
+
+/*
+	Spawns the local engines, stockfish for evaluation and crystal for mates
+	if it is built, or the engines in ENGINESCONFIGPATH instead
+*/
+func newStockPool(flags engineFlags) (*stockpool.StockPool, []stockpool.EngineSpec, error) {
+	// engine options, the threads flag overrides the config
+	threads := flags.threads
+	opts := stockpool.DefaultEngineOptions(threads)
+	if _, err := os.Stat(ENGINECONFIGPATH); err == nil {
+		opts, err = stockpool.LoadEngineOptions(ENGINECONFIGPATH)
+		if err != nil {
+			return nil, nil, err
+		}
+		if threads > 0 {
+			opts.Threads = threads
+		}
+	}
+
+	// engines.yaml replaces the default engines
+	var specs []stockpool.EngineSpec
+	if _, err := os.Stat(ENGINESCONFIGPATH); err == nil {
+		specs, err = stockpool.LoadEngineSpecs(ENGINESCONFIGPATH)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		specs = []stockpool.EngineSpec{{
+			Label:   "stockfish",
+			Path:    STOCKFISHPATH,
+			Count:   1,
+			Options: opts,
+		}}
+		if _, err := os.Stat(CRYSTALPATH); err == nil {
+			specs = append(specs, stockpool.EngineSpec{
+				Label:        "crystal",
+				Path:         CRYSTALPATH,
+				Count:        1,
+				Capabilities: []string{"mate"},
+				Options:      opts,
+			})
+		}
+	}
+	for i := range specs {
+		if flags.deterministic {
+			specs[i].Options.Deterministic = true
+		}
+		if flags.chess960 {
+			specs[i].Options.Chess960 = true
+		}
+	}
+
+	// the first engine is the one serve and autoscale size
+	if len(specs) == 0 {
+		return nil, nil, stockpool.ErrNoEngines
+	}
+
+	pool, err := stockpool.NewStockPoolFromSpecs(specs)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool.Supervise(context.Background(), stockpool.HealthConfig{
+		CheckOnAcquire: true,
+		Interval:       time.Minute,
+	})
+
+	// scale the first engine between its configured count and the max
+	if flags.maxEngines > 0 {
+		err = pool.Autoscale(context.Background(), stockpool.AutoscaleConfig{
+			Min: specs[0].Count,
+			Max: flags.maxEngines,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return pool, specs, nil
+}
+
+/*
+	Searches mates with crystal when the engines have one and no mate engine
+	is configured, and rejects engine labels none of the engines have
+*/
+func setEngineLabels(specs []stockpool.EngineSpec, cfg *puzzlegen.AnalysisConfig) error {
+	if cfg.MateEngine == "" && hasEngine(specs, "crystal") {
+		cfg.MateEngine = "crystal"
+	}
+	for _, label := range []string{cfg.MateEngine, cfg.EvalEngine} {
+		if label != "" && !hasEngine(specs, label) {
+			return fmt.Errorf("%w -- %s", stockpool.ErrNoSuchEngine, label)
+		}
+	}
+
+	return nil
+}
+
+// whether one of specs has the label, specs without one get the default
+func hasEngine(specs []stockpool.EngineSpec, label string) bool {
+	for _, spec := range specs {
+		if spec.Label == label || spec.Label == "" && label == stockpool.DefaultLabel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the puzzles of path by ID, none if it does not exist yet
+func loadDedup(path string) (*puzzlegen.Dedup, error) {
+	dedup := puzzlegen.NewDedup()
+
+	f, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return dedup, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := &puzzlegen.Puzzles{}
+	err = json.Unmarshal(f, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, puzzle := range p.Puzzles {
+		dedup.Add(puzzle)
+	}
+
+	return dedup, nil
+}
+
+func write(puzzle puzzlegen.Puzzle) {
 	f, err := ioutil.ReadFile("puzzles.json")
 	if err != nil {
 		log.Printf("read error -- %s", err)
@@ -95,17 +440,6 @@ func write(fen string, mateIn int, sol *chess.Game) {
 		return
 	}
 
-	puzzle := puzzlegen.Puzzle{
-		Position: fen,
-		Solution: []string{},
-		MateIn:   mateIn,
-	}
-
-	solution := []string{}
-	for _, m := range sol.Moves() {
-		solution = append(solution, m.String())
-	}
-	puzzle.Solution = solution
 	p.Puzzles = append(p.Puzzles, puzzle)
 
 	b, err := json.Marshal(p)
@@ -0,0 +1,298 @@
+package fakeengine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+/*
+	A fake UCI engine for tests. It answers go from a table of positions to
+	scripted info/bestmove lines instead of searching, so puzzlegen and
+	beautify can be tested without stockfish.
+
+	Tests run it by re-executing their own binary:
+
+		func TestMain(m *testing.M) {
+			fakeengine.Main()
+			os.Exit(m.Run())
+		}
+
+		pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/script.json"), 1, 1)
+*/
+
+// EnvScript names the script file the test binary serves when it is run as an engine
+const EnvScript = "FAKEENGINE_SCRIPT"
+
+/*
+	Positions maps a FEN to the lines printed for go. Only the board, side
+	to move, castling and en passant fields are compared, and a missing
+	bestmove line is taken from the first pv. Positions not in the script
+	get a cp 0 answer with the first legal move
+
+	With Hang set go is only answered on stop, like an endless search, and
+	with IgnoreStop not even then, like an engine stuck in a search
+*/
+type Script struct {
+	Name       string              `json:"name"`
+	Positions  map[string][]string `json:"positions"`
+	Hang       bool                `json:"hang"`
+	IgnoreStop bool                `json:"ignore_stop"`
+}
+
+func Load(path string) (*Script, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	script := &Script{}
+	err = json.Unmarshal(b, script)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make(map[string][]string, len(script.Positions))
+	for fen, lines := range script.Positions {
+		positions[Key(fen)] = lines
+	}
+	script.Positions = positions
+
+	return script, nil
+}
+
+/*
+	Path makes the test binary serve script when it is started as an engine
+	and returns the path to start it with
+*/
+func Path(script string) string {
+	os.Setenv(EnvScript, script)
+	return os.Args[0]
+}
+
+/*
+	Main serves the script named by EnvScript on stdin and stdout and exits.
+	It returns straight away if the variable is not set
+*/
+func Main() {
+	path := os.Getenv(EnvScript)
+	if path == "" {
+		return
+	}
+
+	script, err := Load(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakeengine: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = Serve(os.Stdin, os.Stdout, script)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakeengine: %s\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Key is the part of a FEN the script is looked up by
+func Key(fen string) string {
+	fields := strings.Fields(fen)
+	if len(fields) > 4 {
+		fields = fields[:4]
+	}
+
+	return strings.Join(fields, " ")
+}
+
+/*
+	Serve speaks UCI on r and w until quit or the end of r
+*/
+func Serve(r io.Reader, w io.Writer, script *Script) error {
+	multiPV := 1
+	position := ""
+	searching := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var out []string
+		switch fields[0] {
+		case "uci":
+			out = append(out, "id name fakeengine "+script.Name, "id author chess-puzzle-gen")
+			out = append(out, options...)
+			out = append(out, "uciok")
+		case "isready":
+			out = append(out, "readyok")
+		case "setoption":
+			name, value := parseSetOption(fields)
+			if strings.EqualFold(name, "MultiPV") {
+				if v, err := strconv.Atoi(value); err == nil {
+					multiPV = v
+				}
+			}
+		case "position":
+			position = parsePosition(fields)
+		case "go":
+			searching = script.Hang
+			if !searching {
+				out = script.answer(position, multiPV)
+			}
+		case "stop":
+			if searching && !script.IgnoreStop {
+				searching = false
+				out = script.answer(position, multiPV)
+			}
+		case "quit":
+			return nil
+		}
+
+		for _, line := range out {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+var options = []string{
+	"option name Threads type spin default 1 min 1 max 512",
+	"option name Hash type spin default 16 min 1 max 33554432",
+	"option name Clear Hash type button",
+	"option name MultiPV type spin default 1 min 1 max 500",
+	"option name Skill Level type spin default 20 min 0 max 20",
+	"option name Contempt type spin default 24 min -100 max 100",
+	"option name SyzygyPath type string default <empty>",
+	"option name UCI_Chess960 type check default false",
+}
+
+/*
+	Scripted lines for the position, info lines above multiPV are dropped
+	like a real engine would
+*/
+func (s *Script) answer(position string, multiPV int) []string {
+	lines, ok := s.Positions[Key(position)]
+	if !ok {
+		return defaultAnswer(position)
+	}
+
+	out := []string{}
+	bestMove := ""
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "bestmove" {
+			bestMove = line
+			continue
+		}
+		if infoValue(fields, "multipv") > multiPV {
+			continue
+		}
+
+		out = append(out, line)
+	}
+
+	if bestMove == "" {
+		bestMove = "bestmove (none)"
+		for _, line := range out {
+			if pv := infoPV(strings.Fields(line)); pv != "" {
+				bestMove = "bestmove " + pv
+				break
+			}
+		}
+	}
+
+	return append(out, bestMove)
+}
+
+func defaultAnswer(position string) []string {
+	f, err := chess.FEN(position)
+	if err != nil {
+		return []string{"bestmove (none)"}
+	}
+
+	moves := chess.NewGame(f).ValidMoves()
+	if len(moves) == 0 {
+		return []string{"info depth 0 score cp 0", "bestmove (none)"}
+	}
+
+	move := moves[0].String()
+	return []string{
+		"info depth 1 multipv 1 score cp 0 nodes 1 pv " + move,
+		"bestmove " + move,
+	}
+}
+
+func parseSetOption(fields []string) (string, string) {
+	var name, value []string
+	var target *[]string
+	for _, f := range fields[1:] {
+		switch f {
+		case "name":
+			target = &name
+		case "value":
+			target = &value
+		default:
+			if target != nil {
+				*target = append(*target, f)
+			}
+		}
+	}
+
+	return strings.Join(name, " "), strings.Join(value, " ")
+}
+
+/*
+	Returns the FEN of a position command, moves after it are not played
+	since the generator always sends the position it wants searched
+*/
+func parsePosition(fields []string) string {
+	if len(fields) < 2 {
+		return ""
+	}
+	if fields[1] == "startpos" {
+		return chess.StartingPosition().String()
+	}
+
+	fen := []string{}
+	for _, f := range fields[2:] {
+		if f == "moves" {
+			break
+		}
+		fen = append(fen, f)
+	}
+
+	return strings.Join(fen, " ")
+}
+
+func infoValue(fields []string, name string) int {
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == name {
+			v, _ := strconv.Atoi(fields[i+1])
+			return v
+		}
+	}
+
+	return 0
+}
+
+func infoPV(fields []string) string {
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "pv" {
+			return fields[i+1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,85 @@
+package fakeengine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	script := &Script{
+		Name: "test",
+		Positions: map[string][]string{
+			Key("6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1"): {
+				"info depth 5 multipv 1 score mate 1 pv a1a8",
+				"info depth 5 multipv 2 score cp 300 pv a1a2",
+			},
+		},
+	}
+
+	in := strings.Join([]string{
+		"isready",
+		"setoption name MultiPV value 1",
+		"position fen 6k1/5ppp/8/8/8/8/8/R5K1 w - - 3 12",
+		"go depth 5",
+		"position fen 4k3/8/8/8/8/8/8/4K2R w K - 0 1",
+		"go depth 5",
+		"quit",
+		"isready",
+	}, "\n")
+
+	out := &bytes.Buffer{}
+	err := Serve(strings.NewReader(in), out, script)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"readyok",
+		"info depth 5 multipv 1 score mate 1 pv a1a8",
+		"bestmove a1a8",
+	}
+	if len(lines) != 5 {
+		t.Fatalf("unexpected output -- %q", lines)
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Fatalf("expected %q, got %q", line, lines[i])
+		}
+	}
+	if !strings.HasPrefix(lines[3], "info depth 1 multipv 1 score cp 0") || !strings.HasPrefix(lines[4], "bestmove ") {
+		t.Fatalf("expected the default answer, got %q", lines[3:])
+	}
+}
+
+func TestServeHang(t *testing.T) {
+	in := strings.Join([]string{
+		"position fen 4k3/8/8/8/8/8/8/4K2R w K - 0 1",
+		"go infinite",
+		"isready",
+		"stop",
+		"quit",
+	}, "\n")
+
+	tests := []struct {
+		script   *Script
+		expected int
+	}{
+		{&Script{Hang: true}, 3},
+		{&Script{Hang: true, IgnoreStop: true}, 1},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		err := Serve(strings.NewReader(in), out, test.script)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		// readyok comes first, the search only answers stop
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != test.expected || lines[0] != "readyok" {
+			t.Fatalf("%+v -- unexpected output %q", test.script, lines)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package puzzlegen
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"unicode"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+/*
+	The king between two rooks on the back rank, the black pieces mirror
+	the white ones like in the starting positions of Chess960
+*/
+func chess960Homes(r *rand.Rand) map[rune][]int8 {
+	king := int8(r.Intn(6) + 1)
+	queenRook := int8(r.Intn(int(king)))
+	kingRook := king + 1 + int8(r.Intn(int(7-king)))
+
+	return map[rune][]int8{
+		'K': {squareHash(7, king)},
+		'R': {squareHash(7, kingRook), squareHash(7, queenRook)},
+		'k': {squareHash(0, king)},
+		'r': {squareHash(0, kingRook), squareHash(0, queenRook)},
+	}
+}
+
+// the Shredder rights of the rooks of homes
+func chess960Castling(homes map[rune][]int8) string {
+	rights := ""
+	for _, rook := range "Rr" {
+		for _, sq := range homes[rook] {
+			file := rune('a' + sq%8)
+			if rook == 'R' {
+				file = unicode.ToUpper(file)
+			}
+			rights += string(file)
+		}
+	}
+
+	return rights
+}
+
+/*
+	Chess960 castling rights are written as Shredder-FEN, the file of the
+	rook of each right, upper case for white, like HAha for rooks on the a
+	and h files. X-FEN rights, KQkq meaning the outermost rook on that side
+	of the king, become the file of their rook. A right without a rook is
+	kept as it is so canCastle960 rejects it
+*/
+func shredderRights(board [8][8]int8, castling string) (string, error) {
+	if castling == "-" {
+		return "", nil
+	}
+
+	rights := ""
+	for _, right := range castling {
+		switch {
+		case strings.ContainsRune("KQkq", right):
+			if file, ok := outermostRook(board, right); ok {
+				right = file
+			}
+		case !strings.ContainsRune("ABCDEFGHabcdefgh", right):
+			return "", fmt.Errorf("castling rights %q", castling)
+		}
+
+		if strings.ContainsRune(rights, right) {
+			return "", fmt.Errorf("castling rights %q", castling)
+		}
+		rights += string(right)
+	}
+
+	return rights, nil
+}
+
+// the file of the rook on the far side of the king an X-FEN right stands for
+func outermostRook(board [8][8]int8, right rune) (rune, bool) {
+	row, king, rook := int8(7), PieceToBit['K'], PieceToBit['R']
+	if unicode.IsLower(right) {
+		row, king, rook = 0, PieceToBit['k'], PieceToBit['r']
+	}
+
+	col, ok := backRankKing(board, row, king)
+	if !ok {
+		return 0, false
+	}
+
+	step, end := int8(1), int8(8)
+	if unicode.ToUpper(right) == 'Q' {
+		step, end = -1, -1
+	}
+
+	file, found := rune(0), false
+	for c := col + step; c != end; c += step {
+		if board[row][c] == rook {
+			file, found = rune('a'+c), true
+		}
+	}
+	if found && unicode.IsUpper(right) {
+		file = unicode.ToUpper(file)
+	}
+
+	return file, found
+}
+
+func backRankKing(board [8][8]int8, row int8, king int8) (int8, bool) {
+	for col := int8(0); col < 8; col++ {
+		if board[row][col] == king {
+			return col, true
+		}
+	}
+
+	return 0, false
+}
+
+/*
+	The king stands on its back rank off the corner files, a king there
+	never starts between two rooks, and the rook of the right on the same
+	rank
+*/
+func canCastle960(board [8][8]int8, right rune) bool {
+	row, king, rook := int8(7), PieceToBit['K'], PieceToBit['R']
+	if unicode.IsLower(right) {
+		row, king, rook = 0, PieceToBit['k'], PieceToBit['r']
+	}
+
+	file := int8(unicode.ToLower(right) - 'a')
+	if file < 0 || file > 7 || board[row][file] != rook {
+		return false
+	}
+
+	col, ok := backRankKing(board, row, king)
+	return ok && col > 0 && col < 7 && col != file
+}
+
+/*
+	The rights of castling the position allows in the order of the file
+	letters, at most one on each side of each king
+*/
+func chess960Rights(board [8][8]int8, castling string) string {
+	rights := ""
+	for _, right := range "HGFEDCBAhgfedcba" {
+		if strings.ContainsRune(castling, right) && canCastle960(board, right) && !sameSide(board, rights, right) {
+			rights += string(right)
+		}
+	}
+
+	return rights
+}
+
+// whether rights already has a right of the color of right on the same side of the king
+func sameSide(board [8][8]int8, rights string, right rune) bool {
+	row, king := int8(7), PieceToBit['K']
+	if unicode.IsLower(right) {
+		row, king = 0, PieceToBit['k']
+	}
+	col, ok := backRankKing(board, row, king)
+	if !ok {
+		return false
+	}
+
+	side := int8(unicode.ToLower(right)-'a') > col
+	for _, r := range rights {
+		if unicode.IsLower(r) == unicode.IsLower(right) && (int8(unicode.ToLower(r)-'a') > col) == side {
+			return true
+		}
+	}
+
+	return false
+}
+
+// whether a castling field has rights only Chess960 can have
+func isChess960(castling string) bool {
+	return strings.ContainsAny(castling, "ABCDEFGHabcdefgh")
+}
+
+/*
+	The rights left after m is played in position, a right is lost once its
+	king or rook moves or the rook is taken
+*/
+func castlingAfter(position *chess.Position, rights string, m *chess.Move) string {
+	if rights == "" || m == nil {
+		return rights
+	}
+	board, err := parseBoard(position.Board().String())
+	if err != nil {
+		return ""
+	}
+
+	from, to := boardSquare(m.S1()), boardSquare(m.S2())
+	kept := ""
+	for _, right := range rights {
+		row, king := int8(7), PieceToBit['K']
+		if unicode.IsLower(right) {
+			row, king = 0, PieceToBit['k']
+		}
+
+		rook := squareHash(row, int8(unicode.ToLower(right)-'a'))
+		if from == rook || to == rook || board[from/8][from%8] == king {
+			continue
+		}
+		kept += string(right)
+	}
+
+	return kept
+}
+
+// the square of go-chess, a1 is 0, in board coordinates
+func boardSquare(sq chess.Square) int8 {
+	return squareHash(int8(7-sq.Rank()), int8(sq.File()))
+}
+
+// fen with its castling field replaced by rights, none writes -
+func withCastling(fen string, rights string) string {
+	fields := strings.Fields(fen)
+	if len(fields) < 3 {
+		return fen
+	}
+
+	if rights == "" {
+		rights = "-"
+	}
+	fields[2] = rights
+
+	return strings.Join(fields, " ")
+}
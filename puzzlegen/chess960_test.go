@@ -0,0 +1,189 @@
+package puzzlegen
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+func TestShredderRights(t *testing.T) {
+	tests := []struct {
+		placement string
+		castling  string
+		rights    string
+		err       bool
+	}{
+		{"rk2r3/8/8/8/8/8/8/RK2R3", "-", "", false},
+		{"rk2r3/8/8/8/8/8/8/RK2R3", "EAea", "EAea", false},
+		// the outermost rook on each side of the king
+		{"rk2r2r/8/8/8/8/8/8/RK2R2R", "KQkq", "HAha", false},
+		{"rk2r3/8/8/8/8/8/8/RK2R3", "KX", "", true},
+		{"rk2r3/8/8/8/8/8/8/RK2R3", "EE", "", true},
+	}
+	for _, test := range tests {
+		board, err := parseBoard(test.placement)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		rights, err := shredderRights(board, test.castling)
+		if (err != nil) != test.err {
+			t.Fatalf("%s %s -- unexpected error %v", test.placement, test.castling, err)
+		}
+		if rights != test.rights {
+			t.Fatalf("%s %s -- expected %s, got %s", test.placement, test.castling, test.rights, rights)
+		}
+	}
+}
+
+func TestValidatePosition960(t *testing.T) {
+	tests := []struct {
+		fen  string
+		errs []error
+	}{
+		{fen: "bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w GEge - 0 1"},
+		{fen: "bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w KQkq - 0 1"},
+		{fen: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w HAha - 0 1"},
+		{fen: "bqnbrkrn/pppppppp/8/8/8/8/PPPPPPPP/BQNBRKRN w Gd - 0 1", errs: []error{ErrCastlingRights}},
+		{fen: "7k/8/8/8/8/8/8/RK2R3 w EA - 0 1"},
+		// a king in the corner never starts between its rooks
+		{fen: "4k3/8/8/8/8/8/8/K2R4 w D - 0 1", errs: []error{ErrCastlingRights}},
+		{fen: "4k3/8/8/8/8/8/8/1RRK4 w CB - 0 1", errs: []error{ErrCastlingRights}},
+		{fen: "4k3/8/8/8/8/8/8/1RRK4 w CZ - 0 1", errs: []error{ErrInvalidFEN}},
+	}
+	for _, test := range tests {
+		violations := ValidatePosition960(test.fen)
+		if len(violations) != len(test.errs) {
+			t.Fatalf("%s -- expected %v, got %v", test.fen, test.errs, violations)
+		}
+		for i, err := range test.errs {
+			if !errors.Is(violations[i], err) {
+				t.Fatalf("%s -- expected %v, got %v", test.fen, test.errs, violations)
+			}
+		}
+	}
+
+	// orthodox validation does not read rook files
+	if violations := ValidatePosition("rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w HAha - 0 1"); len(violations) != 1 {
+		t.Fatalf("expected the rights to be unreadable, got %v", violations)
+	}
+}
+
+func TestChess960Generated(t *testing.T) {
+	cfg := PuzzleConfig{
+		WhiteQ:   1,
+		WhiteR:   2,
+		WhiteP:   6,
+		BlackQ:   1,
+		BlackR:   2,
+		BlackP:   6,
+		Castling: true,
+		Chess960: true,
+	}
+
+	castled, unorthodox := 0, 0
+	for seed := int64(1); seed <= 200; seed++ {
+		fen, _, err := GenerateRandomFEN(cfg, NewRand(seed))
+		if errors.Is(err, ErrInvalidPosition) {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if violations := ValidatePosition960(fen); violations != nil {
+			t.Fatalf("%s -- %v", fen, violations)
+		}
+
+		rights := strings.Fields(fen)[2]
+		if rights != "-" {
+			castled++
+			if !isChess960(rights) {
+				t.Fatalf("%s -- expected Shredder-FEN rights", fen)
+			}
+		}
+		if rights != "-" && rights != "HAha" {
+			unorthodox++
+		}
+
+		// mutations keep the rights their king and rook allow
+		for i := int64(0); i < 5; i++ {
+			next, err := MutateFEN(fen, 8, NewRand(seed*10+i))
+			if errors.Is(err, ErrInvalidPosition) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+			if violations := ValidatePosition960(next); violations != nil {
+				t.Fatalf("%s -- %v", next, violations)
+			}
+			fen = next
+		}
+	}
+
+	if castled == 0 || unorthodox == 0 {
+		t.Fatalf("expected Chess960 castling rights, got %d and %d", castled, unorthodox)
+	}
+}
+
+func TestCastlingAfter(t *testing.T) {
+	f, err := chess.FEN("4k3/8/8/8/8/8/8/R3K2R w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	position := chess.NewGame(f).Position()
+
+	tests := []struct {
+		move   string
+		rights string
+	}{
+		{"h1h4", "Aa"},
+		{"a1a8", "H"},
+		{"e1e2", "a"},
+		{"e1f1", "a"},
+	}
+	for _, test := range tests {
+		m, err := chess.UCINotation{}.Decode(position, test.move)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		rights := castlingAfter(position, "HAa", m)
+		if rights != test.rights {
+			t.Fatalf("%s -- expected %s, got %s", test.move, test.rights, rights)
+		}
+	}
+}
+
+func TestChess960Search(t *testing.T) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/chess960.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	puzzles := []Puzzle{}
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{Depth: 20, MultiPV: 1},
+	}, pool, func(p Puzzle) { puzzles = append(puzzles, p) }, 10).(*MatePuzzleGenerator)
+	t.Cleanup(gen.Close)
+
+	// the engine only has a mate for the position with its rights
+	puzzle, _ := gen.search(gen.ctx, candidate{fen: "2k5/R7/8/8/8/8/8/4K2R w H - 0 1", chess960: true})
+	if puzzle == nil || !puzzle.Chess960 || strings.Join(puzzle.Solution, " ") != "h1h8" {
+		t.Fatalf("expected the Chess960 mate, got %+v", puzzle)
+	}
+
+	// go-chess cannot play king takes rook castling
+	puzzle, res := gen.search(gen.ctx, candidate{fen: "4k3/8/8/8/8/8/8/R3K3 w A - 0 1", chess960: true})
+	if puzzle != nil || res == nil || res.Best().Score.Mate != 3 {
+		t.Fatalf("expected the castling line to be dropped, got %+v", puzzle)
+	}
+
+	if len(puzzles) != 1 {
+		t.Fatalf("expected 1 puzzle written, got %d", len(puzzles))
+	}
+}
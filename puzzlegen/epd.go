@@ -0,0 +1,359 @@
+package puzzlegen
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+)
+
+var ErrInvalidEPD = errors.New("invalid epd")
+
+/*
+	Paths are EPD or FEN files with one position a line, or directories
+	searched for .epd and .fen files. Blank lines and lines starting with #
+	are skipped. With PuzzleConfig.Chess960 the castling rights are read as
+	Shredder-FEN or X-FEN. The result of every line is appended to Report as a JSON
+	line, lines already in it are skipped so a stopped run resumes where it
+	left off
+*/
+type EPDConfig struct {
+	Paths  []string `yaml:"paths"`
+	Report string   `yaml:"report"`
+}
+
+/*
+	The result of one line of a position file. Puzzle is nil when the
+	position has no unique mate, Error is set when it could not be searched.
+	DM is the dm opcode of the line, DMMatch whether the puzzle mates in
+	that many moves
+*/
+type LineResult struct {
+	File    string  `json:"file"`
+	Line    int     `json:"line"`
+	ID      string  `json:"id,omitempty"`
+	FEN     string  `json:"fen,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	Puzzle  *Puzzle `json:"puzzle,omitempty"`
+	MateIn  int     `json:"mate_in,omitempty"`
+	CP      int     `json:"cp"`
+	DM      int     `json:"dm,omitempty"`
+	DMMatch *bool   `json:"dm_match,omitempty"`
+}
+
+// queues the position of every line of the configured files
+func (g *MatePuzzleGenerator) readPositions(ctx context.Context) {
+	for _, path := range g.cfg.EPD.Paths {
+		files, err := inputFiles(path, ".epd", ".fen")
+		if err != nil {
+			log.Printf("error -- %s", err)
+		}
+
+		for _, file := range files {
+			err := g.readEPD(ctx, file)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("error -- %s -- %s", err, file)
+			}
+		}
+	}
+}
+
+/*
+	Queues the position of every line of the file the report does not have
+	yet, lines that cannot be read are reported at once
+*/
+func (g *MatePuzzleGenerator) readEPD(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || g.report.Done(path, n) {
+			continue
+		}
+
+		fen, ops, err := parseEPD(line)
+		if err == nil {
+			err = validFEN(fen, g.cfg.Chess960)
+		}
+		// X-FEN rights are searched as Shredder-FEN
+		if err == nil && g.cfg.Chess960 {
+			fen = repairFEN(fen, true)
+		}
+
+		source := &Source{File: path, Line: n, ID: ops["id"]}
+		if err != nil {
+			g.report.Write(LineResult{File: path, Line: n, ID: source.ID, FEN: fen, Error: err.Error()})
+			continue
+		}
+
+		c := candidate{fen: fen, source: source, chess960: g.cfg.Chess960}
+		if dm, ok := ops["dm"]; ok {
+			c.dm, err = strconv.Atoi(dm)
+			if err != nil {
+				g.report.Write(LineResult{File: path, Line: n, ID: source.ID, FEN: fen, Error: fmt.Sprintf("%s -- dm %q", ErrInvalidEPD, dm)})
+				continue
+			}
+		}
+
+		select {
+		case g.q <- c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return scanner.Err()
+}
+
+/*
+	Reports the search of a line of a position file. A line without a search
+	result that go-chess can read failed for a reason of its own, no engine
+	or a shutdown, and is left out so a resumed run searches it again
+*/
+func (g *MatePuzzleGenerator) reportLine(c candidate, puzzle *Puzzle, res *analysis.Result) {
+	result := LineResult{
+		File:   c.source.File,
+		Line:   c.source.Line,
+		ID:     c.source.ID,
+		FEN:    c.fen,
+		Puzzle: puzzle,
+		DM:     c.dm,
+	}
+
+	if res != nil {
+		result.MateIn = res.Best().Score.Mate
+		result.CP = res.Best().Score.CP
+	} else {
+		_, err := analysis.ParseFEN(c.fen)
+		if err == nil {
+			log.Printf("error -- no search result -- %s line %d is searched again on resume", c.source.File, c.source.Line)
+			return
+		}
+		result.Error = err.Error()
+	}
+
+	if c.dm != 0 {
+		match := puzzle != nil && puzzle.MateIn == c.dm
+		result.DMMatch = &match
+	}
+
+	g.report.Write(result)
+}
+
+/*
+	Reads an EPD line, the four position fields followed by opcodes like
+	id "name"; dm 2; or a FEN line with its move counters. The counters of
+	an EPD line come from its hmvc and fmvn opcodes
+*/
+func parseEPD(line string) (string, map[string]string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return "", nil, fmt.Errorf("%w -- expected at least 4 fields", ErrInvalidEPD)
+	}
+
+	position := strings.Join(fields[:4], " ")
+
+	// a fen has its counters where an epd has its opcodes
+	if len(fields) >= 6 && isCounter(fields[4]) && isCounter(fields[5]) {
+		ops, err := parseOpcodes(afterFields(line, 6))
+		return position + " " + fields[4] + " " + fields[5], ops, err
+	}
+
+	ops, err := parseOpcodes(afterFields(line, 4))
+	if err != nil {
+		return "", nil, err
+	}
+
+	halfmove, fullmove := "0", "1"
+	if v, ok := ops["hmvc"]; ok && isCounter(v) {
+		halfmove = v
+	}
+	if v, ok := ops["fmvn"]; ok && isCounter(v) {
+		fullmove = v
+	}
+
+	return position + " " + halfmove + " " + fullmove, ops, nil
+}
+
+/*
+	Reads opcodes ended by semicolons, an operand in quotes may hold
+	semicolons and spaces. Opcodes with several operands keep them joined
+	by spaces
+*/
+func parseOpcodes(s string) (map[string]string, error) {
+	ops := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		end, quoted := -1, false
+		for i, c := range s {
+			if c == '"' {
+				quoted = !quoted
+			}
+			if c == ';' && !quoted {
+				end = i
+				break
+			}
+		}
+		if quoted {
+			return nil, fmt.Errorf("%w -- unterminated string", ErrInvalidEPD)
+		}
+
+		op := s
+		if end >= 0 {
+			op, s = s[:end], s[end+1:]
+		} else {
+			s = ""
+		}
+
+		name, operand, _ := strings.Cut(strings.TrimSpace(op), " ")
+		if name == "" {
+			continue
+		}
+		ops[name] = strings.Trim(strings.TrimSpace(operand), `"`)
+	}
+
+	return ops, nil
+}
+
+// the text of s after its first n fields
+func afterFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeft(s, " \t")
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func isCounter(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0
+}
+
+// the fen is readable and passes ValidatePosition, or ValidatePosition960
+func validFEN(fen string, chess960 bool) error {
+	violations := validatePosition(fen, chess960)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	details := []string{}
+	for _, v := range violations {
+		details = append(details, v.Error())
+	}
+	return fmt.Errorf("%w -- %s", ErrInvalidPosition, strings.Join(details, ", "))
+}
+
+/*
+	The JSON lines of LineResult of a run, with the lines of earlier runs.
+	A nil report only logs
+*/
+type lineReport struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]map[int]bool
+}
+
+/*
+	Opens the report at path for appending, the lines it has results for
+	are done. A last line cut off by a crash is searched again
+*/
+func openReport(path string) (*lineReport, error) {
+	r := &lineReport{done: map[string]map[int]bool{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		var result LineResult
+		if json.Unmarshal([]byte(line), &result) != nil {
+			continue
+		}
+		r.markDone(result.File, result.Line)
+	}
+
+	// the cut off line is dropped
+	if end := strings.LastIndexByte(string(data), '\n') + 1; end < len(data) {
+		err = os.Truncate(path, int64(end))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *lineReport) markDone(file string, line int) {
+	if r.done[file] == nil {
+		r.done[file] = map[int]bool{}
+	}
+	r.done[file][line] = true
+}
+
+func (r *lineReport) Done(file string, line int) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done[file][line]
+}
+
+func (r *lineReport) Write(result LineResult) {
+	switch {
+	case result.Error != "":
+		log.Printf("error -- %s line %d -- %s", result.File, result.Line, result.Error)
+	case result.Puzzle != nil:
+		log.Printf("%s line %d -- mate in %d", result.File, result.Line, result.Puzzle.MateIn)
+	default:
+		log.Printf("%s line %d -- no puzzle", result.File, result.Line)
+	}
+	if r == nil {
+		return
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("error -- %s", err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("error -- writing report -- %s", err)
+		return
+	}
+	r.markDone(result.File, result.Line)
+}
+
+func (r *lineReport) Close() error {
+	return r.f.Close()
+}
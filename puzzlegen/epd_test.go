@@ -0,0 +1,214 @@
+package puzzlegen
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+)
+
+func TestParseEPD(t *testing.T) {
+	tests := []struct {
+		line string
+		fen  string
+		ops  map[string]string
+		err  error
+	}{
+		{
+			line: `k7/8/2K5/8/8/8/8/7R w - - id "a; b"; dm 2;`,
+			fen:  "k7/8/2K5/8/8/8/8/7R w - - 0 1",
+			ops:  map[string]string{"id": "a; b", "dm": "2"},
+		},
+		{
+			line: "k7/8/2K5/8/8/8/8/7R w - - 3 40",
+			fen:  "k7/8/2K5/8/8/8/8/7R w - - 3 40",
+			ops:  map[string]string{},
+		},
+		{
+			line: "k7/8/2K5/8/8/8/8/7R b - - hmvc 3; fmvn 40; bm Kb8",
+			fen:  "k7/8/2K5/8/8/8/8/7R b - - 3 40",
+			ops:  map[string]string{"hmvc": "3", "fmvn": "40", "bm": "Kb8"},
+		},
+		{line: "k7/8/2K5/8/8/8/8/7R w -", err: ErrInvalidEPD},
+		{line: `k7/8/2K5/8/8/8/8/7R w - - id "open`, err: ErrInvalidEPD},
+	}
+	for _, test := range tests {
+		fen, ops, err := parseEPD(test.line)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%s -- expected error %v, got %v", test.line, test.err, err)
+		}
+		if test.err != nil {
+			continue
+		}
+
+		if fen != test.fen {
+			t.Fatalf("%s -- expected %s, got %s", test.line, test.fen, fen)
+		}
+		if len(ops) != len(test.ops) {
+			t.Fatalf("%s -- expected %v, got %v", test.line, test.ops, ops)
+		}
+		for name, operand := range test.ops {
+			if ops[name] != operand {
+				t.Fatalf("%s -- expected %v, got %v", test.line, test.ops, ops)
+			}
+		}
+	}
+}
+
+func runEPD(t *testing.T, report string) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{
+			Depth:   20,
+			MultiPV: 3,
+		},
+		EPD: EPDConfig{
+			Paths:  []string{"testdata/epd"},
+			Report: report,
+		},
+		InputOnly: true,
+	}, pool, func(Puzzle) {}, 10).(*MatePuzzleGenerator)
+	defer gen.Close()
+
+	gen.Start()
+	done := make(chan struct{})
+	go func() {
+		gen.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected every line to be searched")
+	}
+}
+
+func readReport(t *testing.T, path string) map[int]LineResult {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer f.Close()
+
+	results := map[int]LineResult{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		var result LineResult
+		err := json.Unmarshal(scanner.Bytes(), &result)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if _, ok := results[result.Line]; ok {
+			t.Fatalf("line %d reported twice", result.Line)
+		}
+		results[result.Line] = result
+	}
+
+	return results
+}
+
+func TestEPDInput(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.jsonl")
+	runEPD(t, report)
+
+	results := readReport(t, report)
+	if len(results) != 5 {
+		t.Fatalf("expected 5 lines reported, got %d", len(results))
+	}
+
+	first := results[1]
+	if first.ID != "rook mate; two moves" || first.Puzzle == nil || first.DMMatch == nil || !*first.DMMatch {
+		t.Fatalf("expected the mate in 2 of line 1, got %+v", first)
+	}
+	if first.Puzzle.Source == nil || first.Puzzle.Source.Line != 1 || first.Puzzle.Source.File != "testdata/epd/positions.epd" {
+		t.Fatalf("expected the puzzle to come from line 1, got %+v", first.Puzzle.Source)
+	}
+	if results[4].Puzzle != nil || results[4].Error != "" || results[4].MateIn != 1 {
+		t.Fatalf("expected no puzzle for two mates in 1, got %+v", results[4])
+	}
+	if !strings.Contains(results[5].Error, ErrInvalidEPD.Error()) {
+		t.Fatalf("expected line 5 to be unreadable, got %+v", results[5])
+	}
+	if results[6].Puzzle == nil || results[6].DMMatch == nil || *results[6].DMMatch {
+		t.Fatalf("expected a mate in 1 that misses dm 2, got %+v", results[6])
+	}
+	if !strings.Contains(results[7].Error, ErrInCheck.Error()) {
+		t.Fatalf("expected line 7 to be invalid, got %+v", results[7])
+	}
+}
+
+func TestEPDResume(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.jsonl")
+	runEPD(t, report)
+
+	// a run stopped after 2 lines, the third cut off while it was written
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	stopped := strings.Join(lines[:2], "") + lines[2][:10]
+	err = os.WriteFile(report, []byte(stopped), 0644)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	runEPD(t, report)
+	if results := readReport(t, report); len(results) != 5 {
+		t.Fatalf("expected 5 lines reported, got %d", len(results))
+	}
+
+	// nothing is left to search
+	runEPD(t, report)
+	if results := readReport(t, report); len(results) != 5 {
+		t.Fatalf("expected 5 lines reported, got %d", len(results))
+	}
+}
+
+func TestEPDNoSearchResult(t *testing.T) {
+	report := filepath.Join(t.TempDir(), "report.jsonl")
+	r, err := openReport(report)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	gen := &MatePuzzleGenerator{report: r}
+
+	// no engine answered, the line is searched again
+	source := &Source{File: "positions.epd", Line: 1}
+	gen.reportLine(candidate{fen: "k7/8/2K5/8/8/8/8/7R w - - 0 1", source: source}, nil, nil)
+	if r.Done(source.File, source.Line) {
+		t.Fatalf("expected line 1 to be searched again")
+	}
+
+	// go-chess cannot read the position, searching it again cannot help
+	broken := &Source{File: "positions.epd", Line: 2}
+	gen.reportLine(candidate{fen: "k7/8/2K5/8/8/8/8/7R x - - 0 1", source: broken}, nil, nil)
+	if !r.Done(broken.File, broken.Line) {
+		t.Fatalf("expected line 2 to be reported")
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	results := readReport(t, report)
+	if len(results) != 1 || results[2].Error == "" {
+		t.Fatalf("expected only the error of line 2, got %+v", results)
+	}
+}
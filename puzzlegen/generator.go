@@ -1,14 +1,18 @@
 package puzzlegen
 
 import (
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
 	chess "github.com/garlicgarrison/go-chess"
-	"github.com/garlicgarrison/go-chess/uci"
 )
 
 type Generator[T any] interface {
 	Start()
+	Wait()
 	Close()
 
-	Create(*chess.Position) (*chess.Game, *uci.SearchResults)
-	Analyze(*chess.Position, int, int) *uci.SearchResults
+	Create(*chess.Position) (*chess.Game, *analysis.Result)
+	// CreateFEN is Create for a FEN, whose castling rights are Chess960
+	// ones with chess960 set
+	CreateFEN(fen string, chess960 bool) (*chess.Game, *analysis.Result)
+	Analyze(*chess.Position, int, int) *analysis.Result
 }
@@ -0,0 +1,236 @@
+package puzzlegen
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/*
+	The keys of the Zobrist hash are drawn from a fixed seed so a position
+	hashes the same in every run, puzzle IDs depend on it never changing
+*/
+const zobristSeed = 0x5a0b7157
+
+var zobrist = newZobristKeys()
+
+type zobristKeys struct {
+	pieces    map[rune][64]uint64
+	castling  map[rune]uint64
+	enPassant [8]uint64
+	black     uint64
+}
+
+func newZobristKeys() zobristKeys {
+	r := NewRand(zobristSeed)
+	keys := zobristKeys{
+		pieces:   map[rune][64]uint64{},
+		castling: map[rune]uint64{},
+	}
+
+	// in a fixed order, ranging over a map would change the keys every run
+	for _, piece := range "PNBRQKpnbrqk" {
+		squares := [64]uint64{}
+		for sq := range squares {
+			squares[sq] = r.Uint64()
+		}
+		keys.pieces[piece] = squares
+	}
+	for _, right := range "KQkqABCDEFGHabcdefgh" {
+		keys.castling[right] = r.Uint64()
+	}
+	for file := range keys.enPassant {
+		keys.enPassant[file] = r.Uint64()
+	}
+	keys.black = r.Uint64()
+
+	return keys
+}
+
+/*
+	The Zobrist hash of the pieces, side to move, castling rights and en
+	passant square of fen, the move counters are not hashed
+*/
+func Zobrist(fen string) (uint64, error) {
+	p, err := parseMutable(fen)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.zobrist(), nil
+}
+
+func (p *mutable) zobrist() uint64 {
+	var h uint64
+	for _, sq := range p.pieces(true) {
+		h ^= zobrist.pieces[p.piece(sq)][sq]
+	}
+	for _, right := range p.castling {
+		h ^= zobrist.castling[right]
+	}
+	if p.enPassant >= 0 {
+		h ^= zobrist.enPassant[p.enPassant%8]
+	}
+	if !p.white {
+		h ^= zobrist.black
+	}
+
+	return h
+}
+
+/*
+	The same position for every fen that only differs by symmetry, as its
+	four position fields. The colors can always be flipped, with the board
+	turned upside down and the other side to move, and the board can be
+	mirrored from the a to the h file when no castling right depends on the
+	files. The canonical form is the smallest of these
+*/
+func CanonicalFEN(fen string) (string, error) {
+	p, err := parseMutable(fen)
+	if err != nil {
+		return "", err
+	}
+
+	return p.canonical().String(), nil
+}
+
+/*
+	The stable ID of the puzzle of fen, the hash of its canonical form in
+	hex. Mirrored and color flipped puzzles share their ID
+*/
+func PuzzleID(fen string) (string, error) {
+	p, err := parseMutable(fen)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%016x", p.canonical().zobrist()), nil
+}
+
+func (p *mutable) canonical() *mutable {
+	if p.castling == "-" {
+		p.castling = ""
+	}
+
+	variants := []*mutable{p, p.flipped()}
+	if p.castling == "" {
+		for _, v := range variants[:2] {
+			mirrored := *v
+			mirrorBoard(&mirrored, nil)
+			variants = append(variants, &mirrored)
+		}
+	}
+
+	best := variants[0]
+	for _, v := range variants[1:] {
+		if v.String() < best.String() {
+			best = v
+		}
+	}
+
+	return best
+}
+
+// the position with the colors swapped and the board turned upside down
+func (p *mutable) flipped() *mutable {
+	flipped := &mutable{
+		white:     !p.white,
+		enPassant: -1,
+		chess960:  p.chess960,
+	}
+
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			if piece, ok := BitToPiece[p.board[row][col]]; ok {
+				flipped.board[7-row][col] = PieceToBit[swapCase(piece)]
+			}
+		}
+	}
+	for _, right := range p.castling {
+		flipped.castling += string(swapCase(right))
+	}
+	if p.enPassant >= 0 {
+		flipped.enPassant = squareHash(7-p.enPassant/8, p.enPassant%8)
+	}
+
+	return flipped
+}
+
+// the four position fields, castling rights in a fixed order
+func (p *mutable) String() string {
+	var sb strings.Builder
+	writePlacement(&sb, p.board)
+
+	if p.white {
+		sb.WriteString(" w ")
+	} else {
+		sb.WriteString(" b ")
+	}
+
+	rights := ""
+	for _, right := range "KQkqHGFEDCBAhgfedcba" {
+		if strings.ContainsRune(p.castling, right) {
+			rights += string(right)
+		}
+	}
+	if rights == "" {
+		rights = "-"
+	}
+	sb.WriteString(rights)
+
+	if p.enPassant >= 0 {
+		sb.WriteString(" " + squareName(p.enPassant))
+	} else {
+		sb.WriteString(" -")
+	}
+
+	return sb.String()
+}
+
+func swapCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+/*
+	Dedup remembers the puzzles it was given by ID, so a writer can skip a
+	puzzle it already wrote or its mirror image. It is safe for concurrent
+	use
+*/
+type Dedup struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func NewDedup() *Dedup {
+	return &Dedup{seen: map[string]bool{}}
+}
+
+/*
+	Add remembers the puzzle and reports whether it is new. Puzzles without
+	an ID get the ID of their position, puzzles whose position cannot be
+	read are always new
+*/
+func (d *Dedup) Add(puzzle Puzzle) bool {
+	id := puzzle.ID
+	if id == "" {
+		var err error
+		id, err = PuzzleID(puzzle.Position)
+		if err != nil {
+			log.Printf("error -- %s -- position: %s", err, puzzle.Position)
+			return true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[id] {
+		return false
+	}
+	d.seen[id] = true
+	return true
+}
@@ -0,0 +1,122 @@
+package puzzlegen
+
+import (
+	"testing"
+)
+
+func TestZobrist(t *testing.T) {
+	a, err := Zobrist("k7/8/2K5/8/8/8/8/7R w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	// the move counters are not part of the position
+	b, err := Zobrist("k7/8/2K5/8/8/8/8/7R w - - 12 40")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if a != b {
+		t.Fatalf("expected the counters to be ignored, got %x and %x", a, b)
+	}
+
+	for _, fen := range []string{
+		"k7/8/2K5/8/8/8/8/7R b - - 0 1",
+		"k7/8/2K5/8/8/8/8/6R1 w - - 0 1",
+		"k7/8/2K5/8/8/8/8/7Q w - - 0 1",
+	} {
+		h, err := Zobrist(fen)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if h == a {
+			t.Fatalf("%s -- expected a different hash", fen)
+		}
+	}
+
+	if _, err := Zobrist("8/8 w - -"); err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestCanonicalFEN(t *testing.T) {
+	tests := []struct {
+		fens []string
+		same bool
+	}{
+		// mirrored and color flipped
+		{[]string{
+			"k7/8/2K5/8/8/8/8/7R w - - 0 1",
+			"7k/8/5K2/8/8/8/8/R7 w - - 0 1",
+			"7r/8/8/8/8/2k5/8/K7 b - - 0 1",
+			"r7/8/8/8/8/5k2/8/7K b - - 0 1",
+		}, true},
+		{[]string{
+			"4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1",
+			"3k4/8/8/3Pp3/8/8/8/3K4 w - e6 0 1",
+			"4k3/8/8/8/3Pp3/8/8/4K3 b - d3 0 1",
+		}, true},
+		// castling depends on the files, only the colors flip
+		{[]string{
+			"4k3/8/8/8/8/8/8/R3K2R w KQ - 0 1",
+			"r3k2r/8/8/8/8/8/8/4K3 b kq - 0 1",
+		}, true},
+		{[]string{
+			"4k3/8/8/8/8/8/8/R3K2R w KQ - 0 1",
+			"3k4/8/8/8/8/8/8/R2K3R w - - 0 1",
+		}, false},
+		// the side to move is not flipped alone
+		{[]string{
+			"k7/8/2K5/8/8/8/8/7R w - - 0 1",
+			"k7/8/2K5/8/8/8/8/7R b - - 0 1",
+		}, false},
+	}
+	for _, test := range tests {
+		first, err := CanonicalFEN(test.fens[0])
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		id, err := PuzzleID(test.fens[0])
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		for _, fen := range test.fens[1:] {
+			canonical, err := CanonicalFEN(fen)
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+			other, err := PuzzleID(fen)
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+
+			if (canonical == first) != test.same || (other == id) != test.same {
+				t.Fatalf("%s and %s -- expected same %v, got %s and %s", test.fens[0], fen, test.same, first, canonical)
+			}
+		}
+	}
+}
+
+func TestPuzzleIDStable(t *testing.T) {
+	// IDs are stored with puzzles, the hash keys must never change
+	id, err := PuzzleID("k7/8/2K5/8/8/8/8/7R w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if id != "454f18fb6f01b675" {
+		t.Fatalf("expected a fixed id, got %s", id)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	d := NewDedup()
+	if !d.Add(NewPuzzle("k7/8/2K5/8/8/8/8/7R w - - 0 1", nil, nil)) {
+		t.Fatalf("expected the first puzzle to be new")
+	}
+	if d.Add(Puzzle{Position: "7k/8/5K2/8/8/8/8/R7 w - - 0 1"}) {
+		t.Fatalf("expected the mirrored puzzle to be a duplicate")
+	}
+	if !d.Add(Puzzle{Position: "k7/8/2K5/8/8/8/8/7Q w - - 0 1"}) {
+		t.Fatalf("expected another puzzle to be new")
+	}
+}
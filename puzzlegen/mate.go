@@ -1,14 +1,18 @@
 package puzzlegen
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"sort"
-	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/tablebase"
 	chess "github.com/garlicgarrison/go-chess"
-	"github.com/garlicgarrison/go-chess/uci"
 )
 
 const (
@@ -27,93 +31,343 @@ var (
 
 /*
 	NOTE: if multiPV is 2, there is only 1 unique solution
+
+	Discovery limits search new positions for a mate, Verification limits
+	search the rest of the solution once one is found. Either falls back to
+	Depth when it is empty
 */
 type AnalysisConfig struct {
-	Depth   int
-	MultiPV int
+	Depth   int `yaml:"depth"`
+	MultiPV int `yaml:"multipv"`
+
+	Discovery    analysis.SearchLimits `yaml:"discovery"`
+	Verification analysis.SearchLimits `yaml:"verification"`
+
+	// AcquireTimeout bounds how long Analyze waits for a free engine, 0 waits until Close
+	AcquireTimeout time.Duration `yaml:"acquire_timeout"`
+
+	// Engine labels for each stage, MateEngine searches for the mating moves
+	// and EvalEngine finds the defending replies. Empty uses any engine
+	MateEngine string `yaml:"mate_engine"`
+	EvalEngine string `yaml:"eval_engine"`
+
+	// Positions with at most TablebasePieces pieces are solved exactly from
+	// the Syzygy tables in TablebasePath instead of searched, 0 disables it
+	TablebasePath   string `yaml:"tablebase_path"`
+	TablebasePieces int    `yaml:"tablebase_pieces"`
 }
 
+func (cfg AnalysisConfig) discovery() analysis.SearchLimits {
+	if cfg.Discovery.IsZero() {
+		return analysis.SearchLimits{Depth: cfg.Depth}
+	}
+	return cfg.Discovery
+}
+
+func (cfg AnalysisConfig) verification() analysis.SearchLimits {
+	if cfg.Verification.IsZero() {
+		return analysis.SearchLimits{Depth: cfg.Depth}
+	}
+	return cfg.Verification
+}
+
+/*
+	Seed replays a run, every generated position is drawn from its own seed
+	taken from it. 0 picks a random seed, which is logged. Positions from
+	the games of PGN and the files of EPD are searched first, InputOnly
+	stops once they are all searched instead of generating random ones
+*/
 type Cfg struct {
 	AnalysisConfig
 	PuzzleConfig
+
+	Seed      int64     `yaml:"seed"`
+	PGN       PGNConfig `yaml:"pgn"`
+	EPD       EPDConfig `yaml:"epd"`
+	InputOnly bool      `yaml:"input_only"`
+
+	// the puzzles written so far, seeded by the caller, nil starts empty
+	Dedup *Dedup `yaml:"-"`
 }
 
 type MatePuzzleGenerator struct {
-	cfg   *Cfg
-	pool  *stockpool.StockPool
-	write func(string, int, *chess.Game)
-	q     chan *chess.Position
-	quit  chan bool
+	cfg       *Cfg
+	analyzer  analysis.Analyzer
+	tablebase *tablebase.Tablebase
+	write     func(Puzzle)
+	q         chan candidate
+	seeds     *Seeds
+	report    *lineReport
+	dedup     *Dedup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{}
 }
 
-func NewMatePuzzleGenerator(cfg *Cfg, pool *stockpool.StockPool, write func(string, int, *chess.Game), queueLimit int) Generator[*chess.Position] {
-	return &MatePuzzleGenerator{
-		cfg:   cfg,
-		pool:  pool,
-		write: write,
-		q:     make(chan *chess.Position, queueLimit),
-		quit:  make(chan bool),
+func NewMatePuzzleGenerator(cfg *Cfg, analyzer analysis.Analyzer, write func(Puzzle), queueLimit int) Generator[*chess.Position] {
+	ctx, cancel := context.WithCancel(context.Background())
+	dedup := cfg.Dedup
+	if dedup == nil {
+		dedup = NewDedup()
+	}
+
+	g := &MatePuzzleGenerator{
+		cfg:      cfg,
+		analyzer: analyzer,
+		write:    write,
+		q:        make(chan candidate, queueLimit),
+		seeds:    NewSeeds(cfg.Seed),
+		dedup:    dedup,
+		ctx:      ctx,
+		done:     make(chan struct{}),
+		cancel:   cancel,
+	}
+
+	if cfg.TablebasePieces > 0 {
+		tb, err := tablebase.Open(cfg.TablebasePath, cfg.TablebasePieces)
+		if err != nil {
+			log.Printf("error -- %s -- searching endgames with the engine", err)
+		}
+		g.tablebase = tb
+	}
+
+	if cfg.PlacementModel != "" && cfg.Model == nil {
+		model, err := LoadPlacementModel(cfg.PlacementModel)
+		if err != nil {
+			log.Printf("error -- %s -- placing pieces uniformly", err)
+		}
+		cfg.Model = model
 	}
+
+	if cfg.EPD.Report != "" {
+		report, err := openReport(cfg.EPD.Report)
+		if err != nil {
+			log.Printf("error -- %s -- searching every line again", err)
+		}
+		g.report = report
+	}
+
+	return g
+}
+
+// a position waiting to be searched and where it came from
+type candidate struct {
+	fen          string
+	seed         int64
+	plausibility float64
+	source       *Source
+	// the dm opcode of an EPD line, 0 without one
+	dm int
+	// the castling rights of fen are Chess960 ones
+	chess960 bool
 }
 
+/*
+	Start generates puzzles in the background until Close, its analysis is
+	queued as batch work so interactive requests to the same analyzer go first.
+	Positions of the configured games and position files come through the
+	queue, random ones are generated once they are all read
+*/
 func (g *MatePuzzleGenerator) Start() {
-	go func() {
-		for {
-			fen, err := GenerateRandomFEN(g.cfg.PuzzleConfig)
-			if err != nil {
-				log.Printf("error -- %s", err)
-			}
+	ctx := analysis.WithPriority(g.ctx, analysis.PriorityBatch)
+	log.Printf("generating with seed %d", g.seeds.Seed())
+
+	feeding := len(g.cfg.PGN.Paths) > 0 || len(g.cfg.EPD.Paths) > 0
+	if feeding {
+		g.wg.Add(1)
+		go func() {
+			defer g.wg.Done()
+			defer close(g.q)
+			g.readGames(ctx)
+			g.readPositions(ctx)
+		}()
+	}
 
-			f, err := chess.FEN(fen)
-			if err != nil {
-				log.Printf("error -- %s", err)
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer close(g.done)
+		for ctx.Err() == nil {
+			var c candidate
+			if feeding {
+				var ok bool
+				select {
+				case c, ok = <-g.q:
+				case <-ctx.Done():
+					return
+				}
+				if !ok && g.cfg.InputOnly {
+					log.Printf("input read")
+					return
+				}
+				if !ok {
+					feeding = false
+					log.Printf("input read -- generating random positions")
+					continue
+				}
+			} else {
+				var err error
+				c, err = g.randomCandidate()
+				if err != nil {
+					continue
+				}
 			}
-			game := chess.NewGame(f)
-			log.Printf("new position -- %s", fen)
 
-			solution, res := g.Create(game.Position())
-			if solution != nil {
-				g.write(fen, res.Info.Score.Mate, solution)
+			puzzle, res := g.search(ctx, c)
+			if c.source != nil && c.source.Line > 0 && ctx.Err() == nil {
+				g.reportLine(c, puzzle, res)
 			}
 		}
 	}()
 }
 
+/*
+	Wait blocks until the generation loop of Start ends, which is after
+	Close or, with InputOnly, once every input position is searched
+*/
+func (g *MatePuzzleGenerator) Wait() {
+	<-g.done
+}
+
+func (g *MatePuzzleGenerator) randomCandidate() (candidate, error) {
+	seed := g.seeds.Next()
+	fen, plausibility, err := GenerateRandomFEN(g.cfg.PuzzleConfig, NewRand(seed))
+	if err != nil {
+		log.Printf("error -- %s -- seed: %d", err, seed)
+		return candidate{}, err
+	}
+
+	return candidate{fen: fen, seed: seed, plausibility: plausibility, chess960: g.cfg.Chess960}, nil
+}
+
+/*
+	Searches the candidate for a mate and writes the puzzle if there is one
+	that was not written yet, returns the puzzle and the search of the
+	position
+*/
+func (g *MatePuzzleGenerator) search(ctx context.Context, c candidate) (*Puzzle, *analysis.Result) {
+	origin := fmt.Sprintf("seed: %d", c.seed)
+	if c.source != nil {
+		origin = fmt.Sprintf("source: %s", c.source)
+	}
+
+	// go-chess cannot hold Chess960 rights, they are kept beside the position
+	position, err := analysis.ParseFEN(c.fen)
+	if err != nil {
+		log.Printf("error -- %s -- %s", err, origin)
+		return nil, nil
+	}
+	rights := searchedRights(c.fen, c.chess960)
+	log.Printf("new position -- %s -- %s", c.fen, origin)
+
+	solution, res := g.mateSolutions(ctx, position, rights)
+	if solution == nil {
+		return nil, res
+	}
+
+	puzzle := NewPuzzle(c.fen, solution, res)
+	puzzle.Chess960 = c.chess960
+	puzzle.Seed = c.seed
+	puzzle.Plausibility = c.plausibility
+	puzzle.Source = c.source
+	if !g.dedup.Add(puzzle) {
+		log.Printf("duplicate puzzle -- %s -- %s", puzzle.ID, origin)
+		return &puzzle, res
+	}
+	g.write(puzzle)
+
+	return &puzzle, res
+}
+
+/*
+	Close stops the generation loop, cancels every Analyze call that is
+	still waiting for an engine and closes the analyzer, giving searches in
+	flight TIMEOUT milliseconds to finish
+*/
 func (g *MatePuzzleGenerator) Close() {
-	g.quit <- true
+	g.cancel()
+
+	if closer, ok := g.analyzer.(analysis.Closer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT*time.Millisecond)
+		defer cancel()
+
+		err := closer.Close(ctx)
+		if err != nil {
+			log.Printf("error -- closing analyzer -- %s", err)
+		}
+	}
+
+	g.wg.Wait()
+
+	if g.report != nil {
+		err := g.report.Close()
+		if err != nil {
+			log.Printf("error -- closing report -- %s", err)
+		}
+	}
 }
 
-func (g *MatePuzzleGenerator) Create(position *chess.Position) (*chess.Game, *uci.SearchResults) {
-	return g.mateSolutions(position)
+func (g *MatePuzzleGenerator) Create(position *chess.Position) (*chess.Game, *analysis.Result) {
+	return g.mateSolutions(g.ctx, position, "")
+}
+
+func (g *MatePuzzleGenerator) CreateFEN(fen string, chess960 bool) (*chess.Game, *analysis.Result) {
+	position, err := analysis.ParseFEN(fen)
+	if err != nil {
+		log.Printf("error -- %s -- %s", err, fen)
+		return nil, nil
+	}
+
+	return g.mateSolutions(g.ctx, position, searchedRights(fen, chess960))
+}
+
+// the castling rights of fen if they are Chess960 ones
+func searchedRights(fen string, chess960 bool) string {
+	if fields := strings.Fields(fen); chess960 && len(fields) > 2 && fields[2] != "-" {
+		return fields[2]
+	}
+	return ""
 }
 
 /*
 	This takes the position and returns the search results of that position
+	NOTE: returns nil if no engine could be acquired before the timeout or Close
 */
-func (g *MatePuzzleGenerator) Analyze(position *chess.Position, depth int, multiPV int) *uci.SearchResults {
+func (g *MatePuzzleGenerator) Analyze(position *chess.Position, depth int, multiPV int) *analysis.Result {
+	return g.analyze(g.ctx, position, "", analysis.SearchLimits{Depth: depth}, multiPV, g.cfg.EvalEngine)
+}
+
+// rights, if set, are the Chess960 castling rights searched with the position
+func (g *MatePuzzleGenerator) analyze(ctx context.Context, position *chess.Position, rights string, limits analysis.SearchLimits, multiPV int, label string) *analysis.Result {
 	if position == nil {
 		return nil
 	}
 
-	cmdPos := uci.CmdPosition{Position: position}
-	cmdGo := uci.CmdGo{Depth: g.cfg.Depth}
-
-	instance := g.pool.Acquire()
-	instance.Engine.Run(uci.CmdSetOption{
-		Name:  "MultiPV",
-		Value: strconv.Itoa(multiPV),
-	})
+	if g.cfg.AcquireTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.cfg.AcquireTimeout)
+		defer cancel()
+	}
 
-	defer g.pool.Release(instance)
+	req := analysis.Request{
+		Position: position,
+		Limits:   limits,
+		MultiPV:  multiPV,
+		Engine:   label,
+	}
+	if rights != "" {
+		req.FEN = withCastling(position.String(), rights)
+	}
 
-	err := instance.Engine.Run(cmdPos, cmdGo)
+	res, err := g.analyzer.Analyze(ctx, req)
 	if err != nil {
-		log.Printf("error -- %s -- position: %s", err, position.String())
-		panic(err)
+		log.Printf("error -- %s -- position: %s", err, req.PositionFEN())
+		return nil
 	}
 
-	res := instance.Engine.SearchResults()
-	return &res
+	return res
 }
 
 /*
@@ -121,9 +375,14 @@ func (g *MatePuzzleGenerator) Analyze(position *chess.Position, depth int, multi
 	1. If it is the opponent's move, just return their best move
 	2. We only need to check the moves after the mate solution is found
 
+	rights are the Chess960 castling rights of the position, they are
+	searched with every position of the line and lost as kings and rooks
+	move. go-chess cannot play Chess960 castling, lines with it give no
+	puzzle
+
 	NOTE: decrease the depth every iteration by 1
 */
-func (g *MatePuzzleGenerator) mateSolutions(position *chess.Position) (*chess.Game, *uci.SearchResults) {
+func (g *MatePuzzleGenerator) mateSolutions(ctx context.Context, position *chess.Position, rights string) (*chess.Game, *analysis.Result) {
 	startPos, err := chess.FEN(position.String())
 	if err != nil {
 		return nil, nil
@@ -138,9 +397,25 @@ func (g *MatePuzzleGenerator) mateSolutions(position *chess.Position) (*chess.Ga
 		return nil, nil
 	}
 
-	var searchResults *uci.SearchResults
+	// the tables do not cover castling
+	if g.tablebase != nil && rights == "" {
+		if solution, res, ok := g.tablebaseSolution(game); ok {
+			return solution, res
+		}
+	}
+
+	var searchResults *analysis.Result
 	for {
-		res := g.Analyze(game.Position(), g.cfg.Depth, g.cfg.MultiPV)
+		limits := g.cfg.discovery()
+		if searchResults != nil {
+			limits = g.cfg.verification()
+		}
+
+		res := g.analyze(ctx, game.Position(), rights, limits, g.cfg.MultiPV, g.cfg.MateEngine)
+		if res == nil {
+			return nil, nil
+		}
+
 		mateMove := g.mateMove(res)
 		if mateMove == nil {
 			if searchResults != nil {
@@ -154,11 +429,23 @@ func (g *MatePuzzleGenerator) mateSolutions(position *chess.Position) (*chess.Ga
 			searchResults = res
 		}
 
-		game.Move(mateMove)
+		rights = castlingAfter(game.Position(), rights, mateMove)
+		if err := game.Move(mateMove); err != nil {
+			log.Printf("error -- %s -- position: %s", err, game.Position().String())
+			return nil, searchResults
+		}
 		if game.Outcome() == chess.NoOutcome {
-			res = g.Analyze(game.Position(), g.cfg.Depth, g.cfg.MultiPV)
+			res = g.analyze(ctx, game.Position(), rights, g.cfg.verification(), g.cfg.MultiPV, g.cfg.EvalEngine)
+			if res == nil {
+				return nil, nil
+			}
+
 			bestReply := g.bestMove(res)
-			game.Move(bestReply)
+			rights = castlingAfter(game.Position(), rights, bestReply)
+			if err := game.Move(bestReply); err != nil {
+				log.Printf("error -- %s -- position: %s", err, game.Position().String())
+				return nil, searchResults
+			}
 			continue
 		}
 
@@ -172,8 +459,8 @@ func (g *MatePuzzleGenerator) mateSolutions(position *chess.Position) (*chess.Ga
 
 	This returns the moves with the shortest mating moves, and mate in N
 */
-func (g *MatePuzzleGenerator) mateMove(search *uci.SearchResults) *chess.Move {
-	pvs := search.MultiPV
+func (g *MatePuzzleGenerator) mateMove(search *analysis.Result) *chess.Move {
+	pvs := append([]analysis.Line{}, search.Lines...)
 	sort.Slice(pvs, func(i, j int) bool {
 		return pvs[i].Score.Mate < pvs[j].Score.Mate
 	})
@@ -201,6 +488,6 @@ func (g *MatePuzzleGenerator) mateMove(search *uci.SearchResults) *chess.Move {
 	return solution
 }
 
-func (g *MatePuzzleGenerator) bestMove(search *uci.SearchResults) *chess.Move {
+func (g *MatePuzzleGenerator) bestMove(search *analysis.Result) *chess.Move {
 	return search.BestMove
 }
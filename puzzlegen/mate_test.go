@@ -1,51 +1,255 @@
 package puzzlegen
 
-// import (
-// 	"io/ioutil"
-// 	"log"
-// 	"testing"
-
-// 	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
-// 	chess "github.com/garlicgarrison/go-chess"
-// 	"gopkg.in/yaml.v2"
-// )
-
-// func write(fen string, sols *chess.Game) {
-
-// }
-
-// func TestMateSolutions(t *testing.T) {
-// 	pool, err := stockpool.NewStockPool("stockfish", 10, 8, 10)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-
-// 	yamlConfig, err := ioutil.ReadFile("../config/pieces.yaml")
-// 	if err != nil {
-// 		panic(err)
-// 	}
-
-// 	var config PuzzleConfig
-// 	err = yaml.Unmarshal(yamlConfig, &config)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-
-// 	gen := NewMatePuzzleGenerator(Cfg{
-// 		AnalysisConfig{
-// 			Depth:   35,
-// 			MultiPV: 3,
-// 		},
-// 		config,
-// 	}, pool, write, 10)
-
-// 	f, err := chess.FEN("1k6/3b3p/3r1Pp1/2N5/4np1p/8/N7/1nR3K1 w - - 0 1")
-// 	if err != nil {
-// 		log.Printf("error -- %s", err)
-// 	}
-
-// 	game := chess.NewGame(f)
-// 	solutions := gen.MateSolutions(game.Position())
-
-// 	log.Printf("solutions -- %d", len(solutions.Moves()))
-// }
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+	"github.com/garlicgarrison/chess-puzzle-gen/tablebase"
+	chess "github.com/garlicgarrison/go-chess"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMain(m *testing.M) {
+	fakeengine.Main()
+	os.Exit(m.Run())
+}
+
+func newTestGenerator(t *testing.T, script string, multiPV int) *MatePuzzleGenerator {
+	pool, err := stockpool.NewStockPool(fakeengine.Path(script), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{
+			Depth:   20,
+			MultiPV: multiPV,
+		},
+	}, pool, func(Puzzle) {}, 10).(*MatePuzzleGenerator)
+	t.Cleanup(gen.Close)
+
+	return gen
+}
+
+func position(t *testing.T, fen string) *chess.Position {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return chess.NewGame(f).Position()
+}
+
+func TestMateSolutions(t *testing.T) {
+	gen := newTestGenerator(t, "testdata/mate.json", 2)
+
+	game, res := gen.Create(position(t, "k7/8/2K5/8/8/8/8/7R w - - 0 1"))
+	if game == nil || res == nil {
+		t.Fatalf("expected a solution")
+	}
+
+	moves := []string{}
+	for _, m := range game.Moves() {
+		moves = append(moves, m.String())
+	}
+	if strings.Join(moves, " ") != "c6b6 a8b8 h1h8" {
+		t.Fatalf("unexpected solution -- %v", moves)
+	}
+	if res.Best().Score.Mate != 2 {
+		t.Fatalf("expected mate in 2, got %d", res.Best().Score.Mate)
+	}
+	if game.Outcome() != chess.WhiteWon {
+		t.Fatalf("expected the solution to end in mate")
+	}
+}
+
+func TestMateSolutionsNotUnique(t *testing.T) {
+	gen := newTestGenerator(t, "testdata/mate.json", 3)
+
+	game, res := gen.Create(position(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if game != nil {
+		t.Fatalf("expected two mates in 1 to be rejected")
+	}
+	if res == nil || len(res.Lines) != 3 {
+		t.Fatalf("expected the search results of the rejected position")
+	}
+}
+
+func TestMateSolutionsMultiPV(t *testing.T) {
+	// with one line the engine cannot see the second mate
+	gen := newTestGenerator(t, "testdata/mate.json", 1)
+
+	game, _ := gen.Create(position(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if game == nil || len(game.Moves()) != 1 {
+		t.Fatalf("expected a mate in 1")
+	}
+}
+
+func TestMateSolutionsNoMate(t *testing.T) {
+	gen := newTestGenerator(t, "testdata/mate.json", 2)
+
+	game, res := gen.Create(position(t, "4k3/8/8/8/8/8/4P3/4K3 w - - 0 1"))
+	if game != nil {
+		t.Fatalf("expected no solution")
+	}
+	if res == nil || res.Best().Score.CP != 0 {
+		t.Fatalf("expected the default cp 0 answer")
+	}
+}
+
+func TestAnalysisConfigLimits(t *testing.T) {
+	config := `
+depth: 14
+multipv: 2
+verification:
+  nodes: 200000
+  movetime: 2s
+`
+	var cfg AnalysisConfig
+	err := yaml.Unmarshal([]byte(config), &cfg)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	if cfg.discovery() != (analysis.SearchLimits{Depth: 14}) {
+		t.Fatalf("expected discovery to fall back to depth -- %+v", cfg.discovery())
+	}
+	if cfg.verification() != (analysis.SearchLimits{Nodes: 200000, MoveTime: 2 * time.Second}) {
+		t.Fatalf("unexpected verification limits -- %+v", cfg.verification())
+	}
+}
+
+func TestMateSolutionsTablebase(t *testing.T) {
+	// the official tables the tablebase tests read
+	for _, name := range []string{"KRvK.rtbw", "KRvK.rtbz", "KPvK.rtbw", "KPvK.rtbz"} {
+		_, err := os.Stat(filepath.Join("../tablebase/testdata", name))
+		if err != nil {
+			t.Skipf("no official %s in ../tablebase/testdata", name)
+		}
+	}
+
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{
+			Depth:           20,
+			MultiPV:         2,
+			TablebasePath:   "../tablebase/testdata",
+			TablebasePieces: 3,
+		},
+	}, pool, func(Puzzle) {}, 10).(*MatePuzzleGenerator)
+	t.Cleanup(gen.Close)
+
+	fen := "2k5/8/1K6/8/8/8/8/7R w - - 0 1"
+	game, res := gen.Create(position(t, fen))
+	if game == nil || res == nil {
+		t.Fatalf("expected a solution")
+	}
+
+	puzzle := NewPuzzle(fen, game, res)
+	if strings.Join(puzzle.Solution, " ") != "h1d1 c8b8 d1d8" || puzzle.MateIn != 2 {
+		t.Fatalf("unexpected solution -- %+v", puzzle)
+	}
+	if puzzle.Verified != VerifiedTablebase {
+		t.Fatalf("expected the solution to be proven by the tablebase")
+	}
+
+	// the engine script only knows c6b6, Kc7 mates as fast
+	game, res = gen.Create(position(t, "k7/8/2K5/8/8/8/8/7R w - - 0 1"))
+	if game != nil || res == nil || res.Best().Score.Mate != 2 {
+		t.Fatalf("expected the second mate in 2 to reject the position")
+	}
+
+	// the rook pawn is a proven draw and not searched
+	game, res = gen.Create(position(t, "7k/8/8/8/8/8/7P/7K w - - 0 1"))
+	if game != nil || res == nil || res.Engine != tablebase.Label {
+		t.Fatalf("expected a tablebase draw")
+	}
+
+	// four pieces are left to the engine
+	game, _ = gen.Create(position(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if game != nil {
+		t.Fatalf("expected two mates in 1 to be rejected")
+	}
+}
+
+func TestDuplicatePuzzles(t *testing.T) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	written := []Puzzle{}
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{Depth: 20, MultiPV: 2},
+	}, pool, func(p Puzzle) { written = append(written, p) }, 10).(*MatePuzzleGenerator)
+	t.Cleanup(gen.Close)
+
+	// the counters differ but the position is the same
+	for _, fen := range []string{"k7/8/2K5/8/8/8/8/7R w - - 0 1", "k7/8/2K5/8/8/8/8/7R w - - 4 30"} {
+		puzzle, _ := gen.search(gen.ctx, candidate{fen: fen})
+		if puzzle == nil {
+			t.Fatalf("%s -- expected a puzzle", fen)
+		}
+	}
+
+	if len(written) != 1 || written[0].ID == "" {
+		t.Fatalf("expected the puzzle to be written once with its id, got %+v", written)
+	}
+
+	// a later run seeded with the puzzles written so far
+	pool, err = stockpool.NewStockPool(fakeengine.Path("testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	dedup := NewDedup()
+	dedup.Add(written[0])
+	again := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{Depth: 20, MultiPV: 2},
+		Dedup:          dedup,
+	}, pool, func(p Puzzle) { written = append(written, p) }, 10).(*MatePuzzleGenerator)
+	t.Cleanup(again.Close)
+
+	puzzle, _ := again.search(again.ctx, candidate{fen: "k7/8/2K5/8/8/8/8/7R w - - 0 1"})
+	if puzzle == nil || len(written) != 1 {
+		t.Fatalf("expected the puzzle of the earlier run to be skipped, got %+v", written)
+	}
+}
+
+func TestCloseHungEngine(t *testing.T) {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("../stockpool/testdata/hang.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{Depth: 20, MultiPV: 2},
+		EPD:            EPDConfig{Paths: []string{"testdata/epd"}},
+		InputOnly:      true,
+	}, pool, func(Puzzle) {}, 10).(*MatePuzzleGenerator)
+	gen.Start()
+
+	// let the first search start
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		gen.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close to end the hung search")
+	}
+}
@@ -0,0 +1,221 @@
+package puzzlegen
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+var (
+	ErrInvalidPieceRange = errors.New("invalid piece range")
+	ErrNoSignature       = errors.New("no material signature meets the config")
+)
+
+// how many signatures are drawn before the config is given up on
+const signatureTries = 1000
+
+// the keys of PuzzleConfig.Ranges, the names of the count fields
+var rangeKeys = map[rune]string{
+	'Q': "white_q",
+	'R': "white_r",
+	'B': "white_b",
+	'N': "white_n",
+	'P': "white_p",
+	'q': "black_q",
+	'r': "black_r",
+	'b': "black_b",
+	'n': "black_n",
+	'p': "black_p",
+}
+
+// in pawns, kings are not counted
+var PieceValues = map[rune]int{
+	'P': 1,
+	'N': 3,
+	'B': 3,
+	'R': 5,
+	'Q': 9,
+	'p': 1,
+	'n': 3,
+	'b': 3,
+	'r': 5,
+	'q': 9,
+}
+
+/*
+	The number of one piece is drawn from Min to Max. Weights[i] is the
+	weight of Min+i pieces, empty weighs every count the same
+*/
+type PieceRange struct {
+	Min     int8      `yaml:"min"`
+	Max     int8      `yaml:"max"`
+	Weights []float64 `yaml:"weights"`
+}
+
+func (pr PieceRange) validate() error {
+	if pr.Min < 0 || pr.Max < pr.Min {
+		return fmt.Errorf("%w -- min %d max %d", ErrInvalidPieceRange, pr.Min, pr.Max)
+	}
+	if len(pr.Weights) == 0 {
+		return nil
+	}
+	if len(pr.Weights) != int(pr.Max-pr.Min)+1 {
+		return fmt.Errorf("%w -- %d weights for %d counts", ErrInvalidPieceRange, len(pr.Weights), pr.Max-pr.Min+1)
+	}
+
+	total := 0.0
+	for _, w := range pr.Weights {
+		if w < 0 {
+			return fmt.Errorf("%w -- negative weight %v", ErrInvalidPieceRange, w)
+		}
+		total += w
+	}
+	if total == 0 {
+		return fmt.Errorf("%w -- weights add up to 0", ErrInvalidPieceRange)
+	}
+
+	return nil
+}
+
+func (pr PieceRange) sample(r *rand.Rand) int8 {
+	if len(pr.Weights) == 0 {
+		return pr.Min + int8(r.Intn(int(pr.Max-pr.Min)+1))
+	}
+
+	total := 0.0
+	for _, w := range pr.Weights {
+		total += w
+	}
+
+	x := r.Float64() * total
+	for i, w := range pr.Weights {
+		if x < w {
+			return pr.Min + int8(i)
+		}
+		x -= w
+	}
+
+	// rounding can leave x just past the last weight
+	for i := len(pr.Weights) - 1; ; i-- {
+		if pr.Weights[i] > 0 {
+			return pr.Min + int8(i)
+		}
+	}
+}
+
+// material in pawns, both ends included
+type MaterialRange struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+func (mr *MaterialRange) contains(material int) bool {
+	return mr == nil || (material >= mr.Min && material <= mr.Max)
+}
+
+/*
+	The count of every piece of a generated position, drawn from cfg. A
+	piece without a range has the fixed count of its field, signatures that
+	miss a material target, have more than 30 pieces or more promoted
+	pieces than missing pawns are drawn again
+*/
+func sampleSignature(cfg PuzzleConfig, r *rand.Rand) (map[rune]int8, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < signatureTries; i++ {
+		signature := cfg.counts()
+		for _, piece := range NonKingPieces {
+			if pr, ok := cfg.Ranges[rangeKeys[piece]]; ok {
+				signature[piece] = pr.sample(r)
+			}
+		}
+
+		if cfg.accepts(signature) {
+			return signature, nil
+		}
+	}
+
+	return nil, ErrNoSignature
+}
+
+func (cfg PuzzleConfig) counts() map[rune]int8 {
+	return map[rune]int8{
+		'Q': cfg.WhiteQ,
+		'R': cfg.WhiteR,
+		'B': cfg.WhiteB,
+		'N': cfg.WhiteN,
+		'P': cfg.WhiteP,
+		'q': cfg.BlackQ,
+		'r': cfg.BlackR,
+		'b': cfg.BlackB,
+		'n': cfg.BlackN,
+		'p': cfg.BlackP,
+	}
+}
+
+func (cfg PuzzleConfig) validate() error {
+	known := map[string]bool{}
+	for _, key := range rangeKeys {
+		known[key] = true
+	}
+	for key, pr := range cfg.Ranges {
+		if !known[key] {
+			return fmt.Errorf("%w -- unknown piece %q", ErrInvalidPieceRange, key)
+		}
+		if err := pr.validate(); err != nil {
+			return fmt.Errorf("%s -- %w", key, err)
+		}
+	}
+
+	// the fewest pieces the config can draw
+	least := 0
+	for piece, count := range cfg.counts() {
+		if pr, ok := cfg.Ranges[rangeKeys[piece]]; ok {
+			count = pr.Min
+		}
+		least += int(count)
+	}
+	if least > 30 {
+		return ErrInvalidPuzzleConfig
+	}
+
+	return nil
+}
+
+func (cfg PuzzleConfig) accepts(signature map[rune]int8) bool {
+	total := 0
+	for _, count := range signature {
+		total += int(count)
+	}
+	if total > 30 {
+		return false
+	}
+
+	white, black := 0, 0
+	for piece, count := range signature {
+		if strings.ContainsRune("PNBRQ", piece) {
+			white += PieceValues[piece] * int(count)
+		} else {
+			black += PieceValues[piece] * int(count)
+		}
+	}
+
+	return promotable(signature, "PNBRQ") && promotable(signature, "pnbrq") &&
+		cfg.WhiteMaterial.contains(white) &&
+		cfg.BlackMaterial.contains(black) &&
+		cfg.Imbalance.contains(white-black)
+}
+
+// pieces beyond the starting ones need a promoted pawn each
+func promotable(signature map[rune]int8, side string) bool {
+	pawns := int(signature[rune(side[0])])
+	promoted := 0
+	for _, piece := range side[1:] {
+		promoted += extra(int(signature[piece]), StartPieces[piece])
+	}
+
+	return pawns <= 8 && promoted <= 8-pawns
+}
@@ -0,0 +1,82 @@
+package puzzlegen
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestSampleSignature(t *testing.T) {
+	data, err := os.ReadFile("testdata/pieces.yaml")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	var cfg PuzzleConfig
+	err = yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	r := NewRand(1)
+	seen := map[int8]bool{}
+	for i := 0; i < 500; i++ {
+		signature, err := sampleSignature(cfg, r)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		if signature['Q'] != 1 || signature['R'] != 1 || signature['r'] != 1 || signature['p'] != 4 {
+			t.Fatalf("expected the fixed counts, got %v", signature)
+		}
+		if signature['P'] < 2 || signature['P'] > 5 {
+			t.Fatalf("expected 2 to 5 white pawns, got %d", signature['P'])
+		}
+		if signature['n'] == 1 {
+			t.Fatalf("expected no draws of a weight of 0")
+		}
+		seen[signature['P']] = true
+
+		white, black := 0, 0
+		for piece, count := range signature {
+			if strings.ContainsRune("PNBRQ", piece) {
+				white += PieceValues[piece] * int(count)
+			} else {
+				black += PieceValues[piece] * int(count)
+			}
+		}
+		if white < 14 || white > 24 || white-black < 3 {
+			t.Fatalf("expected the material targets, got %d against %d", white, black)
+		}
+	}
+
+	// every count of the range is drawn
+	if len(seen) != 4 {
+		t.Fatalf("expected every count of white pawns, got %v", seen)
+	}
+}
+
+func TestSampleSignatureErrors(t *testing.T) {
+	tests := []struct {
+		cfg PuzzleConfig
+		err error
+	}{
+		{PuzzleConfig{Ranges: map[string]PieceRange{"white_k": {Max: 1}}}, ErrInvalidPieceRange},
+		{PuzzleConfig{Ranges: map[string]PieceRange{"white_q": {Min: 2, Max: 1}}}, ErrInvalidPieceRange},
+		{PuzzleConfig{Ranges: map[string]PieceRange{"white_q": {Max: 1, Weights: []float64{1}}}}, ErrInvalidPieceRange},
+		{PuzzleConfig{Ranges: map[string]PieceRange{"white_q": {Max: 1, Weights: []float64{0, 0}}}}, ErrInvalidPieceRange},
+		{PuzzleConfig{WhiteP: 8, BlackP: 8, Ranges: map[string]PieceRange{"white_q": {Min: 15, Max: 15}}}, ErrInvalidPuzzleConfig},
+		{PuzzleConfig{WhiteQ: 1, WhiteMaterial: &MaterialRange{Min: 10, Max: 20}}, ErrNoSignature},
+		// a second queen needs a pawn to have promoted
+		{PuzzleConfig{WhiteQ: 2, WhiteP: 8}, ErrNoSignature},
+	}
+	for _, test := range tests {
+		_, err := sampleSignature(test.cfg, NewRand(1))
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%+v -- expected error %v, got %v", test.cfg, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package puzzlegen
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"unicode"
+)
+
+var ErrNoMutation = errors.New("no mutation applies to the position")
+
+// how many squares an operator draws before it gives up on the position
+const mutationTries = 100
+
+// the name of a mutation operator, see Mutations
+type Mutation string
+
+const (
+	// adds or removes pieces toward the asymptote, see MutateFEN
+	MutationMaterial Mutation = "material"
+	// moves a piece to an empty square at most two squares away
+	MutationMove Mutation = "move"
+	// swaps two different pieces
+	MutationSwap Mutation = "swap"
+	// turns a piece into another piece of its color
+	MutationRetype Mutation = "retype"
+	// shifts the whole board a file, the file it moves off must be empty
+	MutationShift Mutation = "shift"
+	// gives the move to the other side
+	MutationSide Mutation = "side"
+	// mirrors the board from the a to the h file
+	MutationMirror Mutation = "mirror"
+	// gives a piece to the other color
+	MutationRecolor Mutation = "recolor"
+)
+
+// every operator in the order weights are drawn in
+var Mutations = []Mutation{
+	MutationMaterial,
+	MutationMove,
+	MutationSwap,
+	MutationRetype,
+	MutationShift,
+	MutationSide,
+	MutationMirror,
+	MutationRecolor,
+}
+
+// the operators other than material, which works on the fen itself
+var operators = map[Mutation]func(p *mutable, r *rand.Rand) bool{
+	MutationMove:    movePiece,
+	MutationSwap:    swapPieces,
+	MutationRetype:  retypePiece,
+	MutationShift:   shiftBoard,
+	MutationSide:    flipSide,
+	MutationMirror:  mirrorBoard,
+	MutationRecolor: recolorPiece,
+}
+
+/*
+	Draws an operator by weight, operators without a weight are never
+	drawn. No weights draw MutationMaterial
+*/
+func DrawMutation(weights map[Mutation]float64, r *rand.Rand) Mutation {
+	total := 0.0
+	for _, m := range Mutations {
+		total += weights[m]
+	}
+	if total <= 0 {
+		return MutationMaterial
+	}
+
+	x := r.Float64() * total
+	last := MutationMaterial
+	for _, m := range Mutations {
+		if weights[m] <= 0 {
+			continue
+		}
+		if x < weights[m] {
+			return m
+		}
+		x -= weights[m]
+		last = m
+	}
+
+	// rounding can leave x just past the last weight
+	return last
+}
+
+/*
+	Applies the operator m to fen, drawn from r like MutateFEN. asymptote is
+	only used by MutationMaterial. Positions the operator cannot change
+	return ErrNoMutation, mutations ValidatePosition rejects return
+	ErrInvalidPosition
+*/
+func ApplyMutation(m Mutation, fen string, asymptote int, r *rand.Rand) (string, error) {
+	if m == MutationMaterial {
+		return MutateFEN(fen, asymptote, r)
+	}
+
+	operator, ok := operators[m]
+	if !ok {
+		return "", fmt.Errorf("%w -- unknown operator %q", ErrNoMutation, m)
+	}
+
+	r = orRand(r)
+	p, err := parseMutable(fen)
+	if err != nil {
+		return "", err
+	}
+	if !operator(p, r) {
+		return "", fmt.Errorf("%w -- %s -- %s", ErrNoMutation, m, fen)
+	}
+
+	var sb strings.Builder
+	var player int8
+	if p.white {
+		player = 1
+	}
+	writeFEN(&sb, player, p.board, p.castling, p.enPassant, p.chess960)
+
+	return checkFEN(sb.String(), p.chess960)
+}
+
+// the fields of a fen the operators change
+type mutable struct {
+	board     [8][8]int8
+	white     bool
+	castling  string
+	enPassant int8
+	chess960  bool
+}
+
+func parseMutable(fen string) (*mutable, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("%w -- expected at least 4 fields", ErrInvalidFEN)
+	}
+
+	board, err := parseBoard(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w -- %s", ErrInvalidFEN, err)
+	}
+
+	p := &mutable{
+		board:     board,
+		white:     fields[1] == "w",
+		castling:  fields[2],
+		enPassant: -1,
+		chess960:  isChess960(fields[2]),
+	}
+	if sq, ok := parseSquare(fields[3]); ok {
+		p.enPassant = sq
+	}
+
+	return p, nil
+}
+
+// the occupied squares, kings too if kings is set
+func (p *mutable) pieces(kings bool) []int8 {
+	squares := []int8{}
+	for sq := int8(0); sq < 64; sq++ {
+		piece, ok := BitToPiece[p.board[sq/8][sq%8]]
+		if !ok || (!kings && (piece == 'K' || piece == 'k')) {
+			continue
+		}
+		squares = append(squares, sq)
+	}
+
+	return squares
+}
+
+func (p *mutable) piece(sq int8) rune {
+	return BitToPiece[p.board[sq/8][sq%8]]
+}
+
+func (p *mutable) set(sq int8, piece rune) {
+	p.board[sq/8][sq%8] = PieceToBit[piece]
+}
+
+// pawns cannot stand on the first or last rank
+func fits(piece rune, sq int8) bool {
+	return !(piece == 'P' || piece == 'p') || (sq/8 != 0 && sq/8 != 7)
+}
+
+func movePiece(p *mutable, r *rand.Rand) bool {
+	squares := p.pieces(true)
+	if len(squares) == 0 {
+		return false
+	}
+
+	for i := 0; i < mutationTries; i++ {
+		from := squares[r.Intn(len(squares))]
+		row, col := from/8+int8(r.Intn(5)-2), from%8+int8(r.Intn(5)-2)
+		if row < 0 || row > 7 || col < 0 || col > 7 {
+			continue
+		}
+
+		to, piece := squareHash(row, col), p.piece(from)
+		if p.board[row][col] != 0 || !fits(piece, to) {
+			continue
+		}
+
+		p.set(to, piece)
+		p.board[from/8][from%8] = 0
+		return true
+	}
+
+	return false
+}
+
+func swapPieces(p *mutable, r *rand.Rand) bool {
+	squares := p.pieces(true)
+	if len(squares) < 2 {
+		return false
+	}
+
+	for i := 0; i < mutationTries; i++ {
+		a, b := squares[r.Intn(len(squares))], squares[r.Intn(len(squares))]
+		pa, pb := p.piece(a), p.piece(b)
+		if pa == pb || !fits(pa, b) || !fits(pb, a) {
+			continue
+		}
+
+		p.set(a, pb)
+		p.set(b, pa)
+		return true
+	}
+
+	return false
+}
+
+func retypePiece(p *mutable, r *rand.Rand) bool {
+	squares := p.pieces(false)
+	if len(squares) == 0 {
+		return false
+	}
+
+	for i := 0; i < mutationTries; i++ {
+		sq := squares[r.Intn(len(squares))]
+		piece := p.piece(sq)
+
+		side := "PNBRQ"
+		if unicode.IsLower(piece) {
+			side = "pnbrq"
+		}
+		next := rune(side[r.Intn(len(side))])
+		if next == piece || !fits(next, sq) {
+			continue
+		}
+
+		p.set(sq, next)
+		return true
+	}
+
+	return false
+}
+
+// one file toward a or h at random, the other way if that edge is taken
+func shiftBoard(p *mutable, r *rand.Rand) bool {
+	steps := []int8{-1, 1}
+	if r.Intn(2) == 1 {
+		steps = []int8{1, -1}
+	}
+
+	for _, step := range steps {
+		edge := int8(0)
+		if step == 1 {
+			edge = 7
+		}
+
+		empty := true
+		for row := 0; row < 8; row++ {
+			if p.board[row][edge] != 0 {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			continue
+		}
+
+		board := [8][8]int8{}
+		for row := int8(0); row < 8; row++ {
+			for col := int8(0); col < 8; col++ {
+				if c := col + step; c >= 0 && c < 8 {
+					board[row][c] = p.board[row][col]
+				}
+			}
+		}
+		p.board = board
+		p.castling = shiftRights(p.castling, p.chess960, func(file int8) int8 { return file + step })
+		if p.enPassant >= 0 {
+			p.enPassant += step
+		}
+		return true
+	}
+
+	return false
+}
+
+// the en passant square is dropped, it was for the other side
+func flipSide(p *mutable, r *rand.Rand) bool {
+	p.white = !p.white
+	p.enPassant = -1
+	return true
+}
+
+func mirrorBoard(p *mutable, r *rand.Rand) bool {
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 4; col++ {
+			p.board[row][col], p.board[row][7-col] = p.board[row][7-col], p.board[row][col]
+		}
+	}
+
+	p.castling = shiftRights(p.castling, p.chess960, func(file int8) int8 { return 7 - file })
+	if p.enPassant >= 0 {
+		p.enPassant = squareHash(p.enPassant/8, 7-p.enPassant%8)
+	}
+	return true
+}
+
+func recolorPiece(p *mutable, r *rand.Rand) bool {
+	squares := p.pieces(false)
+	if len(squares) == 0 {
+		return false
+	}
+
+	sq := squares[r.Intn(len(squares))]
+	piece := p.piece(sq)
+	if unicode.IsUpper(piece) {
+		p.set(sq, unicode.ToLower(piece))
+	} else {
+		p.set(sq, unicode.ToUpper(piece))
+	}
+	return true
+}
+
+/*
+	Moves Chess960 rights along with their rooks. Orthodox rights are kept
+	and dropped by writeFEN once the king left its home square
+*/
+func shiftRights(castling string, chess960 bool, file func(int8) int8) string {
+	if !chess960 {
+		return castling
+	}
+
+	rights := ""
+	for _, right := range castling {
+		f := file(int8(unicode.ToLower(right) - 'a'))
+		if f < 0 || f > 7 {
+			continue
+		}
+
+		moved := rune('a' + f)
+		if unicode.IsUpper(right) {
+			moved = unicode.ToUpper(moved)
+		}
+		rights += string(moved)
+	}
+
+	return rights
+}
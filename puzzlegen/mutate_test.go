@@ -0,0 +1,127 @@
+package puzzlegen
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestApplyMutation(t *testing.T) {
+	tests := []struct {
+		mutation Mutation
+		fen      string
+		expected string
+	}{
+		{MutationSide, "4k3/8/8/8/8/8/3R4/4K3 w - - 0 1", "4k3/8/8/8/8/8/3R4/4K3 b - - 0 1"},
+		{MutationMirror, "4k3/8/8/8/8/8/3R4/4K3 w - - 0 1", "3k4/8/8/8/8/8/4R3/3K4 w - - 0 1"},
+		// the rights follow their rooks, orthodox ones are lost with the king
+		{MutationMirror, "4k3/8/8/8/8/8/8/1R2K2R w HB - 0 1", "3k4/8/8/8/8/8/8/R2K2R1 w GA - 0 1"},
+		{MutationMirror, "4k3/8/8/8/8/8/8/R3K2R w KQ - 0 1", "3k4/8/8/8/8/8/8/R2K3R w - - 0 1"},
+		{MutationShift, "4k3/8/8/8/8/8/3R4/4K3 w - - 0 1", ""},
+		{MutationSwap, "4k3/8/8/8/8/8/8/4K3 w - - 0 1", "4K3/8/8/8/8/8/8/4k3 w - - 0 1"},
+		{MutationRetype, "4k3/8/8/8/8/8/8/4K3 w - - 0 1", ""},
+	}
+	for _, test := range tests {
+		fen, err := ApplyMutation(test.mutation, test.fen, 5, NewRand(1))
+		if err != nil {
+			if test.expected == "" && errors.Is(err, ErrNoMutation) {
+				continue
+			}
+			t.Fatalf("%s %s -- err -- %s", test.mutation, test.fen, err)
+		}
+
+		if test.expected == "" {
+			// shifting a file either way
+			if test.mutation == MutationShift && (fen == "3k4/8/8/8/8/8/2R5/3K4 w - - 0 1" || fen == "5k2/8/8/8/8/8/4R3/5K2 w - - 0 1") {
+				continue
+			}
+			t.Fatalf("%s %s -- unexpected %s", test.mutation, test.fen, fen)
+		}
+		if fen != test.expected {
+			t.Fatalf("%s %s -- expected %s, got %s", test.mutation, test.fen, test.expected, fen)
+		}
+	}
+
+	if _, err := ApplyMutation("teleport", "4k3/8/8/8/8/8/8/4K3 w - - 0 1", 5, nil); !errors.Is(err, ErrNoMutation) {
+		t.Fatalf("expected an unknown operator to fail, got %v", err)
+	}
+}
+
+func TestMutationOperators(t *testing.T) {
+	start := "4k3/1pp2q2/2n5/4P3/3B4/8/1P3N2/4K2R w K - 0 1"
+
+	counts := func(fen string) map[rune]int {
+		c := map[rune]int{}
+		for _, p := range strings.Fields(fen)[0] {
+			if PieceToBit[p] != 0 {
+				c[p]++
+			}
+		}
+		return c
+	}
+	total := func(c map[rune]int) int {
+		n := 0
+		for _, v := range c {
+			n += v
+		}
+		return n
+	}
+
+	for _, m := range Mutations {
+		changed := 0
+		for seed := int64(1); seed <= 50; seed++ {
+			fen, err := ApplyMutation(m, start, 10, NewRand(seed))
+			if errors.Is(err, ErrInvalidPosition) || errors.Is(err, ErrNoMutation) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s -- err -- %s", m, err)
+			}
+			if violations := ValidatePosition(fen); violations != nil {
+				t.Fatalf("%s -- %s -- %v", m, fen, violations)
+			}
+
+			// the same seed mutates the same way
+			again, _ := ApplyMutation(m, start, 10, NewRand(seed))
+			if again != fen {
+				t.Fatalf("%s -- seed %d gave %s and %s", m, seed, fen, again)
+			}
+
+			before, after := counts(start), counts(fen)
+			switch m {
+			case MutationMove, MutationSwap, MutationShift, MutationSide, MutationMirror:
+				for p, n := range before {
+					if after[p] != n {
+						t.Fatalf("%s -- %s changed the pieces", m, fen)
+					}
+				}
+			case MutationRetype, MutationRecolor:
+				if total(after) != total(before) {
+					t.Fatalf("%s -- %s changed the number of pieces", m, fen)
+				}
+			}
+			if fen != start {
+				changed++
+			}
+		}
+		if changed == 0 {
+			t.Fatalf("%s -- expected the position to change", m)
+		}
+	}
+}
+
+func TestDrawMutation(t *testing.T) {
+	r := NewRand(1)
+	if m := DrawMutation(nil, r); m != MutationMaterial {
+		t.Fatalf("expected material without weights, got %s", m)
+	}
+
+	weights := map[Mutation]float64{MutationMove: 3, MutationMirror: 1, MutationSwap: 0}
+	drawn := map[Mutation]int{}
+	for i := 0; i < 4000; i++ {
+		drawn[DrawMutation(weights, r)]++
+	}
+	if len(drawn) != 2 || drawn[MutationMove] < 2700 || drawn[MutationMove] > 3300 {
+		t.Fatalf("expected move about 3 times as often as mirror, got %v", drawn)
+	}
+}
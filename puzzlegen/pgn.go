@@ -0,0 +1,189 @@
+package puzzlegen
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+// mates count as this many centipawns, less the moves to mate
+const mateCP = 10000
+
+/*
+	Paths are PGN files, or directories searched for .pgn files. Positions
+	from ply MinPly on are searched, every Every-th ply or, if BlunderCP is
+	set, only those right after a move that lost at least BlunderCP
+	centipawns by the discovery search
+*/
+type PGNConfig struct {
+	Paths     []string `yaml:"paths"`
+	MinPly    int      `yaml:"min_ply"`
+	Every     int      `yaml:"every"`
+	BlunderCP int      `yaml:"blunder_cp"`
+}
+
+// queues the positions of every game of the configured files
+func (g *MatePuzzleGenerator) readGames(ctx context.Context) {
+	for _, path := range g.cfg.PGN.Paths {
+		files, err := inputFiles(path, ".pgn")
+		if err != nil {
+			log.Printf("error -- %s", err)
+		}
+
+		for _, file := range files {
+			err := g.readPGN(ctx, file)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("error -- %s -- %s", err, file)
+			}
+		}
+	}
+}
+
+/*
+	Queues the positions of every game of the file, stops at the first game
+	that cannot be read
+*/
+func (g *MatePuzzleGenerator) readPGN(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := chess.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		game := scanner.Next()
+		// the scanner ends with an empty game after trailing blank lines
+		if len(game.Moves()) == 0 && len(game.TagPairs()) == 0 {
+			continue
+		}
+
+		source := Source{File: path, Game: n}
+		for _, tp := range game.TagPairs() {
+			switch strings.ToLower(tp.Key) {
+			case "event":
+				source.Event = tp.Value
+			case "white":
+				source.White = tp.Value
+			case "black":
+				source.Black = tp.Value
+			}
+		}
+
+		err := g.queueGame(ctx, game, source)
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+// queues the positions of game the config samples, see PGNConfig
+func (g *MatePuzzleGenerator) queueGame(ctx context.Context, game *chess.Game, source Source) error {
+	cfg := g.cfg.PGN
+	every := cfg.Every
+	if every < 1 {
+		every = 1
+	}
+
+	positions := game.Positions()
+	scores := map[int]int{}
+	score := func(ply int) (int, bool) {
+		if s, ok := scores[ply]; ok {
+			return s, true
+		}
+		res := g.analyze(ctx, positions[ply], "", g.cfg.discovery(), 1, g.cfg.EvalEngine)
+		if res == nil || len(res.Lines) == 0 {
+			return 0, false
+		}
+		scores[ply] = centipawns(res.Best().Score.CP, res.Best().Score.Mate)
+		return scores[ply], true
+	}
+
+	for ply := cfg.MinPly; ply < len(positions); ply++ {
+		if len(positions[ply].ValidMoves()) == 0 {
+			continue
+		}
+
+		if cfg.BlunderCP > 0 {
+			if ply == 0 || len(positions[ply-1].ValidMoves()) == 0 {
+				continue
+			}
+			before, ok := score(ply - 1)
+			if !ok {
+				continue
+			}
+			after, ok := score(ply)
+			if !ok {
+				continue
+			}
+
+			// both are for the side to move, the mover had before and is left
+			// with -after
+			if before+after < cfg.BlunderCP {
+				continue
+			}
+		} else if (ply-cfg.MinPly)%every != 0 {
+			continue
+		}
+
+		s := source
+		s.Ply = ply
+		select {
+		case g.q <- candidate{fen: positions[ply].String(), source: &s}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// path if it is a file, or the files under it with one of exts in lexical order
+func inputFiles(path string, exts ...string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == path && !d.IsDir() {
+			files = append(files, p)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		for _, ext := range exts {
+			if strings.EqualFold(filepath.Ext(p), ext) {
+				files = append(files, p)
+				break
+			}
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+func centipawns(cp, mate int) int {
+	switch {
+	case mate > 0:
+		return mateCP - mate
+	case mate < 0:
+		return -mateCP - mate
+	}
+	return cp
+}
@@ -0,0 +1,94 @@
+package puzzlegen
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+)
+
+func newPGNGenerator(t *testing.T, cfg PGNConfig, write func(Puzzle)) *MatePuzzleGenerator {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	gen := NewMatePuzzleGenerator(&Cfg{
+		AnalysisConfig: AnalysisConfig{
+			Depth:   20,
+			MultiPV: 2,
+		},
+		PGN: cfg,
+	}, pool, write, 10).(*MatePuzzleGenerator)
+	t.Cleanup(gen.Close)
+
+	return gen
+}
+
+func TestQueueGame(t *testing.T) {
+	// the game ends in mate at ply 5, which has no moves to search
+	tests := []struct {
+		cfg   PGNConfig
+		plies []int
+	}{
+		{PGNConfig{}, []int{0, 1, 2, 3, 4}},
+		{PGNConfig{MinPly: 1, Every: 2}, []int{1, 3}},
+		// only 1... Ka8 walks into a mate from a position scored as equal
+		{PGNConfig{BlunderCP: 300}, []int{2}},
+	}
+	for _, test := range tests {
+		gen := newPGNGenerator(t, test.cfg, func(Puzzle) {})
+
+		err := gen.readPGN(context.Background(), "testdata/pgn/mate.pgn")
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		plies := []int{}
+		for len(gen.q) > 0 {
+			c := <-gen.q
+			if c.source.File != "testdata/pgn/mate.pgn" || c.source.Game != 1 || c.source.Event != "Rook ending" {
+				t.Fatalf("unexpected source -- %+v", c.source)
+			}
+			plies = append(plies, c.source.Ply)
+		}
+		if len(plies) != len(test.plies) {
+			t.Fatalf("%+v -- expected plies %v, got %v", test.cfg, test.plies, plies)
+		}
+		for i := range plies {
+			if plies[i] != test.plies[i] {
+				t.Fatalf("%+v -- expected plies %v, got %v", test.cfg, test.plies, plies)
+			}
+		}
+	}
+}
+
+func TestStartFromGames(t *testing.T) {
+	puzzles := make(chan Puzzle, 100)
+	gen := newPGNGenerator(t, PGNConfig{Paths: []string{"testdata/pgn"}}, func(p Puzzle) {
+		puzzles <- p
+	})
+	gen.Start()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case p := <-puzzles:
+			if p.Source == nil || p.Source.Ply != 2 {
+				continue
+			}
+			if strings.Join(p.Solution, " ") != "c6b6 a8b8 h1h8" {
+				t.Fatalf("unexpected solution -- %v", p.Solution)
+			}
+			if p.Source.File != "testdata/pgn/mate.pgn" || p.Source.Game != 1 || p.Source.White != "White" {
+				t.Fatalf("unexpected source -- %+v", p.Source)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("expected the puzzle of ply 2")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package puzzlegen
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+var ErrInvalidModel = errors.New("invalid placement model")
+
+// positions before this ply are still the opening, they are not counted
+const modelSkipPlies = 10
+
+/*
+	How often every piece stood on every square in a corpus of games, keyed
+	by the letter of the piece. Squares are numbered like the board, 0 is
+	a8. Support is the share of pawns defended by a pawn of their color
+*/
+type PlacementModel struct {
+	Positions int                    `json:"positions"`
+	Squares   map[string][64]float64 `json:"squares"`
+	Support   float64                `json:"support"`
+}
+
+/*
+	Counts the pieces of every position of the games in a PGN corpus, the
+	first modelSkipPlies plies of each game are skipped
+*/
+func BuildPlacementModel(r io.Reader) (*PlacementModel, error) {
+	m := &PlacementModel{Squares: map[string][64]float64{}}
+	pawns, supported := 0, 0
+
+	scanner := chess.NewScanner(r)
+	for scanner.Scan() {
+		for ply, position := range scanner.Next().Positions() {
+			if ply < modelSkipPlies {
+				continue
+			}
+
+			board, err := parseBoard(position.Board().String())
+			if err != nil {
+				return nil, err
+			}
+
+			m.Positions++
+			for row := int8(0); row < 8; row++ {
+				for col := int8(0); col < 8; col++ {
+					piece, ok := BitToPiece[board[row][col]]
+					if !ok {
+						continue
+					}
+
+					squares := m.Squares[string(piece)]
+					squares[squareHash(row, col)]++
+					m.Squares[string(piece)] = squares
+
+					if piece == 'P' || piece == 'p' {
+						pawns++
+						if defended(board, piece, squareHash(row, col)) {
+							supported++
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if m.Positions == 0 {
+		return nil, fmt.Errorf("%w -- no positions past ply %d", ErrInvalidModel, modelSkipPlies)
+	}
+	if pawns > 0 {
+		m.Support = float64(supported) / float64(pawns)
+	}
+
+	return m, nil
+}
+
+func LoadPlacementModel(path string) (*PlacementModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &PlacementModel{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *PlacementModel) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func (m *PlacementModel) validate() error {
+	if m.Support < 0 || m.Support > 1 {
+		return fmt.Errorf("%w -- support %v", ErrInvalidModel, m.Support)
+	}
+
+	for key, squares := range m.Squares {
+		if len(key) != 1 || PieceToBit[rune(key[0])] == 0 {
+			return fmt.Errorf("%w -- unknown piece %q", ErrInvalidModel, key)
+		}
+		for _, count := range squares {
+			if count < 0 {
+				return fmt.Errorf("%w -- negative count for %s", ErrInvalidModel, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+	The chance of piece on sq. Every square gets one extra count so squares
+	the corpus never saw the piece on stay possible
+*/
+func (m *PlacementModel) weight(piece rune, sq int8) float64 {
+	squares := m.Squares[string(piece)]
+	total := 0.0
+	for _, count := range squares {
+		total += count
+	}
+
+	return (squares[sq] + 1) / (total + 64)
+}
+
+/*
+	Draws an empty square for piece weighted by the model, pawns stay off
+	the first and last rank and allowed, if set, rules out more squares.
+	With a chance of Support a pawn goes where a pawn of its color defends
+	it, if there is such a square. ok is false when no square is left
+*/
+func (m *PlacementModel) square(piece rune, board [8][8]int8, r *rand.Rand, allowed func(sq int8) bool) (sq int8, ok bool) {
+	pawn := piece == 'P' || piece == 'p'
+
+	candidates := []int8{}
+	for s := int8(0); s < 64; s++ {
+		if board[s/8][s%8] != 0 || (pawn && (s/8 == 0 || s/8 == 7)) {
+			continue
+		}
+		if allowed != nil && !allowed(s) {
+			continue
+		}
+		candidates = append(candidates, s)
+	}
+
+	if pawn && r.Float64() < m.Support {
+		chain := []int8{}
+		for _, s := range candidates {
+			if defended(board, piece, s) {
+				chain = append(chain, s)
+			}
+		}
+		if len(chain) > 0 {
+			candidates = chain
+		}
+	}
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	total := 0.0
+	for _, s := range candidates {
+		total += m.weight(piece, s)
+	}
+	x := r.Float64() * total
+	for _, s := range candidates {
+		x -= m.weight(piece, s)
+		if x < 0 {
+			return s, true
+		}
+	}
+
+	// rounding can leave x just past the last square
+	return candidates[len(candidates)-1], true
+}
+
+/*
+	How game-like the placement of fen is, between 0 and 1. It is the
+	geometric mean, over every piece, of the chance of its square relative
+	to the most common square of that piece, so 1 has every piece where the
+	corpus had it most
+*/
+func (m *PlacementModel) Plausibility(fen string) (float64, error) {
+	fields := strings.Fields(fen)
+	if len(fields) == 0 {
+		return 0, ErrInvalidFEN
+	}
+	board, err := parseBoard(fields[0])
+	if err != nil {
+		return 0, fmt.Errorf("%w -- %s", ErrInvalidFEN, err)
+	}
+
+	logSum, pieces := 0.0, 0
+	for row := int8(0); row < 8; row++ {
+		for col := int8(0); col < 8; col++ {
+			piece, ok := BitToPiece[board[row][col]]
+			if !ok {
+				continue
+			}
+
+			best := 0.0
+			for s := int8(0); s < 64; s++ {
+				best = math.Max(best, m.weight(piece, s))
+			}
+
+			logSum += math.Log(m.weight(piece, squareHash(row, col)) / best)
+			pieces++
+		}
+	}
+	if pieces == 0 {
+		return 0, nil
+	}
+
+	return math.Exp(logSum / float64(pieces)), nil
+}
+
+// whether a pawn of the color of pawn defends sq
+func defended(board [8][8]int8, pawn rune, sq int8) bool {
+	// the defender stands a row behind, which is further down for white
+	row, own := sq/8+1, PieceToBit['P']
+	if pawn == 'p' {
+		row, own = sq/8-1, PieceToBit['p']
+	}
+	if row < 0 || row > 7 {
+		return false
+	}
+
+	for _, col := range []int8{sq%8 - 1, sq%8 + 1} {
+		if col >= 0 && col < 8 && board[row][col] == own {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+package puzzlegen
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func placementModel(t *testing.T) *PlacementModel {
+	f, err := os.Open("testdata/games.pgn")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer f.Close()
+
+	m, err := BuildPlacementModel(f)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return m
+}
+
+func TestBuildPlacementModel(t *testing.T) {
+	m := placementModel(t)
+
+	// 3 games of 33, 40 and 40 plies without their first 10
+	if m.Positions != 86 {
+		t.Fatalf("expected 86 positions, got %d", m.Positions)
+	}
+	if m.Support <= 0 || m.Support >= 1 {
+		t.Fatalf("expected some pawns to be defended, got %v", m.Support)
+	}
+
+	// two of the games castle short
+	best := int8(0)
+	for sq := int8(0); sq < 64; sq++ {
+		if m.Squares["K"][sq] > m.Squares["K"][best] {
+			best = sq
+		}
+	}
+	if squareName(best) != "g1" {
+		t.Fatalf("expected the white king on g1 most, got %s", squareName(best))
+	}
+}
+
+func TestSaveLoadPlacementModel(t *testing.T) {
+	m := placementModel(t)
+
+	path := filepath.Join(t.TempDir(), "placement.json")
+	err := m.Save(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	loaded, err := LoadPlacementModel(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if loaded.Positions != m.Positions || loaded.Support != m.Support || loaded.Squares["p"] != m.Squares["p"] {
+		t.Fatalf("expected the saved model")
+	}
+
+	err = os.WriteFile(path, []byte(`{"squares": {"x": []}}`), 0644)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	_, err = LoadPlacementModel(path)
+	if !errors.Is(err, ErrInvalidModel) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidModel, err)
+	}
+}
+
+func TestPlausibility(t *testing.T) {
+	m := placementModel(t)
+
+	// castled kings behind their pawns against kings in the centre
+	castled, err := m.Plausibility("r4rk1/pp3ppp/8/8/8/8/PP3PPP/R4RK1 w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	scattered, err := m.Plausibility("8/P2r4/4p3/3k4/2K1p3/5R2/1P3r2/R7 w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if castled <= scattered || castled > 1 || scattered <= 0 {
+		t.Fatalf("expected castled kings to be more plausible, got %v and %v", castled, scattered)
+	}
+
+	_, err = m.Plausibility("")
+	if !errors.Is(err, ErrInvalidFEN) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidFEN, err)
+	}
+}
+
+func TestGenerateFromPlacementModel(t *testing.T) {
+	cfg := PuzzleConfig{
+		WhiteQ: 1,
+		WhiteR: 2,
+		WhiteB: 1,
+		WhiteN: 1,
+		WhiteP: 6,
+		BlackQ: 1,
+		BlackR: 2,
+		BlackB: 1,
+		BlackN: 1,
+		BlackP: 6,
+	}
+	m := placementModel(t)
+
+	// the mean plausibility of positions drawn with and without the model
+	mean := func(cfg PuzzleConfig) float64 {
+		total, n := 0.0, 0
+		for seed := int64(1); seed <= 100; seed++ {
+			fen, _, err := GenerateRandomFEN(cfg, NewRand(seed))
+			if errors.Is(err, ErrInvalidPosition) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+
+			plausibility, err := m.Plausibility(fen)
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+			total += plausibility
+			n++
+		}
+		return total / float64(n)
+	}
+
+	uniform := mean(cfg)
+	cfg.Model = m
+	modelled := mean(cfg)
+	if modelled <= uniform {
+		t.Fatalf("expected the model to draw more plausible positions, got %v against %v", modelled, uniform)
+	}
+
+	// the score is returned with the fen and drawn again from the seed
+	fen, plausibility, err := GenerateRandomFEN(cfg, NewRand(7))
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	again, plausibilityAgain, err := GenerateRandomFEN(cfg, NewRand(7))
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if fen != again || plausibility != plausibilityAgain || plausibility == 0 {
+		t.Fatalf("expected the same position and score, got %s %v and %s %v", fen, plausibility, again, plausibilityAgain)
+	}
+}
+
+func TestNoSquareLeft(t *testing.T) {
+	cfg := PuzzleConfig{Model: placementModel(t)}
+
+	// every square next to the other king
+	opponent := map[int8]bool{}
+	for sq := int8(0); sq < 64; sq++ {
+		opponent[sq] = true
+	}
+
+	_, _, err := kingSquare(cfg, 'k', nil, [8][8]int8{}, NewRand(1), 1, opponent)
+	if !errors.Is(err, ErrNoSquare) {
+		t.Fatalf("expected error %v, got %v", ErrNoSquare, err)
+	}
+}
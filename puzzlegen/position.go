@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"strconv"
 	"strings"
 	"unicode"
+
+	chess "github.com/garlicgarrison/go-chess"
 )
 
 const NonKingPieces = "PNBRQpnbrq"
@@ -16,6 +17,7 @@ const NoiseSTD = 0.5
 var (
 	ErrInvalidPuzzleConfig = errors.New("pieces must add up to 30")
 	ErrInvalidFEN          = errors.New("invalid fen")
+	ErrNoSquare            = errors.New("no square left to place a piece")
 )
 
 var PieceToBit = map[rune]int8{
@@ -63,25 +65,12 @@ var StartPieces = map[rune]int{
 	'k': 1,
 }
 
-var castleSquares = map[rune][][]int8{
-	'K': {
-		{7, 5},
-		{7, 6},
-	},
-	'Q': {
-		{7, 1},
-		{7, 2},
-		{7, 3},
-	},
-	'k': {
-		{0, 5},
-		{0, 6},
-	},
-	'q': {
-		{0, 1},
-		{0, 2},
-		{0, 3},
-	},
+// where kings and rooks start, castling rights need them there
+var homeSquares = map[rune][]int8{
+	'K': {60},
+	'R': {63, 56},
+	'k': {4},
+	'r': {7, 0},
 }
 
 // these are simply arbitrary
@@ -97,57 +86,85 @@ type PuzzleConfig struct {
 	BlackB int8 `yaml:"black_b"`
 	BlackN int8 `yaml:"black_n"`
 	BlackP int8 `yaml:"black_p"`
-}
 
-func validatePuzzleCfg(cfg PuzzleConfig) bool {
-	return cfg.WhiteQ+
-		cfg.WhiteR+
-		cfg.WhiteB+
-		cfg.WhiteN+
-		cfg.WhiteP+
-		cfg.BlackQ+
-		cfg.BlackR+
-		cfg.BlackB+
-		cfg.BlackN+
-		cfg.BlackP <= 30
+	// Castling puts kings and rooks on their home squares first and gives
+	// them their castling rights. EnPassant sets the en passant square when
+	// the last move could have been a double push that can be taken. Both
+	// are off so that puzzles only hinge on them on purpose
+	Castling  bool `yaml:"castling"`
+	EnPassant bool `yaml:"en_passant"`
+
+	// Chess960 draws the home squares of kings and rooks like a Chess960
+	// start and writes castling rights as Shredder-FEN, see chess960Homes
+	Chess960 bool `yaml:"chess960"`
+
+	// Ranges are keyed like the count fields, white_q to black_p. A piece
+	// with a range is drawn from it instead of having the count of its field
+	Ranges map[string]PieceRange `yaml:"ranges"`
+
+	// Signatures outside a target are drawn again. Imbalance is the white
+	// material minus the black one, no target allows any material
+	WhiteMaterial *MaterialRange `yaml:"white_material"`
+	BlackMaterial *MaterialRange `yaml:"black_material"`
+	Imbalance     *MaterialRange `yaml:"imbalance"`
+
+	// PlacementModel is the file of a model built by BuildPlacementModel,
+	// the generator loads it into Model. Without a model every empty square
+	// is as likely
+	PlacementModel string          `yaml:"placement_model"`
+	Model          *PlacementModel `yaml:"-"`
 }
 
 /*
-	Generates a random valid FEN position from scratch
-	NOTE: kings are not in check/checkmate
+	Generates a random valid FEN position from scratch, every choice is drawn
+	from r so the same seed gives the same position. nil r is random. The
+	material is drawn first, see sampleSignature, then the squares from
+	cfg.Model if it is set. plausibility is the Plausibility of the position
+	under cfg.Model, 0 without one
+	NOTE: kings are not in check/checkmate, positions ValidatePosition
+	rejects return ErrInvalidPosition
 */
-func GenerateRandomFEN(cfg PuzzleConfig) (string, error) {
-	ok := validatePuzzleCfg(cfg)
-	if !ok {
-		return "", ErrInvalidPuzzleConfig
+func GenerateRandomFEN(cfg PuzzleConfig, r *rand.Rand) (fen string, plausibility float64, err error) {
+	r = orRand(r)
+	pieceMap, err := sampleSignature(cfg, r)
+	if err != nil {
+		return "", 0, err
 	}
 
-	board := [8][8]int8{}
-	pieceMap := map[rune]int8{
-		'Q': cfg.WhiteQ,
-		'R': cfg.WhiteR,
-		'B': cfg.WhiteB,
-		'N': cfg.WhiteN,
-		'P': cfg.WhiteP,
-		'q': cfg.BlackQ,
-		'r': cfg.BlackR,
-		'b': cfg.BlackB,
-		'n': cfg.BlackN,
-		'p': cfg.BlackP,
+	homes, castling := homeSquares, ""
+	switch {
+	case cfg.Castling && cfg.Chess960:
+		homes = chess960Homes(r)
+		castling = chess960Castling(homes)
+	case cfg.Castling:
+		castling = "KQkq"
 	}
 
+	board := [8][8]int8{}
+
 	whiteAttacks := make(map[int8]bool)
 	blackAttacks := make(map[int8]bool)
 
-	for piece, num := range pieceMap {
+	// in a fixed order, ranging over the map would change it every run
+	for _, piece := range NonKingPieces {
+		num := pieceMap[piece]
 		for i := int8(0); i < num; i++ {
-			for {
+			for tries := 0; ; tries++ {
 				var pRow, pCol int8
-				switch piece {
-				case 'P', 'p':
-					pRow, pCol = int8(rand.Intn(6)+1), int8(rand.Intn(8))
+				switch {
+				case cfg.Castling && tries < len(homes[piece]):
+					sq := homes[piece][tries]
+					pRow, pCol = sq/8, sq%8
+				case cfg.Model != nil:
+					sq, ok := cfg.Model.square(piece, board, r, nil)
+					if !ok {
+						return "", 0, fmt.Errorf("%w -- %c", ErrNoSquare, piece)
+					}
+					pRow, pCol = sq/8, sq%8
+				case piece == 'P' || piece == 'p':
+					pRow, pCol = int8(r.Intn(6)+1), int8(r.Intn(8))
 				default:
-					pRow, pCol = int8(rand.Intn(8)), int8(rand.Intn(8))
+					pRow, pCol = int8(r.Intn(8)), int8(r.Intn(8))
 				}
 
 				if board[pRow][pCol] == 0 {
@@ -177,8 +194,11 @@ func GenerateRandomFEN(cfg PuzzleConfig) (string, error) {
 	}
 
 	// Add white king
-	for {
-		pRow, pCol := int8(rand.Intn(8)), int8(rand.Intn(8))
+	for tries := 0; ; tries++ {
+		pRow, pCol, err := kingSquare(cfg, 'K', homes, board, r, tries, blackAttacks)
+		if err != nil {
+			return "", 0, err
+		}
 
 		if board[pRow][pCol] == 0 && !blackAttacks[squareHash(pRow, pCol)] {
 			board[pRow][pCol] = PieceToBit['K']
@@ -191,8 +211,11 @@ func GenerateRandomFEN(cfg PuzzleConfig) (string, error) {
 	}
 
 	// Add black king
-	for {
-		pRow, pCol := int8(rand.Intn(8)), int8(rand.Intn(8))
+	for tries := 0; ; tries++ {
+		pRow, pCol, err := kingSquare(cfg, 'k', homes, board, r, tries, whiteAttacks)
+		if err != nil {
+			return "", 0, err
+		}
 
 		if board[pRow][pCol] == 0 && !whiteAttacks[squareHash(pRow, pCol)] {
 			board[pRow][pCol] = PieceToBit['k']
@@ -202,10 +225,42 @@ func GenerateRandomFEN(cfg PuzzleConfig) (string, error) {
 
 	// Randomly choose side -- 0 for black 1 for white
 	var sb strings.Builder
-	player := int8(rand.Intn(2))
-	writeFEN(&sb, player, board, blackAttacks, whiteAttacks)
+	player := int8(r.Intn(2))
 
-	return sb.String(), nil
+	enPassant := int8(-1)
+	if squares := enPassantSquares(board, player == 1); cfg.EnPassant && len(squares) > 0 {
+		enPassant = squares[r.Intn(len(squares))]
+	}
+	writeFEN(&sb, player, board, castling, enPassant, cfg.Chess960)
+
+	fen, err = checkFEN(sb.String(), cfg.Chess960)
+	if err != nil || cfg.Model == nil {
+		return fen, 0, err
+	}
+
+	plausibility, err = cfg.Model.Plausibility(fen)
+	return fen, plausibility, err
+}
+
+/*
+	The square to try for a king, its square of homes first if castling is
+	on, then one drawn from the model among the squares the opponent does
+	not attack, or any square
+*/
+func kingSquare(cfg PuzzleConfig, king rune, homes map[rune][]int8, board [8][8]int8, r *rand.Rand, tries int, opponent map[int8]bool) (int8, int8, error) {
+	switch {
+	case cfg.Castling && tries == 0:
+		sq := homes[king][0]
+		return sq / 8, sq % 8, nil
+	case cfg.Model != nil:
+		sq, ok := cfg.Model.square(king, board, r, func(sq int8) bool { return !opponent[sq] })
+		if !ok {
+			return 0, 0, fmt.Errorf("%w -- %c", ErrNoSquare, king)
+		}
+		return sq / 8, sq % 8, nil
+	}
+
+	return int8(r.Intn(8)), int8(r.Intn(8)), nil
 }
 
 /*
@@ -213,59 +268,52 @@ func GenerateRandomFEN(cfg PuzzleConfig) (string, error) {
 	one of those pieces, and then adding the kings with enpassant/casting rights
 	We have to assume the fen is a valid position to start with
 
-	asymptote is the number of pieces we want to converge to
+	asymptote is the number of pieces we want to converge to, the mutation is
+	drawn from r like in GenerateRandomFEN. Shredder-FEN castling rights
+	mutate the position as Chess960
 */
-func MutateFEN(fen string, asymptote int) (string, error) {
+func MutateFEN(fen string, asymptote int, r *rand.Rand) (string, error) {
+	r = orRand(r)
 	if asymptote > 30 {
 		return "", ErrInvalidFEN
 	}
 
-	board := [8][8]int8{}
-	fen = strings.TrimSpace(fen)
-	parts := strings.Split(fen, " ")
+	p, err := parseMutable(fen)
+	if err != nil {
+		return "", err
+	}
+	board := p.board
 
 	startMap := make(map[rune]int)
 	for key, value := range StartPieces {
 		startMap[key] = value
 	}
 
+	// the kings are taken off and put back once the other pieces changed
 	var blackK int8
 	var whiteK int8
-
-	rankStrs := strings.Split(parts[0], "/")
 	totalPieces := 0
 
-	for rank, row := range rankStrs {
-		var file int8
-		for _, p := range row {
-			if p == 'k' {
-				blackK = int8(rank)*8 + file
-				continue
-			}
-			if p == 'K' {
-				whiteK = int8(rank)*8 + file
-				continue
-			}
-
-			pieceBit, ok := PieceToBit[p]
-			if !ok {
-				skip, err := strconv.ParseInt(string(p), 10, 8)
-				if err != nil {
-					return "", ErrInvalidFEN
-				}
-
-				file += int8(skip)
-				continue
-			}
+	for sq := int8(0); sq < 64; sq++ {
+		piece, ok := BitToPiece[board[sq/8][sq%8]]
+		if !ok {
+			continue
+		}
 
-			board[rank][file] = pieceBit
-			startMap[p]--
-			file++
+		switch piece {
+		case 'k':
+			blackK = sq
+			board[sq/8][sq%8] = 0
+		case 'K':
+			whiteK = sq
+			board[sq/8][sq%8] = 0
+		default:
+			startMap[piece]--
 			totalPieces++
 		}
 	}
 
-	noise := rand.NormFloat64()*NoiseSTD + 1
+	noise := r.NormFloat64()*NoiseSTD + 1
 	toAdd := int(math.Floor((float64(asymptote) - float64(totalPieces)) * noise))
 	if toAdd < -1*totalPieces {
 		toAdd = 1
@@ -274,24 +322,26 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 	}
 
 	pieceOperations := int(math.Abs(float64(toAdd)))
-	randRow := rand.Intn(8)
-	randCol := rand.Intn(8)
-	if toAdd == 0 {
+	randRow := r.Intn(8)
+	randCol := r.Intn(8)
+
+	// there is nothing to swap on a board with only kings
+	if toAdd == 0 && totalPieces > 0 {
 		for {
-			randomPiece := rune(NonKingPieces[rand.Intn(8)])
+			randomPiece := rune(NonKingPieces[r.Intn(8)])
 			pieceToRemove := board[randRow][randCol]
 			if (randomPiece == 'P' || randomPiece == 'p') && (randRow == 7 || randRow == 0) ||
 				board[randRow][randCol] == 0 ||
 				PieceToBit[randomPiece] == pieceToRemove {
-				randRow = rand.Intn(8)
-				randCol = rand.Intn(8)
+				randRow = r.Intn(8)
+				randCol = r.Intn(8)
 				continue
 			}
 			startMap[BitToPiece[pieceToRemove]]++
 
 			for {
-				randRow = rand.Intn(8)
-				randCol = rand.Intn(8)
+				randRow = r.Intn(8)
+				randCol = r.Intn(8)
 				startMap[randomPiece]--
 				if board[randRow][randCol] == 0 &&
 					!((randomPiece == 'P' || randomPiece == 'p') && (randRow == 7 || randRow == 0)) {
@@ -307,12 +357,12 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 	for i := 0; i < pieceOperations; i++ {
 		if toAdd > 0 {
 			for {
-				randomPiece := rune(NonKingPieces[rand.Intn(8)])
+				randomPiece := rune(NonKingPieces[r.Intn(8)])
 				if (randomPiece == 'P' || randomPiece == 'p') && (randRow == 7 || randRow == 0) ||
 					startMap[randomPiece] == 0 ||
 					board[randRow][randCol] != 0 {
-					randRow = rand.Intn(8)
-					randCol = rand.Intn(8)
+					randRow = r.Intn(8)
+					randCol = r.Intn(8)
 					continue
 				}
 
@@ -329,8 +379,8 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 					break
 				}
 
-				randRow = rand.Intn(8)
-				randCol = rand.Intn(8)
+				randRow = r.Intn(8)
+				randCol = r.Intn(8)
 			}
 		}
 	}
@@ -364,7 +414,7 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 			pRow, pCol = whiteK/8, whiteK%8
 			placementAttempted = true
 		} else {
-			pRow, pCol = int8(rand.Intn(8)), int8(rand.Intn(8))
+			pRow, pCol = int8(r.Intn(8)), int8(r.Intn(8))
 		}
 
 		if board[pRow][pCol] == 0 && !blackAttacks[squareHash(pRow, pCol)] {
@@ -385,7 +435,7 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 			pRow, pCol = blackK/8, blackK%8
 			placementAttempted = true
 		} else {
-			pRow, pCol = int8(rand.Intn(8)), int8(rand.Intn(8))
+			pRow, pCol = int8(r.Intn(8)), int8(r.Intn(8))
 		}
 
 		if board[pRow][pCol] == 0 && !whiteAttacks[squareHash(pRow, pCol)] {
@@ -394,15 +444,16 @@ func MutateFEN(fen string, asymptote int) (string, error) {
 		}
 	}
 
-	// Pieces of FEN
+	// Pieces of FEN, the rights and en passant square of fen are kept while
+	// the pieces still allow them
 	var sb strings.Builder
 	var player int8
-	if parts[1] == "w" {
+	if p.white {
 		player = 1
 	}
-	writeFEN(&sb, player, board, blackAttacks, whiteAttacks)
+	writeFEN(&sb, player, board, p.castling, p.enPassant, p.chess960)
 
-	return sb.String(), nil
+	return checkFEN(sb.String(), p.chess960)
 }
 
 func squareHash(row, col int8) int8 {
@@ -452,18 +503,17 @@ func kingAttacks(board [8][8]int8, row, col int8) []int8 {
 
 func pawnAttacks(white bool, board [8][8]int8, row, col int8) []int8 {
 	attacks := make([]int8, 0)
+	forward := int8(1)
 	if white {
-		attacks = append(
-			attacks,
-			squareHash(row-1, col+1),
-			squareHash(row-1, col-1),
-		)
-	} else {
-		attacks = append(
-			attacks,
-			squareHash(row+1, col+1),
-			squareHash(row+1, col-1),
-		)
+		forward = -1
+	}
+
+	// pawns on the edge attack one square, and none from the last rank
+	for _, c := range []int8{col - 1, col + 1} {
+		r := row + forward
+		if r >= 0 && r < 8 && c >= 0 && c < 8 {
+			attacks = append(attacks, squareHash(r, c))
+		}
 	}
 
 	return attacks
@@ -567,7 +617,91 @@ func queenAttacks(board [8][8]int8, row, col int8) []int8 {
 	return attacks
 }
 
-func writeFEN(sb *strings.Builder, player int8, board [8][8]int8, blackAttacks, whiteAttacks map[int8]bool) {
+/*
+	castling are the rights the position may have, each is written if its
+	king and rook are on their home squares, or for chess960 if they are
+	on the back rank, see chess960Rights. enPassant is written if it can be
+	taken, -1 writes none
+*/
+func writeFEN(sb *strings.Builder, player int8, board [8][8]int8, castling string, enPassant int8, chess960 bool) {
+	writePlacement(sb, board)
+
+	white := player == 1
+	if white {
+		sb.WriteString(" w")
+	} else {
+		sb.WriteString(" b")
+	}
+
+	rights := ""
+	if chess960 {
+		rights = chess960Rights(board, castling)
+	}
+	for _, right := range "KQkq" {
+		if !chess960 && strings.ContainsRune(castling, right) && canCastle(board, right) {
+			rights += string(right)
+		}
+	}
+	if rights == "" {
+		rights = "-"
+	}
+
+	// castling does not change en passant, go-chess cannot read 960 rights
+	ep := "-"
+	if enPassant >= 0 && canEnPassant(board, white, enPassant) &&
+		canTakeEnPassant(fmt.Sprintf("%s - %s 0 1", sb.String(), squareName(enPassant))) {
+		ep = squareName(enPassant)
+	}
+
+	sb.WriteString(fmt.Sprintf(" %s %s 0 1", rights, ep))
+}
+
+/*
+	The squares behind pawns of the side not to move that could have just
+	moved two squares, with a pawn of the side to move next to them
+*/
+func enPassantSquares(board [8][8]int8, white bool) []int8 {
+	squares := []int8{}
+
+	// the pawn that moved and the pawns taking it stand one row past the square
+	row, pawnRow, taker := int8(5), int8(4), PieceToBit['p']
+	if white {
+		row, pawnRow, taker = 2, 3, PieceToBit['P']
+	}
+
+	for col := int8(0); col < 8; col++ {
+		sq := squareHash(row, col)
+		if !canEnPassant(board, white, sq) {
+			continue
+		}
+		for _, c := range []int8{col - 1, col + 1} {
+			if c >= 0 && c < 8 && board[pawnRow][c] == taker {
+				squares = append(squares, sq)
+				break
+			}
+		}
+	}
+
+	return squares
+}
+
+// whether the side to move has a legal en passant capture
+func canTakeEnPassant(fen string) bool {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		return false
+	}
+
+	for _, m := range chess.NewGame(f).Position().ValidMoves() {
+		if m.HasTag(chess.EnPassant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writePlacement(sb *strings.Builder, board [8][8]int8) {
 	for i, row := range board {
 		empty := 0
 		for _, val := range row {
@@ -589,56 +723,4 @@ func writeFEN(sb *strings.Builder, player int8, board [8][8]int8, blackAttacks,
 			sb.WriteRune('/')
 		}
 	}
-
-	if player == 0 {
-		sb.WriteString(" b")
-	} else {
-		sb.WriteString(" w")
-	}
-
-	sb.WriteRune(' ')
-	if board[7][4] != 'K' && board[0][4] != 'k' {
-		sb.WriteRune('-')
-		goto EnPassant
-	}
-
-	for e, squares := range castleSquares {
-		attackFound := false
-		for _, s := range squares {
-			var check map[int8]bool
-			if unicode.IsUpper(e) {
-				check = blackAttacks
-			} else {
-				check = whiteAttacks
-			}
-
-			if check[squareHash(s[0], s[1])] {
-				attackFound = true
-				break
-			}
-		}
-
-		if !attackFound {
-			sb.WriteRune(e)
-		}
-	}
-
-EnPassant:
-	sb.WriteRune(' ')
-	eSquare := rand.Intn(8)
-	if player == 0 && board[3][eSquare] == PieceToBit['p'] &&
-		board[2][eSquare]+board[1][eSquare] == 0 {
-		sb.WriteRune(rune(eSquare + 97))
-		sb.WriteString(fmt.Sprintf("%d", 6))
-	} else if player == 1 &&
-		board[4][eSquare] == PieceToBit['P'] &&
-		board[5][eSquare]+board[6][eSquare] == 0 {
-		sb.WriteRune(rune(eSquare + 97))
-		sb.WriteString(fmt.Sprintf("%d", 3))
-	} else {
-		sb.WriteRune('-')
-	}
-
-	sb.WriteString(" 0 ")
-	sb.WriteRune('1')
 }
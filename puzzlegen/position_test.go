@@ -1,7 +1,9 @@
 package puzzlegen
 
 import (
+	"errors"
 	"log"
+	"strings"
 	"testing"
 )
 
@@ -19,17 +21,182 @@ func TestPosition(t *testing.T) {
 		BlackP: 1,
 	}
 
-	fen, err := GenerateRandomFEN(cfg)
+	fen, _, err := GenerateRandomFEN(cfg, nil)
 	if err != nil {
 		t.Fatalf("err -- %s", err)
 	}
 	log.Printf("fen generated -- %s", fen)
 
 	for i := 0; i < 10; i++ {
-		fen, err = MutateFEN(fen, 5)
+		// rejected mutations keep the previous position
+		next, err := MutateFEN(fen, 5, nil)
+		if errors.Is(err, ErrInvalidPosition) {
+			continue
+		}
 		if err != nil {
 			t.Fatalf("err -- %s", err)
 		}
+		fen = next
 		log.Printf("fen mutated -- %s", fen)
 	}
 }
+
+func TestPositionSeed(t *testing.T) {
+	cfg := PuzzleConfig{
+		WhiteQ: 1,
+		WhiteR: 2,
+		WhiteP: 3,
+		BlackB: 1,
+		BlackN: 2,
+		BlackP: 3,
+	}
+
+	// every fen of a run is drawn again from its seed
+	run := func(seed int64) []string {
+		fen, _, err := GenerateRandomFEN(cfg, NewRand(seed))
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		fens := []string{fen}
+		for i := int64(0); i < 10; i++ {
+			fen, err = MutateFEN(fen, 5, NewRand(seed+i))
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+			fens = append(fens, fen)
+		}
+
+		return fens
+	}
+
+	for seed := int64(1); seed <= 20; seed++ {
+		first, second := run(seed), run(seed)
+		for i := range first {
+			if first[i] != second[i] {
+				t.Fatalf("seed %d -- %s and %s differ", seed, first[i], second[i])
+			}
+		}
+	}
+}
+
+func TestWriteFEN(t *testing.T) {
+	tests := []struct {
+		placement string
+		player    int8
+		castling  string
+		enPassant string
+		chess960  bool
+		fen       string
+	}{
+		{"r3k3/8/8/8/8/8/8/R3K2R", 1, "KQkq", "-", false, "r3k3/8/8/8/8/8/8/R3K2R w KQq - 0 1"},
+		{"r3k3/8/8/8/8/8/8/R3K2R", 1, "", "-", false, "r3k3/8/8/8/8/8/8/R3K2R w - - 0 1"},
+		// the king left its home square
+		{"r3k3/8/8/8/8/8/8/R4K1R", 0, "KQkq", "-", false, "r3k3/8/8/8/8/8/8/R4K1R b q - 0 1"},
+		{"4k3/8/8/3pP3/8/8/8/4K3", 1, "", "d6", false, "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1"},
+		// nothing can take the pawn
+		{"4k3/8/8/3p4/8/8/8/4K3", 1, "", "d6", false, "4k3/8/8/3p4/8/8/8/4K3 w - - 0 1"},
+		// taking would expose the king to the rook
+		{"8/8/8/K2pP2r/8/8/8/4k3", 1, "", "d6", false, "8/8/8/K2pP2r/8/8/8/4k3 w - - 0 1"},
+		// chess960 rights are the files of the rooks, one on each side of the king
+		{"1r3kr1/8/8/8/8/8/8/RR3K1R", 1, "HBAgb", "-", true, "1r3kr1/8/8/8/8/8/8/RR3K1R w HBgb - 0 1"},
+		{"1r3kr1/8/8/8/8/8/8/1R2K2R", 0, "HBgb", "-", true, "1r3kr1/8/8/8/8/8/8/1R2K2R b HBgb - 0 1"},
+	}
+	for _, test := range tests {
+		board, err := parseBoard(test.placement)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		enPassant := int8(-1)
+		if sq, ok := parseSquare(test.enPassant); ok {
+			enPassant = sq
+		}
+
+		var sb strings.Builder
+		writeFEN(&sb, test.player, board, test.castling, enPassant, test.chess960)
+		if sb.String() != test.fen {
+			t.Fatalf("expected %s, got %s", test.fen, sb.String())
+		}
+	}
+}
+
+func TestCastlingEnPassantConfig(t *testing.T) {
+	cfg := PuzzleConfig{
+		WhiteR: 2,
+		WhiteP: 8,
+		BlackR: 2,
+		BlackP: 8,
+	}
+
+	// neither appears unless it is enabled
+	count := func(cfg PuzzleConfig) (castling, enPassant int) {
+		for seed := int64(1); seed <= 300; seed++ {
+			fen, _, err := GenerateRandomFEN(cfg, NewRand(seed))
+			if errors.Is(err, ErrInvalidPosition) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+
+			fields := strings.Fields(fen)
+			if fields[2] != "-" {
+				castling++
+			}
+			if fields[3] != "-" {
+				enPassant++
+			}
+		}
+		return castling, enPassant
+	}
+
+	castling, enPassant := count(cfg)
+	if castling != 0 || enPassant != 0 {
+		t.Fatalf("expected no castling or en passant, got %d and %d", castling, enPassant)
+	}
+
+	cfg.Castling, cfg.EnPassant = true, true
+	castling, enPassant = count(cfg)
+	if castling == 0 || enPassant == 0 {
+		t.Fatalf("expected castling and en passant, got %d and %d", castling, enPassant)
+	}
+}
+
+func TestMutateFENCastling(t *testing.T) {
+	fens := []string{
+		"r3k2r/pppppppp/8/8/8/8/PPPPPPPP/R3K2R w KQkq - 0 1",
+		// Shredder rights of a Chess960 position
+		"1r2k1r1/pppppppp/8/8/8/8/PPPPPPPP/1R2K1R1 w GBgb - 0 1",
+	}
+
+	for _, fen := range fens {
+		fields := strings.Fields(fen)
+		ranks := strings.Split(fields[0], "/")
+
+		kept := 0
+		for seed := int64(0); seed < 50; seed++ {
+			next, err := MutateFEN(fen, 22, NewRand(seed))
+			if errors.Is(err, ErrInvalidPosition) {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("err -- %s", err)
+			}
+
+			// pieces were only added or removed away from the back ranks
+			nextFields := strings.Fields(next)
+			nextRanks := strings.Split(nextFields[0], "/")
+			if nextRanks[0] != ranks[0] || nextRanks[7] != ranks[7] {
+				continue
+			}
+			if nextFields[2] != fields[2] {
+				t.Fatalf("%s -- expected the rights %s to be kept, got %s", fen, fields[2], next)
+			}
+			kept++
+		}
+		if kept == 0 {
+			t.Fatalf("%s -- expected a mutation to leave the back ranks alone", fen)
+		}
+	}
+}
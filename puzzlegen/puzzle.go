@@ -1,12 +1,93 @@
 package puzzlegen
 
+import (
+	"fmt"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/tablebase"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+// marks puzzles proven from endgame tables, engine searches leave Verified empty
+const VerifiedTablebase = "tablebase"
+
 type Puzzle struct {
+	// the same for the puzzle, its mirror and its color flip, see PuzzleID
+	ID       string   `json:"id,omitempty"`
 	Position string   `json:"position"`
 	Solution []string `json:"solution"`
 	MateIn   int      `json:"mate_in"`
 	CP       int      `json:"cp"`
+	Verified string   `json:"verified,omitempty"`
+	// NewRand(Seed) draws the position again, from scratch or as a mutation
+	// of the puzzle it was annealed from by the operator Mutation, see
+	// ApplyMutation
+	Seed     int64    `json:"seed,omitempty"`
+	Mutation Mutation `json:"mutation,omitempty"`
+	// how game-like the position is under the placement model, see
+	// PlacementModel.Plausibility
+	Plausibility float64 `json:"plausibility,omitempty"`
+	// the game the position was taken from, nil for generated positions
+	Source *Source `json:"source,omitempty"`
+	// the position is Chess960, its castling rights are Shredder-FEN
+	Chess960 bool `json:"chess960,omitempty"`
+}
+
+/*
+	A position of a game in a PGN file or a line of a position file. Game
+	counts the games of File from 1, Ply the moves played before the
+	position from 0. Line counts the lines of a position file from 1, ID is
+	its id opcode
+*/
+type Source struct {
+	File  string `json:"file"`
+	Game  int    `json:"game,omitempty"`
+	Event string `json:"event,omitempty"`
+	White string `json:"white,omitempty"`
+	Black string `json:"black,omitempty"`
+	Ply   int    `json:"ply,omitempty"`
+	Line  int    `json:"line,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+func (s *Source) String() string {
+	if s.Line > 0 {
+		return fmt.Sprintf("%s line %d", s.File, s.Line)
+	}
+	return fmt.Sprintf("%s game %d ply %d", s.File, s.Game, s.Ply)
 }
 
 type Puzzles struct {
 	Puzzles []Puzzle `json:"puzzles"`
 }
+
+/*
+	Builds the puzzle of a position from its solution and the search of its
+	first move, either may be nil
+*/
+func NewPuzzle(fen string, solution *chess.Game, res *analysis.Result) Puzzle {
+	puzzle := Puzzle{
+		Position: fen,
+		Solution: []string{},
+	}
+
+	if id, err := PuzzleID(fen); err == nil {
+		puzzle.ID = id
+	}
+
+	if solution != nil {
+		for _, m := range solution.Moves() {
+			puzzle.Solution = append(puzzle.Solution, m.String())
+		}
+	}
+
+	if res != nil {
+		puzzle.MateIn = res.Best().Score.Mate
+		puzzle.CP = res.Best().Score.CP
+		if res.Engine == tablebase.Label {
+			puzzle.Verified = VerifiedTablebase
+		}
+	}
+
+	return puzzle
+}
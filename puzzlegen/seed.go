@@ -0,0 +1,56 @@
+package puzzlegen
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+	Seeds hands out the seeds of single puzzles from one seeded source, so a
+	run is replayed from its seed and a puzzle from its own seed. It is safe
+	for concurrent use
+*/
+type Seeds struct {
+	seed int64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// 0 picks a seed from the clock
+func NewSeeds(seed int64) *Seeds {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &Seeds{
+		seed: seed,
+		rng:  NewRand(seed),
+	}
+}
+
+// the seed the source started from
+func (s *Seeds) Seed() int64 {
+	return s.seed
+}
+
+func (s *Seeds) Next() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rng.Int63()
+}
+
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
+// nil uses a source seeded from the global one
+func orRand(r *rand.Rand) *rand.Rand {
+	if r == nil {
+		return NewRand(rand.Int63())
+	}
+
+	return r
+}
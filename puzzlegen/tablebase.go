@@ -0,0 +1,182 @@
+package puzzlegen
+
+import (
+	"errors"
+	"log"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/tablebase"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+// the longest mate searched with the tablebase, longer ones are left to the engine
+const tablebaseMateLimit = 3
+
+/*
+	Solves the position from the tablebase, ok is false when it is not
+	covered, or is won with a mate longer than tablebaseMateLimit, and the
+	engine has to search it. Draws and losses are proven by the tables
+	alone. Syzygy tables have no distance to mate, so wins are searched
+	for the fastest mate with every attacking move that does not keep the
+	win cut off. The attacker plays the fastest mate and the defender the
+	longest one, a position where the attacker has two fastest mates is
+	cut off like an engine line that is not unique
+*/
+func (g *MatePuzzleGenerator) tablebaseSolution(game *chess.Game) (solution *chess.Game, res *analysis.Result, ok bool) {
+	position := game.Position()
+	wdl, err := g.tablebase.ProbeWDL(position)
+	if err != nil {
+		if !errors.Is(err, tablebase.ErrNotCovered) {
+			log.Printf("error -- %s -- position: %s", err, position.String())
+		}
+		return nil, nil, false
+	}
+
+	res = &analysis.Result{
+		Engine: tablebase.Label,
+		Lines:  []analysis.Line{{MultiPV: 1, Score: tablebaseScore(wdl)}},
+	}
+	if wdl != tablebase.Win {
+		return nil, res, true
+	}
+
+	mateIn, err := g.tablebaseMateIn(position, tablebaseMateLimit)
+	if err != nil {
+		log.Printf("error -- %s -- position: %s", err, position.String())
+		return nil, nil, false
+	}
+	if mateIn == 0 {
+		return nil, nil, false
+	}
+	res.Lines[0].Score = analysis.Score{Mate: mateIn}
+
+	for n := mateIn; game.Outcome() == chess.NoOutcome; n-- {
+		moves, err := g.tablebaseMates(game.Position(), n, 2)
+		if err != nil {
+			log.Printf("error -- %s -- position: %s", err, game.Position().String())
+			return nil, nil, false
+		}
+
+		if len(moves) > 1 {
+			if len(game.Moves()) == 0 {
+				return nil, res, true
+			}
+			break
+		}
+		game.Move(moves[0])
+		if game.Outcome() != chess.NoOutcome {
+			break
+		}
+
+		reply, err := g.tablebaseDefence(game.Position(), n-1)
+		if err != nil {
+			log.Printf("error -- %s -- position: %s", err, game.Position().String())
+			return nil, nil, false
+		}
+		game.Move(reply)
+	}
+
+	res.BestMove = game.Moves()[0]
+	res.Lines[0].PV = game.Moves()
+	return game, res, true
+}
+
+// a proven result without a mate, a loss scores as low as being mated
+func tablebaseScore(wdl tablebase.WDL) analysis.Score {
+	if wdl == tablebase.Loss {
+		return analysis.Score{CP: -mateCP}
+	}
+	return analysis.Score{}
+}
+
+// the fastest mate of the attacker to move, 0 when there is none within limit
+func (g *MatePuzzleGenerator) tablebaseMateIn(position *chess.Position, limit int) (int, error) {
+	for n := 1; n <= limit; n++ {
+		moves, err := g.tablebaseMates(position, n, 1)
+		if err != nil {
+			return 0, err
+		}
+		if len(moves) > 0 {
+			return n, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// up to max moves that mate in at most n, in the order of ValidMoves
+func (g *MatePuzzleGenerator) tablebaseMates(position *chess.Position, n, max int) ([]*chess.Move, error) {
+	var mates []*chess.Move
+	for _, m := range position.ValidMoves() {
+		// the last move of a mate is a check
+		if n == 1 && !m.HasTag(chess.Check) {
+			continue
+		}
+
+		ok, err := g.tablebaseMated(position.Update(m), n-1)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			mates = append(mates, m)
+			if len(mates) == max {
+				break
+			}
+		}
+	}
+
+	return mates, nil
+}
+
+// whether the defender to move is mated in at most n moves of the attacker
+func (g *MatePuzzleGenerator) tablebaseMated(position *chess.Position, n int) (bool, error) {
+	switch position.Status() {
+	case chess.Checkmate:
+		return true, nil
+	case chess.Stalemate:
+		return false, nil
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	// a position that is not lost is cut off with one probe instead of a search
+	if n > 1 {
+		wdl, err := g.tablebase.ProbeWDL(position)
+		if err != nil {
+			return false, err
+		}
+		if wdl != tablebase.Loss {
+			return false, nil
+		}
+	}
+
+	for _, m := range position.ValidMoves() {
+		moves, err := g.tablebaseMates(position.Update(m), n, 1)
+		if err != nil {
+			return false, err
+		}
+		if len(moves) == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// the first reply, in the order of ValidMoves, that is mated slowest within n
+func (g *MatePuzzleGenerator) tablebaseDefence(position *chess.Position, n int) (*chess.Move, error) {
+	var best *chess.Move
+	slowest := 0
+	for _, m := range position.ValidMoves() {
+		mateIn, err := g.tablebaseMateIn(position.Update(m), n)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || mateIn > slowest {
+			best, slowest = m, mateIn
+		}
+	}
+
+	return best, nil
+}
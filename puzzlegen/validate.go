@@ -0,0 +1,379 @@
+package puzzlegen
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	The rules a position breaks, a Violation wraps one of them so callers can
+	check for a rule with errors.Is
+*/
+var (
+	ErrInvalidPosition = errors.New("invalid position")
+
+	ErrKingCount      = errors.New("each side needs exactly one king")
+	ErrKingsAdjacent  = errors.New("kings are adjacent")
+	ErrInCheck        = errors.New("the side not to move is in check")
+	ErrPawnRank       = errors.New("pawn on the first or last rank")
+	ErrPieceCount     = errors.New("more pieces than promotions allow")
+	ErrCastlingRights = errors.New("castling right without its king and rook")
+	ErrEnPassant      = errors.New("en passant square without a double push")
+)
+
+type Violation struct {
+	Err    error
+	Detail string
+}
+
+func (v Violation) Error() string {
+	if v.Detail == "" {
+		return v.Err.Error()
+	}
+	return fmt.Sprintf("%s -- %s", v.Err, v.Detail)
+}
+
+func (v Violation) Unwrap() error {
+	return v.Err
+}
+
+/*
+	Checks that the position could be reached in a game, returns every rule
+	it breaks or nil. A fen that cannot be read is one ErrInvalidFEN
+*/
+func ValidatePosition(fen string) []Violation {
+	return validatePosition(fen, false)
+}
+
+/*
+	ValidatePosition for Chess960, castling rights are Shredder-FEN or
+	X-FEN and may belong to a king and rooks on any back rank squares
+*/
+func ValidatePosition960(fen string) []Violation {
+	return validatePosition(fen, true)
+}
+
+func validatePosition(fen string, chess960 bool) []Violation {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 || len(fields) > 6 {
+		return []Violation{{Err: ErrInvalidFEN, Detail: "expected 4 to 6 fields"}}
+	}
+
+	board, err := parseBoard(fields[0])
+	if err != nil {
+		return []Violation{{Err: ErrInvalidFEN, Detail: err.Error()}}
+	}
+	if fields[1] != "w" && fields[1] != "b" {
+		return []Violation{{Err: ErrInvalidFEN, Detail: fmt.Sprintf("side to move %q", fields[1])}}
+	}
+	for _, counter := range fields[4:] {
+		if n, err := strconv.Atoi(counter); err != nil || n < 0 {
+			return []Violation{{Err: ErrInvalidFEN, Detail: fmt.Sprintf("move counter %q", counter)}}
+		}
+	}
+	white := fields[1] == "w"
+
+	violations := []Violation{}
+	add := func(err error, format string, args ...interface{}) {
+		violations = append(violations, Violation{Err: err, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// kings
+	kings := map[rune][]int8{}
+	for row := int8(0); row < 8; row++ {
+		for col := int8(0); col < 8; col++ {
+			piece := BitToPiece[board[row][col]]
+			if piece == 'K' || piece == 'k' {
+				kings[piece] = append(kings[piece], squareHash(row, col))
+			}
+		}
+	}
+	for _, k := range "Kk" {
+		if len(kings[k]) != 1 {
+			add(ErrKingCount, "%s has %d kings", colorName(k), len(kings[k]))
+		}
+	}
+	if len(kings['K']) == 1 && len(kings['k']) == 1 {
+		wk, bk := kings['K'][0], kings['k'][0]
+		if abs(wk/8-bk/8) <= 1 && abs(wk%8-bk%8) <= 1 {
+			add(ErrKingsAdjacent, "%s and %s", squareName(wk), squareName(bk))
+		}
+
+		// the king of the side that just moved
+		king, attacker := bk, true
+		if !white {
+			king, attacker = wk, false
+		}
+		if attacked(board, king, attacker) {
+			add(ErrInCheck, "%s king on %s", colorName(BitToPiece[board[king/8][king%8]]), squareName(king))
+		}
+	}
+
+	// pawns and promotions
+	for row := int8(0); row < 8; row += 7 {
+		for col := int8(0); col < 8; col++ {
+			piece := BitToPiece[board[row][col]]
+			if piece == 'P' || piece == 'p' {
+				add(ErrPawnRank, "%s pawn on %s", colorName(piece), squareName(squareHash(row, col)))
+			}
+		}
+	}
+	for _, side := range []string{"PNBRQ", "pnbrq"} {
+		counts := map[rune]int{}
+		bishops := [2]int{}
+		for row := int8(0); row < 8; row++ {
+			for col := int8(0); col < 8; col++ {
+				piece := BitToPiece[board[row][col]]
+				if !strings.ContainsRune(side, piece) {
+					continue
+				}
+				counts[unicode.ToUpper(piece)]++
+				if unicode.ToUpper(piece) == 'B' {
+					bishops[(row+col)%2]++
+				}
+			}
+		}
+
+		name := colorName(rune(side[0]))
+		if counts['P'] > 8 {
+			add(ErrPieceCount, "%s has %d pawns", name, counts['P'])
+			continue
+		}
+
+		promoted := extra(counts['Q'], 1) + extra(counts['R'], 2) + extra(counts['N'], 2) +
+			extra(bishops[0], 1) + extra(bishops[1], 1)
+		if promoted > 8-counts['P'] {
+			add(ErrPieceCount, "%s has %d promoted pieces and %d pawns", name, promoted, counts['P'])
+		}
+	}
+
+	// castling and en passant
+	if chess960 {
+		rights, err := shredderRights(board, fields[2])
+		if err != nil {
+			return append(violations, Violation{Err: ErrInvalidFEN, Detail: err.Error()})
+		}
+		allowed := ""
+		for _, right := range rights {
+			if !canCastle960(board, right) {
+				add(ErrCastlingRights, "%c", right)
+				continue
+			}
+			allowed += string(right)
+		}
+		if len(chess960Rights(board, allowed)) < len(allowed) {
+			add(ErrCastlingRights, "two rights on one side of the king in %s", fields[2])
+		}
+	} else if fields[2] != "-" {
+		for i, right := range fields[2] {
+			if !strings.ContainsRune("KQkq", right) || strings.IndexRune(fields[2], right) != i {
+				return append(violations, Violation{Err: ErrInvalidFEN, Detail: fmt.Sprintf("castling rights %q", fields[2])})
+			}
+		}
+		for _, right := range fields[2] {
+			if !canCastle(board, right) {
+				add(ErrCastlingRights, "%c", right)
+			}
+		}
+	}
+	if fields[3] != "-" {
+		sq, ok := parseSquare(fields[3])
+		if !ok {
+			return append(violations, Violation{Err: ErrInvalidFEN, Detail: fmt.Sprintf("en passant square %q", fields[3])})
+		}
+		if !canEnPassant(board, white, sq) {
+			add(ErrEnPassant, "%s", fields[3])
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+/*
+	Generated positions are repaired where a field is simply wrong, and
+	rejected when the pieces themselves are
+*/
+func checkFEN(fen string, chess960 bool) (string, error) {
+	fen = repairFEN(fen, chess960)
+	violations := validatePosition(fen, chess960)
+	if len(violations) == 0 {
+		return fen, nil
+	}
+
+	details := []string{}
+	for _, v := range violations {
+		details = append(details, v.Error())
+	}
+	return "", fmt.Errorf("%w -- %s -- %s", ErrInvalidPosition, fen, strings.Join(details, ", "))
+}
+
+/*
+	Removes pawns from the first and last rank, and castling rights and en
+	passant squares the position does not allow, Chess960 rights are
+	written as Shredder-FEN. Fens that cannot be read are returned as they
+	are
+*/
+func repairFEN(fen string, chess960 bool) string {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 {
+		return fen
+	}
+	board, err := parseBoard(fields[0])
+	if err != nil {
+		return fen
+	}
+
+	for row := 0; row < 8; row += 7 {
+		for col := 0; col < 8; col++ {
+			if p := BitToPiece[board[row][col]]; p == 'P' || p == 'p' {
+				board[row][col] = 0
+			}
+		}
+	}
+
+	var sb strings.Builder
+	writePlacement(&sb, board)
+	fields[0] = sb.String()
+
+	rights := ""
+	if chess960 {
+		if shredder, err := shredderRights(board, fields[2]); err == nil {
+			rights = chess960Rights(board, shredder)
+		}
+	}
+	for _, right := range fields[2] {
+		if !chess960 && strings.ContainsRune("KQkq", right) && !strings.ContainsRune(rights, right) && canCastle(board, right) {
+			rights += string(right)
+		}
+	}
+	if rights == "" {
+		rights = "-"
+	}
+	fields[2] = rights
+
+	if sq, ok := parseSquare(fields[3]); !ok || !canEnPassant(board, fields[1] == "w", sq) {
+		fields[3] = "-"
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func parseBoard(placement string) ([8][8]int8, error) {
+	board := [8][8]int8{}
+	rows := strings.Split(placement, "/")
+	if len(rows) != 8 {
+		return board, fmt.Errorf("%d ranks", len(rows))
+	}
+
+	for row, pieces := range rows {
+		col := 0
+		for _, p := range pieces {
+			if p >= '1' && p <= '8' {
+				col += int(p - '0')
+				continue
+			}
+
+			bit, ok := PieceToBit[p]
+			if !ok {
+				return board, fmt.Errorf("piece %q", p)
+			}
+			if col < 8 {
+				board[row][col] = bit
+			}
+			col++
+		}
+		if col != 8 {
+			return board, fmt.Errorf("rank %d has %d squares", 8-row, col)
+		}
+	}
+
+	return board, nil
+}
+
+// whether a piece of white, or black if white is false, attacks sq
+func attacked(board [8][8]int8, sq int8, white bool) bool {
+	for row := int8(0); row < 8; row++ {
+		for col := int8(0); col < 8; col++ {
+			piece, ok := BitToPiece[board[row][col]]
+			if !ok || unicode.IsUpper(piece) != white {
+				continue
+			}
+
+			for _, a := range attacks(piece, board, row, col) {
+				if a == sq {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// the king and the rook of the right are on their starting squares
+func canCastle(board [8][8]int8, right rune) bool {
+	switch right {
+	case 'K':
+		return board[7][4] == PieceToBit['K'] && board[7][7] == PieceToBit['R']
+	case 'Q':
+		return board[7][4] == PieceToBit['K'] && board[7][0] == PieceToBit['R']
+	case 'k':
+		return board[0][4] == PieceToBit['k'] && board[0][7] == PieceToBit['r']
+	case 'q':
+		return board[0][4] == PieceToBit['k'] && board[0][0] == PieceToBit['r']
+	}
+
+	return false
+}
+
+/*
+	The pawn that just moved two squares stands in front of sq, and sq and
+	the square it came from are empty
+*/
+func canEnPassant(board [8][8]int8, white bool, sq int8) bool {
+	row, col := sq/8, sq%8
+	if white {
+		return row == 2 && board[3][col] == PieceToBit['p'] && board[2][col] == 0 && board[1][col] == 0
+	}
+	return row == 5 && board[4][col] == PieceToBit['P'] && board[5][col] == 0 && board[6][col] == 0
+}
+
+// the square of a name like e3 in board coordinates, row 0 is the 8th rank
+func parseSquare(name string) (int8, bool) {
+	if len(name) != 2 || name[0] < 'a' || name[0] > 'h' || name[1] < '1' || name[1] > '8' {
+		return 0, false
+	}
+
+	return squareHash(int8('8'-name[1]), int8(name[0]-'a')), true
+}
+
+func squareName(sq int8) string {
+	return fmt.Sprintf("%c%d", 'a'+sq%8, 8-sq/8)
+}
+
+func colorName(piece rune) string {
+	if unicode.IsUpper(piece) {
+		return "white"
+	}
+	return "black"
+}
+
+func extra(count, start int) int {
+	if count > start {
+		return count - start
+	}
+	return 0
+}
+
+func abs(x int8) int8 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,89 @@
+package puzzlegen
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidatePosition(t *testing.T) {
+	tests := []struct {
+		fen  string
+		errs []error
+	}{
+		{fen: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"},
+		{fen: "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1"},
+		{fen: "8/8/8/8/8/8/8/8 w - - 0 1", errs: []error{ErrKingCount, ErrKingCount}},
+		{fen: "8/8/8/3kK3/8/8/8/8 w - - 0 1", errs: []error{ErrKingsAdjacent, ErrInCheck}},
+		{fen: "4k2R/8/8/8/8/8/8/4K3 w - - 0 1", errs: []error{ErrInCheck}},
+		{fen: "P3k3/8/8/8/8/8/8/4K3 w - - 0 1", errs: []error{ErrPawnRank}},
+		{fen: "4k3/8/8/8/8/P7/PPPPPPPP/4K3 w - - 0 1", errs: []error{ErrPieceCount}},
+		{fen: "4k3/8/8/8/QQQ5/8/PPPPPPP1/4K3 b - - 0 1", errs: []error{ErrPieceCount}},
+		// c1 is dark, d1 and f1 are light
+		{fen: "4k3/8/8/8/8/8/PPPPPPPP/2BBKB2 b - - 0 1", errs: []error{ErrPieceCount}},
+		{fen: "4k3/8/8/8/8/8/8/4K3 w K - 0 1", errs: []error{ErrCastlingRights}},
+		{fen: "4k3/8/8/8/8/8/8/4K3 w - e6 0 1", errs: []error{ErrEnPassant}},
+		// the pawn is there but black is to move
+		{fen: "4k3/8/8/3pP3/8/8/8/4K3 b - d6 0 1", errs: []error{ErrEnPassant}},
+		{fen: "4k3/8/8 w - - 0 1", errs: []error{ErrInvalidFEN}},
+		{fen: "4k3/8/8/8/8/8/8/4K3 w KK - 0 1", errs: []error{ErrInvalidFEN}},
+	}
+	for _, test := range tests {
+		violations := ValidatePosition(test.fen)
+		if len(violations) != len(test.errs) {
+			t.Fatalf("%s -- expected %v, got %v", test.fen, test.errs, violations)
+		}
+		for i, err := range test.errs {
+			if !errors.Is(violations[i], err) {
+				t.Fatalf("%s -- expected %v, got %v", test.fen, test.errs, violations)
+			}
+		}
+	}
+}
+
+func TestRepairFEN(t *testing.T) {
+	fen := repairFEN("P3k3/8/8/8/8/8/8/4K2R w KQ e6 0 1", false)
+	if fen != "4k3/8/8/8/8/8/8/4K2R w K - 0 1" {
+		t.Fatalf("unexpected repair -- %s", fen)
+	}
+}
+
+func TestGeneratedPositionsValid(t *testing.T) {
+	cfg := PuzzleConfig{
+		WhiteQ: 1,
+		WhiteR: 2,
+		WhiteB: 2,
+		WhiteP: 6,
+		BlackQ: 1,
+		BlackR: 1,
+		BlackN: 2,
+		BlackP: 7,
+	}
+
+	check := func(fen string, err error) {
+		if errors.Is(err, ErrInvalidPosition) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if violations := ValidatePosition(fen); violations != nil {
+			t.Fatalf("%s -- %v", fen, violations)
+		}
+	}
+
+	for seed := int64(1); seed <= 200; seed++ {
+		fen, _, err := GenerateRandomFEN(cfg, NewRand(seed))
+		check(fen, err)
+		if err != nil {
+			continue
+		}
+
+		for i := int64(0); i < 5; i++ {
+			next, err := MutateFEN(fen, 5, NewRand(seed*10+i))
+			check(next, err)
+			if err == nil {
+				fen = next
+			}
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+)
+
+const (
+	DefaultRetryMin = time.Second
+	DefaultRetryMax = 30 * time.Second
+
+	// bounds the status request of a reconnect
+	ConnectTimeout = 5 * time.Second
+)
+
+/*
+	A remote server, Addr is host:port or a URL. Capacity is the number of
+	searches sent to it at once, 0 uses the capacity the node reports
+*/
+type Node struct {
+	Addr     string `yaml:"addr"`
+	Token    string `yaml:"token"`
+	Capacity int    `yaml:"capacity"`
+}
+
+/*
+	A node that cannot be reached is retried after RetryMin, doubling up to
+	RetryMax while it stays down
+*/
+type PoolConfig struct {
+	Nodes    []Node        `yaml:"nodes"`
+	RetryMin time.Duration `yaml:"retry_min"`
+	RetryMax time.Duration `yaml:"retry_max"`
+}
+
+type node struct {
+	Node
+	url string
+
+	// guarded by the pool
+	capacity   int
+	labels     []string
+	inUse      int
+	up         bool
+	connecting bool
+	backoff    time.Duration
+	retryAt    time.Time
+	err        error
+}
+
+func (n *node) serves(label string) bool {
+	if label == "" || len(n.labels) == 0 {
+		return true
+	}
+
+	for _, l := range n.labels {
+		if l == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Pool sends searches to remote servers, at most the capacity of each node
+	at once. Nodes that drop are reconnected in the background of later
+	searches, and a search that failed in transit is retried on another node
+*/
+type Pool struct {
+	client   *http.Client
+	retryMin time.Duration
+	retryMax time.Duration
+
+	mu     sync.Mutex
+	nodes  []*node
+	closed bool
+	// closed and replaced whenever a slot frees up or a node changes state
+	wake chan struct{}
+
+	inFlight sync.WaitGroup
+}
+
+var _ analysis.Analyzer = (*Pool)(nil)
+var _ analysis.Closer = (*Pool)(nil)
+
+/*
+	Connects to every node, nodes that cannot be reached are logged and
+	retried once a search needs them
+*/
+func NewPool(cfg PoolConfig) (*Pool, error) {
+	if len(cfg.Nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+	if cfg.RetryMin <= 0 {
+		cfg.RetryMin = DefaultRetryMin
+	}
+	if cfg.RetryMax < cfg.RetryMin {
+		cfg.RetryMax = DefaultRetryMax
+	}
+
+	p := &Pool{
+		client:   &http.Client{},
+		retryMin: cfg.RetryMin,
+		retryMax: cfg.RetryMax,
+		wake:     make(chan struct{}),
+	}
+	for _, n := range cfg.Nodes {
+		url := n.Addr
+		if !strings.Contains(url, "://") {
+			url = "http://" + url
+		}
+		p.nodes = append(p.nodes, &node{
+			Node: n,
+			url:  strings.TrimSuffix(url, "/"),
+		})
+	}
+
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		n.connecting = true
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			p.connect(context.Background(), n)
+		}(n)
+	}
+	wg.Wait()
+
+	return p, nil
+}
+
+/*
+	Analyze implements analysis.Analyzer. It waits for a free slot on a node
+	serving req.Engine until ctx is done, the priority of ctx is sent along
+*/
+func (p *Pool) Analyze(ctx context.Context, req analysis.Request) (*analysis.Result, error) {
+	body, err := json.Marshal(analyzeRequest{
+		FEN:      req.PositionFEN(),
+		Depth:    req.Limits.Depth,
+		Nodes:    req.Limits.Nodes,
+		MoveTime: req.Limits.MoveTime.Milliseconds(),
+		Mate:     req.Limits.Mate,
+		MultiPV:  req.MultiPV,
+		Engine:   req.Engine,
+		Priority: analysis.PriorityFrom(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := p.acquire(ctx, req.Engine)
+		if err != nil {
+			return nil, err
+		}
+
+		res := &analysis.Result{}
+		err = p.do(ctx, n, http.MethodPost, AnalyzePath, body, res)
+		p.release(n)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		var serverErr *ServerError
+		if errors.As(err, &serverErr) {
+			return nil, err
+		}
+
+		// the node went away, the search is retried elsewhere
+		p.down(n, err)
+	}
+}
+
+/*
+	Close fails searches waiting for a node, then waits for searches in
+	flight until ctx is done
+*/
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.broadcast()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.client.CloseIdleConnections()
+	return err
+}
+
+/*
+	Takes a slot on the least loaded node that serves label, reconnecting
+	nodes that are due for a retry on the way
+*/
+func (p *Pool) acquire(ctx context.Context, label string) (*node, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+
+		var best, reconnect *node
+		var retry time.Time
+		var rejected error
+		possible, unauthorized := 0, 0
+		for _, n := range p.nodes {
+			if !n.serves(label) {
+				continue
+			}
+			possible++
+			if !n.up && errors.Is(n.err, ErrUnauthorized) {
+				rejected = n.err
+				unauthorized++
+			}
+
+			switch {
+			case n.up:
+				if n.inUse < n.capacity && (best == nil || n.inUse*best.capacity < best.inUse*n.capacity) {
+					best = n
+				}
+			case n.connecting:
+			case !time.Now().Before(n.retryAt):
+				reconnect = n
+			case retry.IsZero() || n.retryAt.Before(retry):
+				retry = n.retryAt
+			}
+		}
+
+		if best != nil {
+			best.inUse++
+			p.inFlight.Add(1)
+			p.mu.Unlock()
+			return best, nil
+		}
+		if possible == 0 {
+			p.mu.Unlock()
+			return nil, ErrNoSuchEngine
+		}
+		// retrying a wrong token will not help, unless another node works
+		if unauthorized == possible {
+			p.mu.Unlock()
+			return nil, rejected
+		}
+		if reconnect != nil {
+			reconnect.connecting = true
+			p.mu.Unlock()
+			p.connect(ctx, reconnect)
+			continue
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		// no node is free, wait for a release or the next retry
+		timer := time.NewTimer(time.Hour)
+		if !retry.IsZero() {
+			timer.Reset(time.Until(retry))
+		}
+
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (p *Pool) release(n *node) {
+	p.mu.Lock()
+	n.inUse--
+	p.broadcast()
+	p.mu.Unlock()
+	p.inFlight.Done()
+}
+
+// Asks the node for its capacity and labels, n.connecting must be set
+func (p *Pool) connect(ctx context.Context, n *node) {
+	statusCtx, cancel := context.WithTimeout(ctx, ConnectTimeout)
+	defer cancel()
+
+	var status statusResponse
+	err := p.do(statusCtx, n, http.MethodGet, StatusPath, nil, &status)
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, not the node
+		p.mu.Lock()
+		n.connecting = false
+		p.broadcast()
+		p.mu.Unlock()
+		return
+	}
+	if err != nil {
+		p.down(n, err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n.capacity = n.Capacity
+	if n.capacity == 0 {
+		n.capacity = status.Capacity
+	}
+	if n.capacity < 1 {
+		n.capacity = 1
+	}
+	n.labels = status.Labels
+	n.up = true
+	n.connecting = false
+	n.backoff = 0
+	n.err = nil
+	p.broadcast()
+}
+
+func (p *Pool) down(n *node, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n.backoff *= 2
+	if n.backoff == 0 {
+		n.backoff = p.retryMin
+	}
+	if n.backoff > p.retryMax {
+		n.backoff = p.retryMax
+	}
+	log.Printf("error -- node %s down, retrying in %s -- %s", n.Addr, n.backoff, err)
+
+	n.up = false
+	n.connecting = false
+	n.retryAt = time.Now().Add(n.backoff)
+	n.err = err
+	p.broadcast()
+}
+
+// must hold p.mu
+func (p *Pool) broadcast() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *Pool) do(ctx context.Context, n *node, method, path string, body []byte, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, n.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("node %s -- %w", n.Addr, ErrUnauthorized)
+	case resp.StatusCode != http.StatusOK:
+		var e errorResponse
+		b, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(b, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(b))
+		}
+		return &ServerError{
+			Node:    n.Addr,
+			Status:  resp.StatusCode,
+			Message: e.Error,
+		}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,181 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+func request(t *testing.T, fen string) analysis.Request {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return analysis.Request{
+		Position: chess.NewGame(f).Position(),
+		Limits:   analysis.SearchLimits{Depth: 20},
+		MultiPV:  2,
+	}
+}
+
+func TestPoolAnalyze(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{Tokens: []string{"secret"}, Capacity: 2, Labels: []string{"stockfish"}})
+
+	pool, err := NewPool(PoolConfig{Nodes: []Node{{Addr: strings.TrimPrefix(srv.URL, "http://"), Token: "secret"}}})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	res, err := pool.Analyze(context.Background(), request(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if res.Engine != "stockfish" || res.BestMove.String() != "a1a8" || len(res.Lines) != 2 {
+		t.Fatalf("unexpected result -- %+v", res)
+	}
+	if res.Best().Score.Mate != 1 || res.Lines[1].PV[0].String() != "e1e8" {
+		t.Fatalf("unexpected lines -- %+v", res.Lines)
+	}
+
+	req := request(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1")
+	req.Engine = "crystal"
+	_, err = pool.Analyze(context.Background(), req)
+	if !errors.Is(err, ErrNoSuchEngine) {
+		t.Fatalf("expected no such engine, got %v", err)
+	}
+}
+
+func TestPoolUnauthorized(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{Tokens: []string{"secret"}, Capacity: 1})
+
+	pool, err := NewPool(PoolConfig{Nodes: []Node{{Addr: srv.URL, Token: "wrong"}}, RetryMin: time.Millisecond})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err = pool.Analyze(ctx, request(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	// reserve an address, the node is down until a server listens on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	pool, err := NewPool(PoolConfig{
+		Nodes:    []Node{{Addr: addr}},
+		RetryMin: 10 * time.Millisecond,
+		RetryMax: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	srv := newTestServer(t, ServerConfig{Capacity: 1})
+	srv.Listener.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Errorf("err -- %s", err)
+			return
+		}
+		go http.Serve(l, srv.Config.Handler)
+		t.Cleanup(func() { l.Close() })
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := pool.Analyze(ctx, request(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if res.BestMove.String() != "a1a8" {
+		t.Fatalf("unexpected result -- %+v", res)
+	}
+}
+
+// records the most searches it ran at once
+type concurrencyAnalyzer struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (a *concurrencyAnalyzer) Analyze(ctx context.Context, req analysis.Request) (*analysis.Result, error) {
+	a.mu.Lock()
+	a.running++
+	if a.running > a.max {
+		a.max = a.running
+	}
+	a.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	a.mu.Lock()
+	a.running--
+	a.mu.Unlock()
+	return &analysis.Result{Lines: []analysis.Line{}}, nil
+}
+
+func TestPoolCapacity(t *testing.T) {
+	analyzers := []*concurrencyAnalyzer{{}, {}}
+	nodes := []Node{}
+	for i, a := range analyzers {
+		srv := httptest.NewServer(NewServer(a, ServerConfig{Capacity: 4}))
+		defer srv.Close()
+
+		// the first node reports its capacity, the second is capped by the client
+		node := Node{Addr: srv.URL}
+		if i == 1 {
+			node.Capacity = 1
+		}
+		nodes = append(nodes, node)
+	}
+
+	pool, err := NewPool(PoolConfig{Nodes: nodes})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.Analyze(context.Background(), request(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"))
+			if err != nil {
+				t.Errorf("err -- %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if analyzers[0].max > 4 || analyzers[1].max != 1 {
+		t.Fatalf("expected at most 4 and 1 at once, got %d and %d", analyzers[0].max, analyzers[1].max)
+	}
+}
@@ -0,0 +1,70 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+)
+
+/*
+	The protocol is JSON over HTTP. Every request carries the node token as
+	"Authorization: Bearer <token>"
+
+	GET  /status   returns the capacity and engine labels of the node
+	POST /analyze  searches a position and returns an analysis.Result
+*/
+const (
+	StatusPath  = "/status"
+	AnalyzePath = "/analyze"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNoNodes      = errors.New("no remote nodes configured")
+	ErrNoSuchEngine = errors.New("no remote node with that engine")
+	ErrPoolClosed   = errors.New("remote pool closed")
+	ErrNoToken      = errors.New("no token to serve beyond loopback with")
+)
+
+// ServerError is an error the node returned while analysing
+type ServerError struct {
+	Node    string
+	Status  int
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("node %s -- %d %s", e.Node, e.Status, e.Message)
+}
+
+type statusResponse struct {
+	Capacity int      `json:"capacity"`
+	Labels   []string `json:"labels"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// MoveTime is in milliseconds
+type analyzeRequest struct {
+	FEN      string            `json:"fen"`
+	Depth    int               `json:"depth,omitempty"`
+	Nodes    int               `json:"nodes,omitempty"`
+	MoveTime int64             `json:"movetime,omitempty"`
+	Mate     int               `json:"mate,omitempty"`
+	MultiPV  int               `json:"multipv,omitempty"`
+	Engine   string            `json:"engine,omitempty"`
+	Priority analysis.Priority `json:"priority,omitempty"`
+}
+
+func (r analyzeRequest) limits() analysis.SearchLimits {
+	return analysis.SearchLimits{
+		Depth:    r.Depth,
+		Nodes:    r.Nodes,
+		MoveTime: time.Duration(r.MoveTime) * time.Millisecond,
+		Mate:     r.Mate,
+	}
+}
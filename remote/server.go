@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+)
+
+/*
+	Tokens are the accepted bearer tokens, none accepts every request.
+	Capacity is the number of searches run at once and is reported to
+	clients, Labels are the engines the analyzer serves
+*/
+type ServerConfig struct {
+	Tokens   []string `yaml:"tokens"`
+	Capacity int      `yaml:"capacity"`
+	Labels   []string `yaml:"labels"`
+}
+
+/*
+	Server exposes an analyzer, usually a local StockPool, to remote pools.
+	It is an http.Handler, searches beyond Capacity wait for a free slot
+	until the client gives up
+*/
+type Server struct {
+	analyzer analysis.Analyzer
+	cfg      ServerConfig
+	slots    chan struct{}
+	mux      *http.ServeMux
+}
+
+func NewServer(analyzer analysis.Analyzer, cfg ServerConfig) *Server {
+	if cfg.Capacity < 1 {
+		cfg.Capacity = 1
+	}
+
+	s := &Server{
+		analyzer: analyzer,
+		cfg:      cfg,
+		slots:    make(chan struct{}, cfg.Capacity),
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc(StatusPath, s.status)
+	s.mux.HandleFunc(AnalyzePath, s.analyze)
+
+	return s
+}
+
+/*
+	CheckListen returns ErrNoToken when cfg has no tokens and addr is not a
+	loopback address, engines without a token are only served to this host
+*/
+func CheckListen(addr string, cfg ServerConfig) error {
+	if len(cfg.Tokens) > 0 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("%w -- %s", ErrNoToken, addr)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized.Error())
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusResponse{
+		Capacity: s.cfg.Capacity,
+		Labels:   s.cfg.Labels,
+	})
+}
+
+func (s *Server) analyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req analyzeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	position, err := analysis.ParseFEN(req.FEN)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the request context is cancelled when the client disconnects
+	ctx := analysis.WithPriority(r.Context(), req.Priority)
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	case <-ctx.Done():
+		return
+	}
+
+	res, err := s.analyzer.Analyze(ctx, analysis.Request{
+		Position: position,
+		FEN:      req.FEN,
+		Limits:   req.limits(),
+		MultiPV:  req.MultiPV,
+		Engine:   req.Engine,
+	})
+	if err != nil {
+		log.Printf("error -- %s -- position: %s", err, req.FEN)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.cfg.Tokens) == 0 {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, t := range s.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("error -- writing response -- %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
@@ -0,0 +1,106 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
+)
+
+func TestMain(m *testing.M) {
+	fakeengine.Main()
+	os.Exit(m.Run())
+}
+
+func newTestServer(t *testing.T, cfg ServerConfig) *httptest.Server {
+	pool, err := stockpool.NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), cfg.Capacity, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	srv := httptest.NewServer(NewServer(pool, cfg))
+	t.Cleanup(func() {
+		srv.Close()
+		pool.Close(context.Background())
+	})
+	return srv
+}
+
+func TestServerAuth(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{Tokens: []string{"secret"}, Capacity: 1})
+
+	tests := []struct {
+		token    string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+StatusPath, nil)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expected {
+			t.Fatalf("token %q -- expected %d, got %d", test.token, test.expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestCheckListen(t *testing.T) {
+	tests := []struct {
+		addr   string
+		tokens []string
+		ok     bool
+	}{
+		{"127.0.0.1:7373", nil, true},
+		{"[::1]:7373", nil, true},
+		{"localhost:7373", nil, true},
+		{":7373", nil, false},
+		{"0.0.0.0:7373", nil, false},
+		{"192.168.1.2:7373", nil, false},
+		{":7373", []string{"secret"}, true},
+	}
+
+	for _, test := range tests {
+		err := CheckListen(test.addr, ServerConfig{Tokens: test.tokens})
+		if test.ok && err != nil {
+			t.Fatalf("%s -- err -- %s", test.addr, err)
+		}
+		if !test.ok && !errors.Is(err, ErrNoToken) {
+			t.Fatalf("%s -- expected ErrNoToken, got %v", test.addr, err)
+		}
+	}
+}
+
+func TestServerBadRequest(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{Capacity: 1})
+
+	resp, err := http.Post(srv.URL+AnalyzePath, "application/json", strings.NewReader(`{"fen": "not a fen", "depth": 10}`))
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,152 @@
+package stockpool
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/go-chess/uci"
+)
+
+// how long a cancelled search has to answer stop before its engine is restarted
+const StopTimeout = time.Second
+
+var (
+	ErrNoBestMove       = errors.New("engine returned no best move")
+	ErrNoSearchLimits   = errors.New("search without limits")
+	ErrNondeterministic = errors.New("movetime limits are not reproducible, use nodes")
+)
+
+var _ analysis.Analyzer = (*StockPool)(nil)
+var _ analysis.Closer = (*StockPool)(nil)
+
+/*
+	Analyze implements analysis.Analyzer. It searches the position on an
+	instance with the requested label, an engine that fails mid search is
+	restarted before it goes back to the pool. Cancelling ctx stops the
+	search and returns ctx.Err()
+
+	Deterministic instances are reset before every search, consecutive
+	searches of one puzzle can land on different instances so each of them
+	is treated as a new root
+*/
+func (sp *StockPool) Analyze(ctx context.Context, req analysis.Request) (*analysis.Result, error) {
+	// a bare go searches until stopped
+	if req.Limits.IsZero() {
+		return nil, ErrNoSearchLimits
+	}
+
+	instance, err := sp.AcquireLabel(ctx, req.Engine)
+	if err != nil {
+		return nil, err
+	}
+	defer sp.Release(instance)
+
+	if instance.spec.Options.Deterministic {
+		if req.Limits.MoveTime > 0 {
+			return nil, ErrNondeterministic
+		}
+
+		err = reset(instance.Engine, instance.tap)
+		if err != nil {
+			sp.Restart(instance)
+			return nil, err
+		}
+	}
+
+	multiPV := req.MultiPV
+	if multiPV < 1 {
+		multiPV = 1
+	}
+
+	cmdOpt := uci.CmdSetOption{
+		Name:  "MultiPV",
+		Value: strconv.Itoa(multiPV),
+	}
+	cmdPos := cmdPosition{fen: req.PositionFEN()}
+	cmdGo := goCommand(req.Limits)
+
+	eng := instance.Engine
+	done := make(chan error, 1)
+	go func() {
+		done <- eng.Run(cmdOpt, cmdPos, cmdGo)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		sp.stop(instance, done)
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		sp.Restart(instance)
+		return nil, err
+	}
+
+	res := instance.Engine.SearchResults()
+	if res.BestMove == nil {
+		return nil, ErrNoBestMove
+	}
+
+	return analysis.FromSearchResults(res, instance.Label()), nil
+}
+
+/*
+	Stops the search of a cancelled Analyze, done is the result of its Run.
+	An engine that does not answer stop within StopTimeout is killed, and
+	either way one that failed is restarted
+*/
+func (sp *StockPool) stop(si *StockInstance, done <-chan error) {
+	si.Engine.Stop()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			return
+		}
+	case <-time.After(StopTimeout):
+		si.Engine.Kill()
+		<-done
+	}
+
+	sp.Restart(si)
+}
+
+/*
+	uci.CmdPosition writes the FEN of a go-chess position, which cannot
+	hold the castling rights of Chess960, so the FEN is written as it is
+*/
+type cmdPosition struct {
+	fen string
+}
+
+func (cmd cmdPosition) String() string {
+	return "position fen " + cmd.fen
+}
+
+// uci.CmdGo writes the node count after mate, so mate is written here
+type cmdGo struct {
+	uci.CmdGo
+	mate int
+}
+
+func goCommand(limits analysis.SearchLimits) cmdGo {
+	return cmdGo{
+		CmdGo: uci.CmdGo{
+			Depth:    limits.Depth,
+			Nodes:    limits.Nodes,
+			MoveTime: limits.MoveTime,
+		},
+		mate: limits.Mate,
+	}
+}
+
+func (cmd cmdGo) String() string {
+	if cmd.mate <= 0 {
+		return cmd.CmdGo.String()
+	}
+
+	return cmd.CmdGo.String() + " mate " + strconv.Itoa(cmd.mate)
+}
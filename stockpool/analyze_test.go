@@ -0,0 +1,177 @@
+package stockpool
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+func TestAnalyze(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	f, err := chess.FEN("6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	res, err := pool.Analyze(context.Background(), analysis.Request{
+		Position: chess.NewGame(f).Position(),
+		Limits:   analysis.SearchLimits{Depth: 20},
+		MultiPV:  2,
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	if res.Engine != DefaultLabel || res.BestMove.String() != "a1a8" || len(res.Lines) != 2 {
+		t.Fatalf("unexpected result -- %+v", res)
+	}
+	if res.Best().Score.Mate != 1 || res.Lines[1].PV[0].String() != "e1e8" {
+		t.Fatalf("unexpected lines -- %+v", res.Lines)
+	}
+}
+
+func TestAnalyzeDeterministic(t *testing.T) {
+	opts := DefaultEngineOptions(4)
+	opts.Deterministic = true
+	pool, err := NewStockPoolWithOptions(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, opts)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	transcript, err := OpenTranscript(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer transcript.Close()
+	pool.Record(transcript)
+
+	req := analysis.Request{
+		Position: testPosition(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"),
+		Limits:   analysis.SearchLimits{Nodes: 50000},
+	}
+	for i := 0; i < 2; i++ {
+		_, err = pool.Analyze(context.Background(), req)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+	}
+
+	req.Limits.MoveTime = time.Second
+	_, err = pool.Analyze(context.Background(), req)
+	if !errors.Is(err, ErrNondeterministic) {
+		t.Fatalf("expected nondeterministic, got %v", err)
+	}
+
+	entries, err := LoadTranscript(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	sent := []string{}
+	for _, e := range entries {
+		if e.Sent != "" {
+			sent = append(sent, e.Sent)
+		}
+	}
+
+	search := []string{
+		"ucinewgame",
+		"setoption name Clear Hash",
+		"isready",
+		"setoption name MultiPV value 1",
+		"position fen 6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1",
+		"go nodes 50000",
+	}
+	expected := append(append([]string{}, search...), search...)
+	if len(sent) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, sent)
+		}
+	}
+}
+
+func TestAnalyzeCancel(t *testing.T) {
+	tests := []struct {
+		script   string
+		restarts int64
+	}{
+		// the search ends with bestmove on stop and the engine is kept
+		{"testdata/stop.json", 0},
+		// the search ignores stop, so the engine is restarted
+		{"testdata/hang.json", 1},
+	}
+
+	for _, test := range tests {
+		pool, err := NewStockPool(fakeengine.Path(test.script), 1, 1)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		_, err = pool.Analyze(ctx, analysis.Request{
+			FEN:    "k7/8/2K5/8/8/8/8/7R w - - 0 1",
+			Limits: analysis.SearchLimits{Depth: 20},
+		})
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s -- expected the deadline, got %v", test.script, err)
+		}
+		if waited := time.Since(start); waited > 2*StopTimeout {
+			t.Fatalf("%s -- expected the search to stop, waited %s", test.script, waited)
+		}
+		if stats := pool.Stats(); stats.Restarts != test.restarts {
+			t.Fatalf("%s -- expected %d restarts, got %d", test.script, test.restarts, stats.Restarts)
+		}
+
+		// the instance is back and answers
+		instance, err := pool.AcquireContext(context.Background())
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+		if err := ping(instance.Engine, time.Second); err != nil {
+			t.Fatalf("%s -- %s", test.script, err)
+		}
+		pool.Release(instance)
+
+		err = pool.Close(context.Background())
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+	}
+}
+
+func TestGoCommand(t *testing.T) {
+	tests := []struct {
+		limits   analysis.SearchLimits
+		expected string
+	}{
+		{analysis.SearchLimits{Depth: 12}, "go depth 12"},
+		{analysis.SearchLimits{Nodes: 50000}, "go nodes 50000"},
+		{analysis.SearchLimits{MoveTime: 1500 * time.Millisecond}, "go movetime 1500"},
+		{analysis.SearchLimits{Depth: 30, Mate: 3}, "go depth 30 mate 3"},
+	}
+
+	for _, test := range tests {
+		cmd := goCommand(test.limits).String()
+		if cmd != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, cmd)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package stockpool
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"time"
+)
+
+const (
+	DefaultAutoscaleInterval = time.Second
+	DefaultIdleAfter         = time.Minute
+)
+
+/*
+	Label is the engine to scale, empty is the first spec. The pool grows
+	while callers are waiting for that engine, up to Max instances, and
+	retires one instance for every IdleAfter that some stay idle, down to
+	Min. Max defaults to the number of CPUs divided by the threads of each
+	engine
+*/
+type AutoscaleConfig struct {
+	Label     string        `yaml:"label"`
+	Min       int           `yaml:"min"`
+	Max       int           `yaml:"max"`
+	Interval  time.Duration `yaml:"interval"`
+	IdleAfter time.Duration `yaml:"idle_after"`
+}
+
+/*
+	Autoscale resizes the pool every Interval until ctx is done or the pool
+	is closed
+*/
+func (sp *StockPool) Autoscale(ctx context.Context, cfg AutoscaleConfig) error {
+	spec := sp.spec(cfg.Label)
+	if spec == nil {
+		return ErrNoSuchEngine
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultAutoscaleInterval
+	}
+	if cfg.IdleAfter <= 0 {
+		cfg.IdleAfter = DefaultIdleAfter
+	}
+	if cfg.Max <= 0 {
+		threads := spec.Options.Threads
+		if threads < 1 || spec.Options.Deterministic {
+			threads = 1
+		}
+		cfg.Max = runtime.NumCPU() / threads
+	}
+	if cfg.Max < cfg.Min {
+		cfg.Max = cfg.Min
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		var idleSince time.Time
+		for {
+			select {
+			case <-ticker.C:
+			case <-sp.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+
+			waiting, idle, size := sp.load(spec)
+
+			var err error
+			switch {
+			case size < cfg.Min:
+				idleSince = time.Time{}
+				err = sp.GrowLabel(spec.Label, cfg.Min-size)
+			case waiting > 0 && size < cfg.Max:
+				idleSince = time.Time{}
+				grow := waiting
+				if grow > cfg.Max-size {
+					grow = cfg.Max - size
+				}
+				err = sp.GrowLabel(spec.Label, grow)
+			case waiting == 0 && idle > 0 && size > cfg.Min:
+				if idleSince.IsZero() {
+					idleSince = time.Now()
+				}
+				if time.Since(idleSince) < cfg.IdleAfter {
+					continue
+				}
+				idleSince = time.Now()
+				err = sp.ShrinkLabel(spec.Label, 1)
+			default:
+				idleSince = time.Time{}
+			}
+
+			if err != nil {
+				log.Printf("error -- autoscaling %s -- %s", spec.Label, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+/*
+	Returns the callers waiting for an instance of spec, and the idle and
+	total instances of it
+*/
+func (sp *StockPool) load(spec *EngineSpec) (waiting, idle, size int) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	// matchers only look at the spec of an instance
+	probe := &StockInstance{spec: spec}
+	for _, w := range sp.waiters {
+		if w.match(probe) {
+			waiting++
+		}
+	}
+	for _, si := range sp.idle {
+		if si.spec == spec {
+			idle++
+		}
+	}
+
+	return waiting, idle, sp.size(spec)
+}
@@ -0,0 +1,250 @@
+package stockpool
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garlicgarrison/go-chess/uci"
+)
+
+const DefaultHealthTimeout = 5 * time.Second
+
+var ErrEngineUnresponsive = errors.New("engine did not answer in time")
+
+/*
+	An engine process spoken to over UCI. The pool starts the process with
+	its own pipes rather than through uci.New, uci.Engine keeps them
+	unexported and its Close blocks behind a hung command, so a wedged
+	engine could not be torn down. Commands are the ones of the uci
+	package, sent by their String
+*/
+type Engine struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	out    *os.File
+	lines  *bufio.Scanner
+	logger *log.Logger
+
+	mu      sync.Mutex
+	results uci.SearchResults
+}
+
+// every command and every line of output is written to logger
+func startEngine(path string, logger *log.Logger) (*Engine, error) {
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	out, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Stdout = w
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		out.Close()
+		w.Close()
+		return nil, err
+	}
+
+	err = cmd.Start()
+	// the process has its own copy, output ends once it exits
+	w.Close()
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	go cmd.Wait()
+
+	return &Engine{
+		cmd:    cmd,
+		in:     in,
+		out:    out,
+		lines:  bufio.NewScanner(out),
+		logger: logger,
+	}, nil
+}
+
+/*
+	Sends cmds in order, reading the answer of the ones that have one: uci
+	until uciok, isready until readyok and go until bestmove
+*/
+func (e *Engine) Run(cmds ...fmt.Stringer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, cmd := range cmds {
+		line := cmd.String()
+		e.logger.Println(line)
+		_, err := io.WriteString(e.in, line+"\n")
+		if err != nil {
+			return err
+		}
+
+		name, _, _ := strings.Cut(line, " ")
+		switch name {
+		case "uci":
+			err = e.readUntil("uciok")
+		case "isready":
+			err = e.readUntil("readyok")
+		case "go":
+			err = e.readResults()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Engine) readUntil(last string) error {
+	for e.lines.Scan() {
+		line := e.lines.Text()
+		e.logger.Println(line)
+		if line == last {
+			return nil
+		}
+	}
+
+	return e.ended()
+}
+
+func (e *Engine) readResults() error {
+	res, err := uci.ProcessEngineOutput(e.lines, e.logger)
+	if err != nil {
+		return err
+	}
+	if res.BestMove == nil {
+		return e.ended()
+	}
+
+	e.results = *res
+	return nil
+}
+
+// the error of output that ended before the answer did
+func (e *Engine) ended() error {
+	if err := e.lines.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+/*
+	Sends stop without waiting for Run, a search in progress then ends with
+	its bestmove
+*/
+func (e *Engine) Stop() error {
+	line := uci.CmdStop.String()
+	e.logger.Println(line)
+	_, err := io.WriteString(e.in, line+"\n")
+	return err
+}
+
+// the results of the last go
+func (e *Engine) SearchResults() uci.SearchResults {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.results
+}
+
+/*
+	Kills the process and closes its pipes, which also unblocks a command
+	still waiting for an answer. It does not wait for Run
+*/
+func (e *Engine) Kill() {
+	if e.cmd.Process != nil {
+		e.cmd.Process.Kill()
+	}
+	e.in.Close()
+	e.out.Close()
+}
+
+/*
+	Starts a new engine process, applies the options it supports and waits
+	for it to answer isready. Also returns the options it did not support.
+	Everything the engine sends and receives goes through tp
+*/
+func spawn(path string, opts EngineOptions, tp *tap) (*Engine, []string, error) {
+	eng, err := startEngine(path, log.New(tp, "", 0))
+	if err != nil {
+		return nil, nil, ErrPathNotFound
+	}
+
+	if err := run(eng, uci.CmdUCI, DefaultHealthTimeout); err != nil {
+		eng.Kill()
+		return nil, nil, err
+	}
+
+	unsupported := applyOptions(eng, opts, tp)
+	if err := ping(eng, DefaultHealthTimeout); err != nil {
+		eng.Kill()
+		return nil, nil, err
+	}
+
+	return eng, unsupported, nil
+}
+
+/*
+	Sends isready and waits up to timeout for readyok
+	NOTE: a hung process keeps its output open, so the timeout is the only
+	way to tell it apart from a slow one
+*/
+func ping(eng *Engine, timeout time.Duration) error {
+	return run(eng, uci.CmdIsReady, timeout)
+}
+
+func run(eng *Engine, cmd fmt.Stringer, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- eng.Run(cmd)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return ErrEngineUnresponsive
+	}
+}
+
+/*
+	Forgets everything from earlier searches, the next search runs as it
+	would on a fresh engine
+*/
+func reset(eng *Engine, tp *tap) error {
+	cmds := []fmt.Stringer{uci.CmdUCINewGame}
+	if tp.advertised("Clear Hash") {
+		cmds = append(cmds, cmdButton{name: "Clear Hash"})
+	}
+	cmds = append(cmds, uci.CmdIsReady)
+
+	return eng.Run(cmds...)
+}
+
+// setoption for button options, which take no value
+type cmdButton struct {
+	name string
+}
+
+func (cmd cmdButton) String() string {
+	return "setoption name " + cmd.name
+}
+
+// asks the engine to quit and then kills it
+func quit(eng *Engine) {
+	run(eng, uci.CmdQuit, DefaultHealthTimeout)
+	eng.Kill()
+}
@@ -0,0 +1,136 @@
+package stockpool
+
+import (
+	"context"
+	"log"
+	"time"
+
+	guuid "github.com/google/uuid"
+)
+
+/*
+	CheckOnAcquire pings every instance before it is handed out, Interval > 0
+	also pings idle instances on a schedule. Timeout is how long an engine has
+	to answer isready before it is considered dead.
+*/
+type HealthConfig struct {
+	CheckOnAcquire bool
+	Interval       time.Duration
+	Timeout        time.Duration
+}
+
+/*
+	Supervise turns on health checks for the pool. Dead or unresponsive
+	engines are killed and respawned with the same options until ctx is done.
+*/
+func (sp *StockPool) Supervise(ctx context.Context, cfg HealthConfig) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHealthTimeout
+	}
+
+	sp.mu.Lock()
+	sp.health = cfg
+	sp.mu.Unlock()
+
+	if cfg.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sp.done:
+				return
+			case <-ctx.Done():
+				sp.mu.Lock()
+				sp.health = HealthConfig{}
+				sp.mu.Unlock()
+				return
+			case <-ticker.C:
+				sp.checkIdle(cfg.Timeout)
+			}
+		}
+	}()
+}
+
+/*
+	Restart kills the engine of a borrowed instance and starts a fresh one in
+	its place. The instance gets a new id, so it should be released afterwards
+	as usual.
+*/
+func (sp *StockPool) Restart(si *StockInstance) error {
+	sp.mu.Lock()
+	_, ok := sp.idSet[si.id]
+	closed := sp.closed
+	sp.mu.Unlock()
+	if !ok {
+		return ErrWrongStockInstance
+	}
+	if closed {
+		return ErrPoolClosed
+	}
+
+	si.Engine.Kill()
+	eng, _, err := spawn(si.spec.Path, si.spec.Options, si.tap)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	delete(sp.idSet, si.id)
+	if err != nil {
+		sp.stats.Failures++
+		log.Printf("error -- restarting instance %s -- %s", si.id, err)
+		return err
+	}
+
+	si.id = guuid.New()
+	si.Engine = eng
+	si.tap.setInstance(si.id.String())
+	sp.idSet[si.id] = si
+	sp.stats.Restarts++
+	return nil
+}
+
+/*
+	Takes each idle instance out of the pool once and checks it, borrowed
+	instances are checked the next time they are idle
+*/
+func (sp *StockPool) checkIdle(timeout time.Duration) {
+	sp.mu.Lock()
+	n := len(sp.idle)
+	sp.mu.Unlock()
+
+	for ; n > 0; n-- {
+		sp.mu.Lock()
+		if len(sp.idle) == 0 {
+			sp.mu.Unlock()
+			return
+		}
+		instance := sp.idle[0]
+		sp.idle = sp.idle[1:]
+		sp.mu.Unlock()
+
+		if !sp.healthy(instance, timeout) {
+			continue
+		}
+
+		sp.put(instance)
+	}
+}
+
+/*
+	Pings the instance and restarts it if needed. Returns false if the
+	instance could not be brought back and was dropped from the pool.
+*/
+func (sp *StockPool) healthy(si *StockInstance, timeout time.Duration) bool {
+	err := ping(si.Engine, timeout)
+	if err == nil {
+		return true
+	}
+
+	log.Printf("error -- instance %s failed health check -- %s", si.id, err)
+	return sp.Restart(si) == nil
+}
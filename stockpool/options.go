@@ -0,0 +1,113 @@
+package stockpool
+
+import (
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garlicgarrison/go-chess/uci"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+	Options applied to every engine when it is spawned or restarted.
+	Zero values are left at the engine default, anything not covered by
+	the named fields can go in Options by its UCI name
+
+	Deterministic makes every search reproducible. Threads is forced to 1
+	and the engine starts each search with an empty hash, so movetime limits
+	are refused since they depend on the speed of the machine
+*/
+type EngineOptions struct {
+	Hash          int               `yaml:"hash"`
+	Threads       int               `yaml:"threads"`
+	SkillLevel    *int              `yaml:"skill_level"`
+	Contempt      *int              `yaml:"contempt"`
+	SyzygyPath    string            `yaml:"syzygy_path"`
+	Chess960      bool              `yaml:"chess960"`
+	Deterministic bool              `yaml:"deterministic"`
+	Options       map[string]string `yaml:"options"`
+}
+
+func DefaultEngineOptions(threads int) EngineOptions {
+	return EngineOptions{
+		Hash:    2048,
+		Threads: threads,
+	}
+}
+
+func LoadEngineOptions(path string) (EngineOptions, error) {
+	var opts EngineOptions
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return opts, err
+	}
+
+	err = yaml.Unmarshal(b, &opts)
+	return opts, err
+}
+
+/*
+	Returns the setoption commands in a fixed order, Threads and Hash first
+	since the engine reallocates on them
+*/
+func (o EngineOptions) commands() []uci.CmdSetOption {
+	cmds := []uci.CmdSetOption{}
+	threads := o.Threads
+	if o.Deterministic {
+		threads = 1
+	}
+	if threads > 0 {
+		cmds = append(cmds, uci.CmdSetOption{Name: "Threads", Value: strconv.Itoa(threads)})
+	}
+	if o.Hash > 0 {
+		cmds = append(cmds, uci.CmdSetOption{Name: "Hash", Value: strconv.Itoa(o.Hash)})
+	}
+	if o.SkillLevel != nil {
+		cmds = append(cmds, uci.CmdSetOption{Name: "Skill Level", Value: strconv.Itoa(*o.SkillLevel)})
+	}
+	if o.Contempt != nil {
+		cmds = append(cmds, uci.CmdSetOption{Name: "Contempt", Value: strconv.Itoa(*o.Contempt)})
+	}
+	if o.SyzygyPath != "" {
+		cmds = append(cmds, uci.CmdSetOption{Name: "SyzygyPath", Value: o.SyzygyPath})
+	}
+	if o.Chess960 {
+		cmds = append(cmds, uci.CmdSetOption{Name: "UCI_Chess960", Value: "true"})
+	}
+
+	names := make([]string, 0, len(o.Options))
+	for name := range o.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmds = append(cmds, uci.CmdSetOption{Name: name, Value: o.Options[name]})
+	}
+
+	return cmds
+}
+
+/*
+	Sends every option the engine advertised and returns the names of the
+	ones it did not, those are never sent
+*/
+func applyOptions(eng *Engine, opts EngineOptions, tp *tap) []string {
+	unsupported := []string{}
+	for _, cmd := range opts.commands() {
+		if !tp.advertised(cmd.Name) {
+			unsupported = append(unsupported, cmd.Name)
+			continue
+		}
+
+		eng.Run(cmd)
+	}
+
+	if len(unsupported) > 0 {
+		log.Printf("engine does not support options -- %s", strings.Join(unsupported, ", "))
+	}
+
+	return unsupported
+}
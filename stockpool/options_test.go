@@ -0,0 +1,76 @@
+package stockpool
+
+import (
+	"context"
+	"testing"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestEngineOptionsCommands(t *testing.T) {
+	config := `
+hash: 256
+threads: 2
+skill_level: 0
+syzygy_path: /tb
+options:
+  UCI_ShowWDL: "true"
+  Move Overhead: "50"
+`
+	var opts EngineOptions
+	err := yaml.Unmarshal([]byte(config), &opts)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	expected := []string{
+		"setoption name Threads value 2",
+		"setoption name Hash value 256",
+		"setoption name Skill Level value 0",
+		"setoption name SyzygyPath value /tb",
+		"setoption name Move Overhead value 50",
+		"setoption name UCI_ShowWDL value true",
+	}
+
+	cmds := opts.commands()
+	if len(cmds) != len(expected) {
+		t.Fatalf("expected %d commands, got %d", len(expected), len(cmds))
+	}
+	for i, cmd := range cmds {
+		if cmd.String() != expected[i] {
+			t.Fatalf("expected %q, got %q", expected[i], cmd.String())
+		}
+	}
+}
+
+func TestDeterministicThreads(t *testing.T) {
+	opts := EngineOptions{Threads: 8, Hash: 64, Deterministic: true}
+
+	cmds := opts.commands()
+	if len(cmds) != 2 || cmds[0].String() != "setoption name Threads value 1" {
+		t.Fatalf("expected a single thread, got %v", cmds)
+	}
+}
+
+func TestApplyOptions(t *testing.T) {
+	skill := 10
+	opts := EngineOptions{
+		Threads:    1,
+		SkillLevel: &skill,
+		Options:    map[string]string{"Move Overhead": "50"},
+	}
+
+	pool, err := NewStockPoolWithOptions(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, opts)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	// options with spaces in their names are advertised too
+	unsupported := pool.Unsupported()[DefaultLabel]
+	if len(unsupported) != 1 || unsupported[0] != "Move Overhead" {
+		t.Fatalf("expected only Move Overhead unsupported, got %v", unsupported)
+	}
+}
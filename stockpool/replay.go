@@ -0,0 +1,122 @@
+package stockpool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/go-chess/uci"
+)
+
+var ErrNotRecorded = errors.New("search not in transcript")
+
+var _ analysis.Analyzer = (*Replay)(nil)
+
+type replayed struct {
+	engine string
+	res    uci.SearchResults
+}
+
+/*
+	Replay answers searches from a transcript instead of an engine, so a run
+	can be reproduced without stockfish. A search is matched on the position,
+	the go command, MultiPV and the engine label. A search recorded more than
+	once is answered in recorded order, the last answer repeats after that
+*/
+type Replay struct {
+	mu       sync.Mutex
+	searches map[string][]replayed
+}
+
+func LoadReplay(path string) (*Replay, error) {
+	entries, err := LoadTranscript(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReplay(entries)
+}
+
+func NewReplay(entries []TranscriptEntry) (*Replay, error) {
+	r := &Replay{searches: make(map[string][]replayed)}
+
+	// the state of each instance, searches from several instances interleave
+	type state struct {
+		multiPV  int
+		position string
+		goCmd    string
+		output   []string
+	}
+	states := map[string]*state{}
+
+	for _, e := range entries {
+		s, ok := states[e.Instance]
+		if !ok {
+			s = &state{multiPV: 1}
+			states[e.Instance] = s
+		}
+
+		fields := strings.Fields(e.Sent)
+		switch {
+		case len(fields) == 5 && fields[0] == "setoption" && fields[2] == "MultiPV":
+			s.multiPV, _ = strconv.Atoi(fields[4])
+		case len(fields) > 0 && fields[0] == "position":
+			s.position = e.Sent
+		case len(fields) > 0 && fields[0] == "go":
+			s.goCmd = e.Sent
+			s.output = nil
+		case e.Sent == "" && s.goCmd != "":
+			s.output = append(s.output, e.Received)
+			if !strings.HasPrefix(e.Received, "bestmove") {
+				continue
+			}
+
+			scanner := bufio.NewScanner(strings.NewReader(strings.Join(s.output, "\n")))
+			res, err := uci.ProcessEngineOutput(scanner, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			search := replayed{engine: e.Engine, res: *res}
+			for _, label := range []string{e.Engine, ""} {
+				key := replayKey(s.position, s.goCmd, s.multiPV, label)
+				r.searches[key] = append(r.searches[key], search)
+			}
+			s.goCmd = ""
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Replay) Analyze(ctx context.Context, req analysis.Request) (*analysis.Result, error) {
+	multiPV := req.MultiPV
+	if multiPV < 1 {
+		multiPV = 1
+	}
+
+	position := cmdPosition{fen: req.PositionFEN()}.String()
+	key := replayKey(position, goCommand(req.Limits).String(), multiPV, req.Engine)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	searches := r.searches[key]
+	if len(searches) == 0 {
+		return nil, fmt.Errorf("%w -- %s %s", ErrNotRecorded, position, goCommand(req.Limits))
+	}
+	if len(searches) > 1 {
+		r.searches[key] = searches[1:]
+	}
+
+	return analysis.FromSearchResults(searches[0].res, searches[0].engine), nil
+}
+
+func replayKey(position, goCmd string, multiPV int, label string) string {
+	return fmt.Sprintf("%s|%s|%d|%s", position, goCmd, multiPV, label)
+}
@@ -0,0 +1,46 @@
+package stockpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+)
+
+func TestReplay(t *testing.T) {
+	path, recorded := recordSearch(t)
+
+	replay, err := LoadReplay(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	req := analysis.Request{
+		Position: testPosition(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"),
+		Limits:   analysis.SearchLimits{Depth: 20},
+		MultiPV:  2,
+	}
+	for _, label := range []string{"", DefaultLabel} {
+		req.Engine = label
+		res, err := replay.Analyze(context.Background(), req)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+
+		if res.Engine != recorded.Engine || res.BestMove.String() != recorded.BestMove.String() || len(res.Lines) != len(recorded.Lines) {
+			t.Fatalf("expected %+v, got %+v", recorded, res)
+		}
+		for i := range res.Lines {
+			if res.Lines[i].Score != recorded.Lines[i].Score || res.Lines[i].PV[0].String() != recorded.Lines[i].PV[0].String() {
+				t.Fatalf("expected %+v, got %+v", recorded.Lines, res.Lines)
+			}
+		}
+	}
+
+	req.Limits.Depth = 10
+	_, err = replay.Analyze(context.Background(), req)
+	if !errors.Is(err, ErrNotRecorded) {
+		t.Fatalf("expected not recorded, got %v", err)
+	}
+}
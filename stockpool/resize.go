@@ -0,0 +1,135 @@
+package stockpool
+
+import (
+	"sync"
+)
+
+// Grow adds n instances of the first engine spec
+func (sp *StockPool) Grow(n int) error {
+	return sp.GrowLabel("", n)
+}
+
+// Shrink retires n instances of the first engine spec
+func (sp *StockPool) Shrink(n int) error {
+	return sp.ShrinkLabel("", n)
+}
+
+/*
+	GrowLabel adds n instances of the engine with the label, an empty label
+	is the first spec. Instances still waiting to be retired by Shrink are
+	kept instead of spawning new ones. The new instances go to waiters first
+*/
+func (sp *StockPool) GrowLabel(label string, n int) error {
+	spec := sp.spec(label)
+	if spec == nil {
+		return ErrNoSuchEngine
+	}
+
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return ErrPoolClosed
+	}
+	kept := sp.retiring[spec]
+	if kept > n {
+		kept = n
+	}
+	sp.retiring[spec] -= kept
+	n -= kept
+	transcript := sp.transcript
+	sp.mu.Unlock()
+
+	for ; n > 0; n-- {
+		si, _, err := newInstance(spec, transcript)
+		if err != nil {
+			return err
+		}
+
+		sp.mu.Lock()
+		if sp.closed {
+			sp.mu.Unlock()
+			quit(si.Engine)
+			return ErrPoolClosed
+		}
+		sp.idSet[si.id] = si
+		sp.mu.Unlock()
+
+		sp.put(si)
+	}
+
+	return nil
+}
+
+/*
+	ShrinkLabel retires n instances of the engine with the label, an empty
+	label is the first spec. Idle instances are shut down right away and
+	borrowed ones once they are released. n is capped at the number of
+	instances left
+*/
+func (sp *StockPool) ShrinkLabel(label string, n int) error {
+	spec := sp.spec(label)
+	if spec == nil {
+		return ErrNoSuchEngine
+	}
+
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return ErrPoolClosed
+	}
+
+	if size := sp.size(spec); n > size {
+		n = size
+	}
+
+	retired := []*StockInstance{}
+	for i := 0; i < len(sp.idle) && n > 0; {
+		si := sp.idle[i]
+		if si.spec != spec {
+			i++
+			continue
+		}
+
+		sp.idle = append(sp.idle[:i], sp.idle[i+1:]...)
+		delete(sp.idSet, si.id)
+		retired = append(retired, si)
+		n--
+	}
+	sp.retiring[spec] += n
+	sp.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, si := range retired {
+		wg.Add(1)
+		go func(si *StockInstance) {
+			defer wg.Done()
+			quit(si.Engine)
+		}(si)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// Size is the number of instances in the pool, not counting retired ones
+func (sp *StockPool) Size() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	size := 0
+	for _, spec := range sp.specs {
+		size += sp.size(spec)
+	}
+	return size
+}
+
+// must hold sp.mu
+func (sp *StockPool) size(spec *EngineSpec) int {
+	size := -sp.retiring[spec]
+	for _, si := range sp.idSet {
+		if si.spec == spec {
+			size++
+		}
+	}
+	return size
+}
@@ -0,0 +1,99 @@
+package stockpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+)
+
+func TestGrowShrink(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	// the new instance goes to the caller already waiting
+	acquired := make(chan *StockInstance)
+	go func() {
+		si, _ := pool.AcquireContext(context.Background())
+		acquired <- si
+	}()
+	for len(pool.Waiting()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err = pool.Grow(1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	second := <-acquired
+	if second == nil || second == first || pool.Size() != 2 {
+		t.Fatalf("expected a second instance, size %d", pool.Size())
+	}
+
+	// both are borrowed, so they retire on release
+	err = pool.Shrink(5)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if pool.Size() != 0 {
+		t.Fatalf("expected size 0, got %d", pool.Size())
+	}
+
+	// growing again keeps one of the retiring instances
+	err = pool.Grow(1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	pool.Release(first)
+	pool.Release(second)
+	if pool.Size() != 1 {
+		t.Fatalf("expected size 1, got %d", pool.Size())
+	}
+
+	si, err := pool.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	pool.Release(si)
+}
+
+func TestAutoscale(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 0, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	err = pool.Autoscale(context.Background(), AutoscaleConfig{
+		Max:       2,
+		Interval:  5 * time.Millisecond,
+		IdleAfter: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	si, err := pool.AcquireContext(ctx)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	pool.Release(si)
+
+	for pool.Size() > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("expected the idle instance to be retired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
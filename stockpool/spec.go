@@ -0,0 +1,58 @@
+package stockpool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const DefaultLabel = "stockfish"
+
+var ErrNoEngines = errors.New("no engines configured")
+
+/*
+	An engine binary in the pool. Count instances of Path are spawned with
+	Options, and callers can ask for them by Label or by any of Capabilities
+	e.g. a mate solving fork can be labelled "crystal" with capability "mate"
+*/
+type EngineSpec struct {
+	Label        string        `yaml:"label"`
+	Path         string        `yaml:"path"`
+	Count        int           `yaml:"count"`
+	Capabilities []string      `yaml:"capabilities"`
+	Options      EngineOptions `yaml:"options"`
+}
+
+type engineSpecs struct {
+	Engines []EngineSpec `yaml:"engines"`
+}
+
+func LoadEngineSpecs(path string) ([]EngineSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var specs engineSpecs
+	err = yaml.Unmarshal(b, &specs)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs.Engines) == 0 {
+		return nil, fmt.Errorf("%w -- %s", ErrNoEngines, path)
+	}
+
+	return specs.Engines, nil
+}
+
+func (s *EngineSpec) has(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,46 @@
+package stockpool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadEngineSpecs(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "engines.yaml")
+	config := `
+engines:
+  - label: stockfish
+    path: /usr/bin/stockfish
+    count: 2
+  - label: crystal
+    path: /usr/bin/crystal
+    capabilities: [mate]
+`
+	err := os.WriteFile(path, []byte(config), 0644)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	specs, err := LoadEngineSpecs(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if len(specs) != 2 || specs[0].Count != 2 || !specs[1].has("mate") {
+		t.Fatalf("unexpected specs %+v", specs)
+	}
+
+	// an empty list has no first engine to scale
+	empty := filepath.Join(dir, "empty.yaml")
+	err = os.WriteFile(empty, []byte("engines: []\n"), 0644)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	_, err = LoadEngineSpecs(empty)
+	if !errors.Is(err, ErrNoEngines) {
+		t.Fatalf("expected error %v, got %v", ErrNoEngines, err)
+	}
+}
@@ -1,85 +1,535 @@
 package stockpool
 
 import (
+	"context"
 	"errors"
-	"strconv"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/garlicgarrison/go-chess/uci"
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
 	guuid "github.com/google/uuid"
 )
 
 var (
 	ErrPathNotFound       = errors.New("path not found")
 	ErrWrongStockInstance = errors.New("wrong instance released")
+	ErrAcquireTimeout     = errors.New("timed out waiting for instance")
+	ErrNoSuchEngine       = errors.New("no engine with that label or capability")
+	ErrPoolClosed         = errors.New("pool closed")
+	ErrInstancesBorrowed  = errors.New("instances still borrowed at close")
 )
 
+// TimeoutError is returned by AcquireContext when the deadline passes first
+type TimeoutError struct {
+	Waited time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s after %s", ErrAcquireTimeout, e.Waited)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrAcquireTimeout
+}
+
 // TODO: add threads
 type StockInstance struct {
 	id     guuid.UUID
-	Engine *uci.Engine
+	spec   *EngineSpec
+	tap    *tap
+	Engine *Engine
+}
+
+// Label of the engine binary this instance runs
+func (si *StockInstance) Label() string {
+	return si.spec.Label
+}
+
+// Wait statistics of acquire calls
+type WaitStats struct {
+	Acquired  int64
+	Timeouts  int64
+	Cancelled int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+/*
+	Statistics of every acquire call since the pool was created, in total
+	and per priority class
+*/
+type Stats struct {
+	WaitStats
+	Classes map[analysis.Priority]WaitStats
+
+	// engines respawned by health checks, and those that could not be
+	Restarts int64
+	Failures int64
+}
+
+// AvgWait is the average time callers waited before getting an instance
+func (s WaitStats) AvgWait() time.Duration {
+	if s.Acquired == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Acquired)
+}
+
+/*
+	A caller blocked in acquire, released instances go to the highest
+	priority waiter they match, the longest waiting first within a priority
+*/
+type waiter struct {
+	match    func(*StockInstance) bool
+	priority analysis.Priority
+	ch       chan *StockInstance
 }
 
 type StockPool struct {
-	idSet   map[guuid.UUID]bool
-	pool    chan *StockInstance
-	threads int
-	timeout int
+	specs []*EngineSpec
+
+	// options each label did not advertise, reported once at construction
+	unsupported map[string][]string
+
+	// guards everything below
+	mu      sync.Mutex
+	idSet   map[guuid.UUID]*StockInstance
+	idle    []*StockInstance
+	waiters []*waiter
+	health  HealthConfig
+	stats   Stats
+
+	// borrowed instances of each spec to shut down when they are released
+	retiring   map[*EngineSpec]int
+	transcript *Transcript
+
+	closed  bool
+	drained bool
+	// closed on Close to stop the supervisor, and signalled when an
+	// instance comes back while closing
+	done     chan struct{}
+	returned chan struct{}
 }
 
-func NewStockPool(path string, limit, threads, timeout int) (*StockPool, error) {
-	idSet := make(map[guuid.UUID]bool)
-	ch := make(chan *StockInstance, limit)
+func NewStockPool(path string, limit, threads int) (*StockPool, error) {
+	return NewStockPoolWithOptions(path, limit, DefaultEngineOptions(threads))
+}
 
-	for i := 0; i < limit; i++ {
-		eng, err := uci.New(path)
-		if err != nil {
-			return nil, ErrPathNotFound
+func NewStockPoolWithOptions(path string, limit int, opts EngineOptions) (*StockPool, error) {
+	return NewStockPoolFromSpecs([]EngineSpec{{
+		Label:   DefaultLabel,
+		Path:    path,
+		Count:   limit,
+		Options: opts,
+	}})
+}
+
+/*
+	Spawns every engine in specs, a spec without a label gets DefaultLabel
+*/
+func NewStockPoolFromSpecs(specs []EngineSpec) (*StockPool, error) {
+	sp := &StockPool{
+		unsupported: make(map[string][]string),
+		idSet:       make(map[guuid.UUID]*StockInstance),
+		stats:       Stats{Classes: make(map[analysis.Priority]WaitStats)},
+		retiring:    make(map[*EngineSpec]int),
+		done:        make(chan struct{}),
+		returned:    make(chan struct{}, 1),
+	}
+
+	for i := range specs {
+		spec := specs[i]
+		if spec.Label == "" {
+			spec.Label = DefaultLabel
 		}
+		sp.specs = append(sp.specs, &spec)
+
+		for j := 0; j < spec.Count; j++ {
+			si, unsupported, err := newInstance(&spec, nil)
+			if err != nil {
+				sp.Close(context.Background())
+				return nil, err
+			}
+			sp.unsupported[spec.Label] = unsupported
 
-		eng.Run(uci.CmdSetOption{
-			Name:  "Threads",
-			Value: strconv.FormatInt(int64(threads), 10),
-		})
-
-		eng.Run(uci.CmdSetOption{
-			Name:  "Hash",
-			Value: "2048",
-		})
-
-		id := guuid.New()
-		idSet[id] = true
-		ch <- &StockInstance{
-			id:     id,
-			Engine: eng,
+			sp.idSet[si.id] = si
+			sp.idle = append(sp.idle, si)
 		}
 	}
 
-	return &StockPool{
-		idSet:   idSet,
-		pool:    ch,
-		threads: threads,
-		timeout: timeout,
-	}, nil
+	return sp, nil
 }
 
+func newInstance(spec *EngineSpec, transcript *Transcript) (*StockInstance, []string, error) {
+	tp := newTap(spec.Label)
+	tp.record(transcript)
+	eng, unsupported, err := spawn(spec.Path, spec.Options, tp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	si := &StockInstance{
+		id:     guuid.New(),
+		spec:   spec,
+		tap:    tp,
+		Engine: eng,
+	}
+	tp.setInstance(si.id.String())
+
+	return si, unsupported, nil
+}
+
+/*
+	Acquire blocks until an instance is free. Prefer AcquireContext so the
+	wait can be cancelled or bounded by a deadline.
+*/
 func (sp *StockPool) Acquire() *StockInstance {
-	for {
-		select {
-		case instance := <-sp.pool:
-			return instance
-		default:
-			time.Sleep(time.Duration(sp.timeout) * time.Millisecond)
-		}
+	instance, _ := sp.AcquireContext(context.Background())
+	return instance
+}
+
+/*
+	AcquireContext blocks until an instance is free or ctx is done.
+	If the deadline of ctx passes first, a *TimeoutError is returned,
+	otherwise a cancelled ctx returns ctx.Err()
+
+	Waiters are served by the priority set with analysis.WithPriority, so
+	interactive callers go ahead of queued batch work
+
+	With CheckOnAcquire set, dead instances are restarted before they are
+	handed out
+*/
+func (sp *StockPool) AcquireContext(ctx context.Context) (*StockInstance, error) {
+	return sp.acquire(ctx, func(*StockInstance) bool { return true })
+}
+
+/*
+	AcquireLabel is AcquireContext restricted to the engine with the given
+	label, an empty label takes any engine
+*/
+func (sp *StockPool) AcquireLabel(ctx context.Context, label string) (*StockInstance, error) {
+	if label == "" {
+		return sp.AcquireContext(ctx)
 	}
+	if !sp.hasSpec(func(s *EngineSpec) bool { return s.Label == label }) {
+		return nil, ErrNoSuchEngine
+	}
+
+	return sp.acquire(ctx, func(si *StockInstance) bool {
+		return si.spec.Label == label
+	})
+}
+
+/*
+	AcquireCapability is AcquireContext restricted to engines that list the
+	capability in their spec
+*/
+func (sp *StockPool) AcquireCapability(ctx context.Context, capability string) (*StockInstance, error) {
+	if !sp.hasSpec(func(s *EngineSpec) bool { return s.has(capability) }) {
+		return nil, ErrNoSuchEngine
+	}
+
+	return sp.acquire(ctx, func(si *StockInstance) bool {
+		return si.spec.has(capability)
+	})
 }
 
 func (sp *StockPool) Release(si *StockInstance) error {
+	sp.mu.Lock()
 	_, ok := sp.idSet[si.id]
+	sp.mu.Unlock()
 	if !ok {
 		return ErrWrongStockInstance
 	}
 
-	sp.pool <- si
+	sp.put(si)
+	return nil
+}
+
+/*
+	Close stops handing out instances, waits until every borrowed instance
+	is released or ctx is done, then sends quit to every engine and kills the
+	processes. Once ctx is done the engines still borrowed are killed, which
+	ends the command they are stuck in, they are shut down on release and
+	ErrInstancesBorrowed is returned
+*/
+func (sp *StockPool) Close(ctx context.Context) error {
+	sp.mu.Lock()
+	if sp.closed {
+		sp.mu.Unlock()
+		return nil
+	}
+	sp.closed = true
+	close(sp.done)
+	for _, w := range sp.waiters {
+		close(w.ch)
+	}
+	sp.waiters = nil
+	sp.mu.Unlock()
+
+	var err error
+	for err == nil {
+		sp.mu.Lock()
+		borrowed := len(sp.idSet) - len(sp.idle)
+		sp.mu.Unlock()
+		if borrowed == 0 {
+			break
+		}
+
+		select {
+		case <-sp.returned:
+		case <-ctx.Done():
+			err = ErrInstancesBorrowed
+		}
+	}
+
+	sp.mu.Lock()
+	sp.drained = true
+	idle := sp.idle
+	sp.idle = nil
+	for _, si := range idle {
+		delete(sp.idSet, si.id)
+	}
+	// the instances left are borrowed
+	borrowed := make([]*StockInstance, 0, len(sp.idSet))
+	for _, si := range sp.idSet {
+		borrowed = append(borrowed, si)
+	}
+	sp.mu.Unlock()
+
+	for _, si := range borrowed {
+		si.Engine.Kill()
+	}
+
+	var wg sync.WaitGroup
+	for _, si := range idle {
+		wg.Add(1)
+		go func(si *StockInstance) {
+			defer wg.Done()
+			quit(si.Engine)
+		}(si)
+	}
+	wg.Wait()
+
+	return err
+}
+
+// Unsupported returns the configured options each label does not advertise
+func (sp *StockPool) Unsupported() map[string][]string {
+	return sp.unsupported
+}
+
+// Stats returns a snapshot of the acquire wait statistics
+func (sp *StockPool) Stats() Stats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	stats := sp.stats
+	stats.Classes = make(map[analysis.Priority]WaitStats, len(sp.stats.Classes))
+	for p, s := range sp.stats.Classes {
+		stats.Classes[p] = s
+	}
+	return stats
+}
+
+// Waiting returns the number of callers queued for an instance per priority
+func (sp *StockPool) Waiting() map[analysis.Priority]int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	waiting := make(map[analysis.Priority]int)
+	for _, w := range sp.waiters {
+		waiting[w.priority]++
+	}
+	return waiting
+}
+
+func (sp *StockPool) acquire(ctx context.Context, match func(*StockInstance) bool) (*StockInstance, error) {
+	start := time.Now()
+	priority := analysis.PriorityFrom(ctx)
+
+	for {
+		instance, w, err := sp.take(match, priority)
+		if err != nil {
+			sp.record(priority, time.Since(start), err)
+			return nil, err
+		}
+
+		if instance == nil {
+			var ok bool
+			select {
+			case instance, ok = <-w.ch:
+				if !ok {
+					sp.record(priority, time.Since(start), ErrPoolClosed)
+					return nil, ErrPoolClosed
+				}
+			case <-ctx.Done():
+				sp.cancel(w)
+
+				waited := time.Since(start)
+				err := ctx.Err()
+				if errors.Is(err, context.DeadlineExceeded) {
+					err = &TimeoutError{Waited: waited}
+				}
+				sp.record(priority, waited, err)
+				return nil, err
+			}
+		}
+
+		sp.mu.Lock()
+		health := sp.health
+		sp.mu.Unlock()
+
+		if health.CheckOnAcquire && !sp.healthy(instance, health.Timeout) {
+			continue
+		}
+
+		sp.record(priority, time.Since(start), nil)
+		return instance, nil
+	}
+}
+
+/*
+	Removes the first idle instance that matches, or queues a waiter if
+	there is none
+*/
+func (sp *StockPool) take(match func(*StockInstance) bool, priority analysis.Priority) (*StockInstance, *waiter, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.closed {
+		return nil, nil, ErrPoolClosed
+	}
+
+	for i, si := range sp.idle {
+		if match(si) {
+			sp.idle = append(sp.idle[:i], sp.idle[i+1:]...)
+			return si, nil, nil
+		}
+	}
+
+	w := &waiter{
+		match:    match,
+		priority: priority,
+		ch:       make(chan *StockInstance, 1),
+	}
+	sp.waiters = append(sp.waiters, w)
+	return nil, w, nil
+}
+
+/*
+	Hands the instance to the highest priority waiter it matches, otherwise it goes
+	back to idle. While closing it goes back to idle for Close to shut down,
+	or is shut down here if Close already gave up waiting. Instances retired
+	by Shrink are shut down here too
+*/
+func (sp *StockPool) put(si *StockInstance) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.closed {
+		if sp.drained {
+			delete(sp.idSet, si.id)
+			go quit(si.Engine)
+			return
+		}
+
+		sp.idle = append(sp.idle, si)
+		select {
+		case sp.returned <- struct{}{}:
+		default:
+		}
+		return
+	}
+
+	if sp.retiring[si.spec] > 0 {
+		sp.retiring[si.spec]--
+		delete(sp.idSet, si.id)
+		go quit(si.Engine)
+		return
+	}
+
+	// waiters are in arrival order, so the first of the highest priority
+	// has waited longest
+	next := -1
+	for i, w := range sp.waiters {
+		if w.match(si) && (next < 0 || w.priority > sp.waiters[next].priority) {
+			next = i
+		}
+	}
+	if next >= 0 {
+		w := sp.waiters[next]
+		sp.waiters = append(sp.waiters[:next], sp.waiters[next+1:]...)
+		w.ch <- si
+		return
+	}
+
+	sp.idle = append(sp.idle, si)
+}
+
+/*
+	Dequeues a waiter that gave up, if an instance was handed to it in
+	the meantime it is put back
+*/
+func (sp *StockPool) cancel(w *waiter) {
+	sp.mu.Lock()
+	for i, other := range sp.waiters {
+		if other == w {
+			sp.waiters = append(sp.waiters[:i], sp.waiters[i+1:]...)
+			sp.mu.Unlock()
+			return
+		}
+	}
+	sp.mu.Unlock()
+
+	if si, ok := <-w.ch; ok {
+		sp.put(si)
+	}
+}
+
+// returns the spec with the label, an empty label is the first spec
+func (sp *StockPool) spec(label string) *EngineSpec {
+	for _, s := range sp.specs {
+		if label == "" || s.Label == label {
+			return s
+		}
+	}
+
 	return nil
 }
+
+func (sp *StockPool) hasSpec(match func(*EngineSpec) bool) bool {
+	for _, s := range sp.specs {
+		if match(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (sp *StockPool) record(priority analysis.Priority, wait time.Duration, err error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.stats.WaitStats.record(wait, err)
+	class := sp.stats.Classes[priority]
+	class.record(wait, err)
+	sp.stats.Classes[priority] = class
+}
+
+func (s *WaitStats) record(wait time.Duration, err error) {
+	switch {
+	case err == nil:
+		s.Acquired++
+		s.TotalWait += wait
+		if wait > s.MaxWait {
+			s.MaxWait = wait
+		}
+	case errors.Is(err, ErrAcquireTimeout):
+		s.Timeouts++
+	default:
+		s.Cancelled++
+	}
+}
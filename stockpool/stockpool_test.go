@@ -0,0 +1,277 @@
+package stockpool
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+)
+
+func TestMain(m *testing.M) {
+	fakeengine.Main()
+	os.Exit(m.Run())
+}
+
+func TestAcquireContextTimeout(t *testing.T) {
+	pool, err := NewStockPool("stockfish", 0, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	instance, err := pool.AcquireContext(ctx)
+	if instance != nil {
+		t.Fatalf("expected no instance from an empty pool")
+	}
+	if !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Waited < 20*time.Millisecond {
+		t.Fatalf("expected waited >= 20ms, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = pool.AcquireContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	stats := pool.Stats()
+	if stats.Timeouts != 1 || stats.Cancelled != 1 || stats.Acquired != 0 {
+		t.Fatalf("unexpected stats -- %+v", stats)
+	}
+}
+
+func TestAcquireUnknownLabel(t *testing.T) {
+	pool, err := NewStockPoolFromSpecs([]EngineSpec{
+		{Label: "stockfish", Path: "stockfish"},
+		{Label: "crystal", Path: "crystal", Capabilities: []string{"mate"}},
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	_, err = pool.AcquireLabel(context.Background(), "lc0")
+	if !errors.Is(err, ErrNoSuchEngine) {
+		t.Fatalf("expected no such engine, got %v", err)
+	}
+
+	_, err = pool.AcquireCapability(context.Background(), "nnue")
+	if !errors.Is(err, ErrNoSuchEngine) {
+		t.Fatalf("expected no such engine, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = pool.AcquireCapability(ctx, "mate")
+	if !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	pool, err := NewStockPool("stockfish", 0, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		_, err := pool.AcquireContext(context.Background())
+		acquired <- err
+	}()
+
+	// let the acquire above start waiting
+	time.Sleep(10 * time.Millisecond)
+
+	err = pool.Close(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	err = <-acquired
+	if !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected waiter to see closed pool, got %v", err)
+	}
+
+	_, err = pool.AcquireContext(context.Background())
+	if !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("expected closed pool, got %v", err)
+	}
+}
+
+func TestCloseHungEngine(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("testdata/hang.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	analyzed := make(chan error)
+	go func() {
+		_, err := pool.Analyze(context.Background(), analysis.Request{
+			FEN:    "k7/8/2K5/8/8/8/8/7R w - - 0 1",
+			Limits: analysis.SearchLimits{Depth: 20},
+		})
+		analyzed <- err
+	}()
+
+	// let the search above start
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = pool.Close(ctx)
+	if !errors.Is(err, ErrInstancesBorrowed) {
+		t.Fatalf("expected borrowed instances, got %v", err)
+	}
+
+	select {
+	case err = <-analyzed:
+		if err == nil {
+			t.Fatalf("expected the killed search to fail")
+		}
+	case <-time.After(DefaultHealthTimeout):
+		t.Fatalf("expected Close to end the search")
+	}
+}
+
+func TestAcquireLabel(t *testing.T) {
+	path := fakeengine.Path("../puzzlegen/testdata/mate.json")
+	pool, err := NewStockPoolFromSpecs([]EngineSpec{
+		{Label: "stockfish", Path: path, Count: 1},
+		{Label: "crystal", Path: path, Count: 1, Capabilities: []string{"mate"}},
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	instance, err := pool.AcquireCapability(context.Background(), "mate")
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if instance.Label() != "crystal" {
+		t.Fatalf("expected crystal, got %s", instance.Label())
+	}
+
+	// the only mate engine is borrowed, so this waits for the release
+	released := make(chan *StockInstance)
+	go func() {
+		si, _ := pool.AcquireLabel(context.Background(), "crystal")
+		released <- si
+	}()
+
+	other, err := pool.AcquireContext(context.Background())
+	if err != nil || other.Label() != "stockfish" {
+		t.Fatalf("expected stockfish, got %v", err)
+	}
+
+	pool.Release(instance)
+	if si := <-released; si != instance {
+		t.Fatalf("expected the released crystal instance")
+	}
+
+	pool.Release(instance)
+	pool.Release(other)
+}
+
+func TestAcquirePriority(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	instance, err := pool.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	// batch work queues first, the interactive request still goes ahead
+	order := make(chan analysis.Priority, 3)
+	for _, p := range []analysis.Priority{analysis.PriorityBatch, analysis.PriorityBatch, analysis.PriorityInteractive} {
+		ctx := analysis.WithPriority(context.Background(), p)
+		go func(p analysis.Priority) {
+			si, err := pool.AcquireContext(ctx)
+			if err != nil {
+				t.Errorf("err -- %s", err)
+				return
+			}
+			order <- p
+			time.Sleep(5 * time.Millisecond)
+			pool.Release(si)
+		}(p)
+		for pool.Waiting()[p] == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	pool.Release(instance)
+	for _, expected := range []analysis.Priority{analysis.PriorityInteractive, analysis.PriorityBatch, analysis.PriorityBatch} {
+		if p := <-order; p != expected {
+			t.Fatalf("expected %s, got %s", expected, p)
+		}
+	}
+
+	stats := pool.Stats()
+	if stats.Classes[analysis.PriorityBatch].Acquired != 2 || stats.Classes[analysis.PriorityInteractive].Acquired != 1 {
+		t.Fatalf("unexpected stats -- %+v", stats)
+	}
+	if stats.Classes[analysis.PriorityBatch].MaxWait < stats.Classes[analysis.PriorityInteractive].MaxWait {
+		t.Fatalf("expected batch to wait longer -- %+v", stats)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	instance, err := pool.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	old := instance.Engine
+	old.Kill()
+
+	// a killed engine fails straight away instead of timing out
+	err = ping(old, DefaultHealthTimeout)
+	if err == nil || errors.Is(err, ErrEngineUnresponsive) {
+		t.Fatalf("expected the killed engine to fail, got %v", err)
+	}
+
+	err = pool.Restart(instance)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if instance.Engine == old {
+		t.Fatalf("expected a new engine")
+	}
+
+	err = pool.Release(instance)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	pool.Supervise(context.Background(), HealthConfig{CheckOnAcquire: true, Timeout: time.Second})
+	instance, err = pool.AcquireContext(context.Background())
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	if stats := pool.Stats(); stats.Restarts != 1 || stats.Failures != 0 {
+		t.Fatalf("unexpected stats -- %+v", stats)
+	}
+	pool.Release(instance)
+}
@@ -0,0 +1,197 @@
+package stockpool
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	One line sent to or received from an engine, Position is the FEN of the
+	last position the instance was given
+*/
+type TranscriptEntry struct {
+	Time     time.Time `json:"time"`
+	Engine   string    `json:"engine"`
+	Instance string    `json:"instance"`
+	Position string    `json:"position,omitempty"`
+	Sent     string    `json:"sent,omitempty"`
+	Received string    `json:"received,omitempty"`
+}
+
+/*
+	Transcript is a JSONL file of TranscriptEntry, any number of instances
+	can record to the same one
+*/
+type Transcript struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// OpenTranscript appends to the file at path, creating it if needed
+func OpenTranscript(path string) (*Transcript, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transcript{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+func (t *Transcript) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.f.Close()
+}
+
+func (t *Transcript) write(entry TranscriptEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(entry)
+}
+
+func LoadTranscript(path string) ([]TranscriptEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []TranscriptEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry TranscriptEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+/*
+	Record writes every line the instance sends and receives to t from now
+	on, nil stops recording
+*/
+func (si *StockInstance) Record(t *Transcript) {
+	si.tap.record(t)
+}
+
+/*
+	Record is StockInstance.Record for every instance of the pool, including
+	borrowed ones and those restarted or added later
+*/
+func (sp *StockPool) Record(t *Transcript) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.transcript = t
+	for _, si := range sp.idSet {
+		si.Record(t)
+	}
+}
+
+// the first word of every command a GUI sends, everything else is engine output
+var uciCommands = map[string]bool{
+	"uci":        true,
+	"debug":      true,
+	"isready":    true,
+	"setoption":  true,
+	"register":   true,
+	"ucinewgame": true,
+	"position":   true,
+	"go":         true,
+	"stop":       true,
+	"ponderhit":  true,
+	"quit":       true,
+}
+
+/*
+	tap is the log writer of an engine, Engine logs each command and each
+	line of output on its own. It also keeps the names of the options the
+	engine advertised, which the pool checks options against
+*/
+type tap struct {
+	mu         sync.Mutex
+	transcript *Transcript
+	engine     string
+	instance   string
+	position   string
+	options    map[string]bool
+}
+
+func newTap(engine string) *tap {
+	return &tap{
+		engine:  engine,
+		options: make(map[string]bool),
+	}
+}
+
+// advertised reports whether the engine listed the option, ignoring case
+func (tp *tap) advertised(name string) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.options[strings.ToLower(name)]
+}
+
+func (tp *tap) record(t *Transcript) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.transcript = t
+}
+
+func (tp *tap) setInstance(id string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	tp.instance = id
+}
+
+func (tp *tap) Write(b []byte) (int, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	line := strings.TrimRight(string(b), "\r\n")
+	fields := strings.Fields(line)
+	sent := len(fields) > 0 && uciCommands[fields[0]]
+	switch {
+	case sent && fields[0] == "uci":
+		tp.options = make(map[string]bool)
+	case sent && fields[0] == "position":
+		tp.position = strings.TrimPrefix(line, "position fen ")
+	case !sent && strings.HasPrefix(line, "option name "):
+		name := strings.TrimPrefix(line, "option name ")
+		if i := strings.Index(name, " type "); i >= 0 {
+			name = name[:i]
+		}
+		tp.options[strings.ToLower(name)] = true
+	}
+
+	if tp.transcript == nil {
+		return len(b), nil
+	}
+
+	entry := TranscriptEntry{
+		Time:     time.Now(),
+		Engine:   tp.engine,
+		Instance: tp.instance,
+		Position: tp.position,
+	}
+	if sent {
+		entry.Sent = line
+	} else {
+		entry.Received = line
+	}
+	tp.transcript.write(entry)
+
+	return len(b), nil
+}
@@ -0,0 +1,90 @@
+package stockpool
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/garlicgarrison/chess-puzzle-gen/analysis"
+	"github.com/garlicgarrison/chess-puzzle-gen/fakeengine"
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+// records one search of the two mate in 1 position and returns the transcript
+func recordSearch(t *testing.T) (string, *analysis.Result) {
+	pool, err := NewStockPool(fakeengine.Path("../puzzlegen/testdata/mate.json"), 1, 1)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer pool.Close(context.Background())
+
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	transcript, err := OpenTranscript(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+	defer transcript.Close()
+	pool.Record(transcript)
+
+	res, err := pool.Analyze(context.Background(), analysis.Request{
+		Position: testPosition(t, "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1"),
+		Limits:   analysis.SearchLimits{Depth: 20},
+		MultiPV:  2,
+	})
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return path, res
+}
+
+func testPosition(t *testing.T, fen string) *chess.Position {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return chess.NewGame(f).Position()
+}
+
+func TestRecord(t *testing.T) {
+	path, _ := recordSearch(t)
+
+	entries, err := LoadTranscript(path)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	var sent, received []string
+	for _, e := range entries {
+		if e.Engine != DefaultLabel || e.Instance == "" || e.Time.IsZero() {
+			t.Fatalf("untagged entry -- %+v", e)
+		}
+		if e.Sent != "" {
+			sent = append(sent, e.Sent)
+			continue
+		}
+		if e.Position != "6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1" {
+			t.Fatalf("expected the searched position, got %q", e.Position)
+		}
+		received = append(received, e.Received)
+	}
+
+	expected := []string{
+		"setoption name MultiPV value 2",
+		"position fen 6k1/5ppp/8/8/8/8/8/R3R1K1 w - - 0 1",
+		"go depth 20",
+	}
+	if len(sent) != len(expected) {
+		t.Fatalf("expected %q, got %q", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Fatalf("expected %q, got %q", expected, sent)
+		}
+	}
+
+	if len(received) != 3 || received[2] != "bestmove a1a8" {
+		t.Fatalf("unexpected output -- %q", received)
+	}
+}
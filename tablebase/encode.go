@@ -0,0 +1,400 @@
+package tablebase
+
+import "sort"
+
+/*
+	The index of a position in a Syzygy table. Pieces are numbered like
+	Stockfish, pawn 1 to king 6 with 8 added for black, and squares like
+	the chess package, a1 is 0 and h8 is 63
+
+	Pawnless tables keep one of the symmetric positions, the first piece in
+	the a1-d1-d4 triangle and below the a1-h8 diagonal. Tables with pawns
+	are split by the file of the lead pawn, mirrored to the a to d files
+*/
+
+const (
+	pawnCode = 1
+	kingCode = 6
+	blackBit = 8
+)
+
+var (
+	binomial [MaxPieces][64]uint64
+	// a2 to h7 counted from the edges, the lead pawn has the highest
+	mapPawns      [64]int
+	leadPawnIdx   [MaxPieces][64]uint64
+	leadPawnsSize [MaxPieces][4]uint64
+	// below the a1-h8 diagonal to 0..27
+	mapB1H1H7 [64]int
+	// the a1-d1-d4 triangle to 0..9, the diagonal last
+	mapA1D1D4 [64]int
+	// the 462 placements of two kings, the first in the triangle
+	mapKK [10][64]int
+)
+
+func init() {
+	code := 0
+	for sq := 0; sq < 64; sq++ {
+		if offDiagonal(sq) < 0 {
+			mapB1H1H7[sq] = code
+			code++
+		}
+	}
+
+	code = 0
+	diagonal := []int{}
+	for sq := 0; sq <= 27; sq++ {
+		switch {
+		case sq%8 > 3:
+		case offDiagonal(sq) < 0:
+			mapA1D1D4[sq] = code
+			code++
+		case offDiagonal(sq) == 0:
+			diagonal = append(diagonal, sq)
+		}
+	}
+	for _, sq := range diagonal {
+		mapA1D1D4[sq] = code
+		code++
+	}
+
+	// both kings on the diagonal come last
+	type pair struct{ idx, sq int }
+	both := []pair{}
+	code = 0
+	for idx := 0; idx < 10; idx++ {
+		for s1 := 0; s1 <= 27; s1++ {
+			if s1%8 > 3 || mapA1D1D4[s1] != idx || (idx == 0 && s1 != 1) {
+				continue
+			}
+
+			for s2 := 0; s2 < 64; s2++ {
+				switch {
+				case distance(s1, s2) <= 1:
+				case offDiagonal(s1) == 0 && offDiagonal(s2) > 0:
+				case offDiagonal(s1) == 0 && offDiagonal(s2) == 0:
+					both = append(both, pair{idx, s2})
+				default:
+					mapKK[idx][s2] = code
+					code++
+				}
+			}
+		}
+	}
+	for _, p := range both {
+		mapKK[p.idx][p.sq] = code
+		code++
+	}
+
+	binomial[0][0] = 1
+	for n := 1; n < 64; n++ {
+		for k := 0; k < MaxPieces && k <= n; k++ {
+			if k > 0 {
+				binomial[k][n] += binomial[k-1][n-1]
+			}
+			if k < n {
+				binomial[k][n] += binomial[k][n-1]
+			}
+		}
+	}
+
+	available := 47
+	for lead := 1; lead < MaxPieces; lead++ {
+		for file := 0; file < 4; file++ {
+			var idx uint64
+			for rank := 1; rank < 7; rank++ {
+				sq := rank*8 + file
+				if lead == 1 {
+					mapPawns[sq] = available
+					mapPawns[sq^7] = available - 1
+					available -= 2
+				}
+				leadPawnIdx[lead][sq] = idx
+				idx += binomial[lead-1][mapPawns[sq]]
+			}
+			leadPawnsSize[lead][file] = idx
+		}
+	}
+}
+
+// the rank minus the file, 0 on the a1-h8 diagonal and negative below it
+func offDiagonal(sq int) int {
+	return sq/8 - sq%8
+}
+
+func distance(a, b int) int {
+	df, dr := a%8-b%8, a/8-b/8
+	if df < 0 {
+		df = -df
+	}
+	if dr < 0 {
+		dr = -dr
+	}
+	if df > dr {
+		return df
+	}
+
+	return dr
+}
+
+/*
+	The pieces of one side to move of a table, and of one file of the lead
+	pawn, in the order they are encoded. Pieces of a group are the same and
+	are placed together, groupIdx is what an index of the group counts for
+*/
+type layout struct {
+	pieces   [MaxPieces]uint8
+	groupLen [MaxPieces + 1]int
+	groupIdx [MaxPieces + 1]uint64
+}
+
+/*
+	Splits the pieces into groups, the lead group first and then runs of the
+	same piece. order holds where the lead group and the pawns of the other
+	color are multiplied in, 0xF for none
+*/
+func (t *table) setGroups(l *layout, order [2]int, file int) {
+	n, first := 0, 0
+	if !t.pawns {
+		first = 2
+		if t.unique {
+			first = 3
+		}
+	}
+
+	l.groupLen[0] = 1
+	for i := 1; i < t.count; i++ {
+		first--
+		if first > 0 || l.pieces[i] == l.pieces[i-1] {
+			l.groupLen[n]++
+		} else {
+			n++
+			l.groupLen[n] = 1
+		}
+	}
+	n++
+	l.groupLen[n] = 0
+
+	pp := t.pawns && t.pawnCount[1] > 0
+	next, free := 1, 64-l.groupLen[0]
+	if pp {
+		next, free = 2, free-l.groupLen[1]
+	}
+
+	idx := uint64(1)
+	for k := 0; next < n || k == order[0] || k == order[1]; k++ {
+		switch {
+		case k == order[0]:
+			l.groupIdx[0] = idx
+			switch {
+			case t.pawns:
+				idx *= leadPawnsSize[l.groupLen[0]][file]
+			case t.unique:
+				idx *= 31332
+			default:
+				idx *= 462
+			}
+		case k == order[1]:
+			l.groupIdx[1] = idx
+			idx *= binomial[l.groupLen[1]][48-l.groupLen[0]]
+		default:
+			l.groupIdx[next] = idx
+			idx *= binomial[l.groupLen[next]][free]
+			free -= l.groupLen[next]
+			next++
+		}
+	}
+	l.groupIdx[n] = idx
+}
+
+// the number of positions, the last group index
+func (l *layout) size() uint64 {
+	n := 0
+	for l.groupLen[n] != 0 {
+		n++
+	}
+
+	return l.groupIdx[n]
+}
+
+/*
+	The side and file of the table a position is in, with the colors of the
+	table. For tables with pawns the pieces of the lead color are in pieces
+	of side 0 and file 0
+*/
+func (t *table) fileOf(pieces []uint8, sqs []int) int {
+	if !t.pawns {
+		return 0
+	}
+
+	return edgeDistance(leadPawn(t.leadPawn(), pieces, sqs) % 8)
+}
+
+func (t *table) leadPawn() uint8 {
+	return t.sides[0][0].pieces[0]
+}
+
+// the square of the pawn nearest the edge, the lowest of those
+func leadPawn(pawn uint8, pieces []uint8, sqs []int) int {
+	lead := -1
+	for i, p := range pieces {
+		if p == pawn && (lead < 0 || mapPawns[sqs[i]] > mapPawns[lead]) {
+			lead = sqs[i]
+		}
+	}
+
+	return lead
+}
+
+func edgeDistance(file int) int {
+	if file > 3 {
+		return 7 - file
+	}
+
+	return file
+}
+
+/*
+	The index of the position in l, the layout of its side and file. pieces
+	and sqs are in any order, they are not changed
+*/
+func (t *table) index(l *layout, pieces []uint8, sqs []int) uint64 {
+	var p [MaxPieces]uint8
+	var s [MaxPieces]int
+	n, lead := 0, 0
+
+	// the lead pawns first, the one nearest the edge in front
+	if t.pawns {
+		pawn := l.pieces[0]
+		for i := range pieces {
+			if pieces[i] == pawn {
+				p[n], s[n] = pieces[i], sqs[i]
+				n++
+			}
+		}
+		lead = n
+		for i := 1; i < lead; i++ {
+			if mapPawns[s[i]] > mapPawns[s[0]] {
+				s[0], s[i] = s[i], s[0]
+			}
+		}
+	}
+	for i := range pieces {
+		if !t.pawns || pieces[i] != l.pieces[0] {
+			p[n], s[n] = pieces[i], sqs[i]
+			n++
+		}
+	}
+
+	// the order the table stores its pieces in
+	for i := lead; i < n-1; i++ {
+		for j := i + 1; j < n; j++ {
+			if p[j] == l.pieces[i] && p[i] != l.pieces[i] {
+				p[i], p[j] = p[j], p[i]
+				s[i], s[j] = s[j], s[i]
+				break
+			}
+		}
+	}
+
+	if s[0]%8 > 3 {
+		for i := 0; i < n; i++ {
+			s[i] ^= 7
+		}
+	}
+
+	var idx uint64
+	if t.pawns {
+		idx = leadPawnIdx[lead][s[0]]
+		rest := s[1:lead]
+		sort.SliceStable(rest, func(a, b int) bool {
+			return mapPawns[rest[a]] < mapPawns[rest[b]]
+		})
+		for i := 1; i < lead; i++ {
+			idx += binomial[i][mapPawns[s[i]]]
+		}
+	} else {
+		idx = t.leadIndex(l, s[:n])
+	}
+
+	idx *= l.groupIdx[0]
+	g, pawns := l.groupLen[0], t.pawns && t.pawnCount[1] > 0
+	for next := 1; l.groupLen[next] != 0; next++ {
+		group := s[g : g+l.groupLen[next]]
+		sort.Ints(group)
+
+		// squares of the groups before are left out
+		var k uint64
+		for i, sq := range group {
+			adjust := 0
+			for _, before := range s[:g] {
+				if sq > before {
+					adjust++
+				}
+			}
+			if pawns {
+				adjust += 8
+			}
+			k += binomial[i+1][sq-adjust]
+		}
+
+		pawns = false
+		idx += k * l.groupIdx[next]
+		g += l.groupLen[next]
+	}
+
+	return idx
+}
+
+// the index of the lead group of a pawnless table, which moves s there
+func (t *table) leadIndex(l *layout, s []int) uint64 {
+	if s[0]/8 > 3 {
+		for i := range s {
+			s[i] ^= 56
+		}
+	}
+
+	// the first piece off the diagonal goes below it
+	for i := 0; i < l.groupLen[0]; i++ {
+		off := offDiagonal(s[i])
+		if off == 0 {
+			continue
+		}
+		if off > 0 {
+			for j := i; j < len(s); j++ {
+				s[j] = ((s[j] >> 3) | (s[j] << 3)) & 63
+			}
+		}
+		break
+	}
+
+	if !t.unique {
+		return uint64(mapKK[mapA1D1D4[s[0]]][s[1]])
+	}
+
+	adjust1 := 0
+	if s[1] > s[0] {
+		adjust1 = 1
+	}
+	adjust2 := 0
+	if s[2] > s[0] {
+		adjust2++
+	}
+	if s[2] > s[1] {
+		adjust2++
+	}
+
+	var idx int
+	switch {
+	case offDiagonal(s[0]) != 0:
+		idx = (mapA1D1D4[s[0]]*63+s[1]-adjust1)*62 + s[2] - adjust2
+	case offDiagonal(s[1]) != 0:
+		idx = (6*63+(s[0]/8)*28+mapB1H1H7[s[1]])*62 + s[2] - adjust2
+	case offDiagonal(s[2]) != 0:
+		idx = 6*63*62 + 4*28*62 + (s[0]/8)*7*28 + (s[1]/8-adjust1)*28 + mapB1H1H7[s[2]]
+	default:
+		idx = 6*63*62 + 4*28*62 + 4*7*28 + (s[0]/8)*7*6 + (s[1]/8-adjust1)*6 + s[2]/8 - adjust2
+	}
+
+	return uint64(idx)
+}
@@ -0,0 +1,452 @@
+package tablebase
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+	Syzygy table files. After the magic and a flag byte come the piece
+	order of every side and file, then the compression parameters, the
+	sparse index, the block lengths and the blocks, each side and file in
+	turn. Values are Huffman coded pairs of values, which expand
+	recursively into the values of the positions in index order
+*/
+
+const (
+	wdlExt = ".rtbw"
+	dtzExt = ".rtbz"
+)
+
+var (
+	wdlMagic = []byte{0x71, 0xe8, 0x23, 0x5d}
+	dtzMagic = []byte{0xd7, 0x66, 0x0c, 0xa5}
+
+	ErrInvalidTable = errors.New("invalid table file")
+)
+
+// the flags of a side and file
+const (
+	flagSTM         = 1
+	flagMapped      = 2
+	flagWinPlies    = 4
+	flagLossPlies   = 8
+	flagWide        = 16
+	flagSingleValue = 128
+)
+
+// the flags of the file
+const (
+	fileSplit = 1
+	filePawns = 2
+)
+
+// the values of one side and file
+type pairs struct {
+	layout
+	flags uint8
+
+	// the value of every position with flagSingleValue
+	single int
+
+	blockSize uint64
+	span      uint64
+	blocks    uint32
+	// blocks and padding
+	blockLengthSize int
+	// the first block and the offset in it of every span
+	sparse []byte
+	// the number of values of every block, less one
+	blockLengths []byte
+	data         []byte
+
+	minLen int
+	lowest []uint16
+	base   []uint64
+	// the number of values a symbol expands to, less one
+	symLen []int
+	tree   []byte
+	// where the values of each result start in the dtz map
+	mapIdx [4]int
+}
+
+// a file read with bounds checks, the first error sticks
+type cursor struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil || n < 0 || c.pos+n > len(c.b) {
+		c.err = ErrInvalidTable
+		// numbers read after the error are 0
+		return make([]byte, 8)
+	}
+
+	b := c.b[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *cursor) uint8() uint8 {
+	return c.take(1)[0]
+}
+
+func (c *cursor) uint16() uint16 {
+	return binary.LittleEndian.Uint16(c.take(2))
+}
+
+func (c *cursor) uint32() uint32 {
+	return binary.LittleEndian.Uint32(c.take(4))
+}
+
+// skips to the next multiple of n bytes from the start of the file
+func (c *cursor) align(n int) {
+	if r := c.pos % n; r != 0 {
+		c.take(n - r)
+	}
+}
+
+func (t *table) read(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	magic := wdlMagic
+	if t.dtz {
+		magic = dtzMagic
+	}
+	c := &cursor{b: b}
+	if string(c.take(4)) != string(magic) {
+		return fmt.Errorf("%w -- %s", ErrInvalidTable, path)
+	}
+
+	flags := c.uint8()
+	if (flags&filePawns != 0) != t.pawns || (flags&fileSplit != 0) == t.symmetric {
+		return fmt.Errorf("%w -- %s is not %s", ErrInvalidTable, path, t.name)
+	}
+
+	sides, files := 1, 1
+	if !t.dtz && !t.symmetric {
+		sides = 2
+	}
+	if t.pawns {
+		files = 4
+	}
+	pp := t.pawns && t.pawnCount[1] > 0
+
+	for f := 0; f < files; f++ {
+		order := [2][2]int{}
+		o := c.uint8()
+		order[0][0], order[1][0] = int(o&0xf), int(o>>4)
+		order[0][1], order[1][1] = 0xf, 0xf
+		if pp {
+			o = c.uint8()
+			order[0][1], order[1][1] = int(o&0xf), int(o>>4)
+		}
+
+		for i := 0; i < sides; i++ {
+			t.sides[i][f] = &pairs{}
+		}
+		for k := 0; k < t.count; k++ {
+			p := c.uint8()
+			for i := 0; i < sides; i++ {
+				t.sides[i][f].pieces[k] = p & 0xf
+				if i == 1 {
+					t.sides[i][f].pieces[k] = p >> 4
+				}
+			}
+		}
+		for i := 0; i < sides; i++ {
+			if !t.matches(t.sides[i][f].pieces[:t.count]) {
+				return fmt.Errorf("%w -- %s is not %s", ErrInvalidTable, path, t.name)
+			}
+			t.setGroups(&t.sides[i][f].layout, order[i], f)
+		}
+	}
+	c.align(2)
+
+	for f := 0; f < files; f++ {
+		for i := 0; i < sides; i++ {
+			t.sides[i][f].readSizes(c)
+		}
+	}
+
+	if t.dtz {
+		start := c.pos
+		for f := 0; f < files; f++ {
+			d := t.sides[0][f]
+			if d.flags&flagMapped == 0 {
+				continue
+			}
+			if d.flags&flagWide != 0 {
+				c.align(2)
+				for i := range d.mapIdx {
+					d.mapIdx[i] = (c.pos-start)/2 + 1
+					c.take(2 * int(c.uint16()))
+				}
+				continue
+			}
+			for i := range d.mapIdx {
+				d.mapIdx[i] = c.pos - start + 1
+				c.take(int(c.uint8()))
+			}
+		}
+		t.dtzMap = c.b[start:c.pos]
+		c.align(2)
+	}
+
+	for f := 0; f < files; f++ {
+		for i := 0; i < sides; i++ {
+			d := t.sides[i][f]
+			d.sparse = c.take(6 * int(d.sparseSize()))
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < sides; i++ {
+			d := t.sides[i][f]
+			d.blockLengths = c.take(2 * d.blockLengthSize)
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < sides; i++ {
+			d := t.sides[i][f]
+			if d.flags&flagSingleValue != 0 {
+				continue
+			}
+			c.align(64)
+			d.data = c.take(int(uint64(d.blocks) * d.blockSize))
+		}
+	}
+
+	if c.err != nil {
+		return fmt.Errorf("%w -- %s", c.err, path)
+	}
+	return nil
+}
+
+// whether pieces are the pieces of the table in some order
+func (t *table) matches(pieces []uint8) bool {
+	var counts [16]int
+	for _, p := range pieces {
+		counts[p]++
+	}
+	for _, p := range t.pieces {
+		counts[p]--
+	}
+	for _, n := range counts {
+		if n != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *pairs) sparseSize() uint64 {
+	if d.flags&flagSingleValue != 0 {
+		return 0
+	}
+
+	return (d.size() + d.span - 1) / d.span
+}
+
+func (d *pairs) readSizes(c *cursor) {
+	d.flags = c.uint8()
+	if d.flags&flagSingleValue != 0 {
+		d.single = int(c.uint8())
+		return
+	}
+
+	blockBits, spanBits := c.uint8(), c.uint8()
+	if blockBits > 31 || spanBits > 31 {
+		c.err = ErrInvalidTable
+		return
+	}
+	d.blockSize, d.span = 1<<blockBits, 1<<spanBits
+	padding := int(c.uint8())
+	d.blocks = c.uint32()
+	d.blockLengthSize = int(d.blocks) + padding
+
+	maxLen := int(c.uint8())
+	d.minLen = int(c.uint8())
+	if maxLen < d.minLen || maxLen > 64 {
+		c.err = ErrInvalidTable
+		return
+	}
+
+	n := maxLen - d.minLen + 1
+	d.lowest = make([]uint16, n)
+	for i := range d.lowest {
+		d.lowest[i] = c.uint16()
+	}
+
+	// the lowest code of every length, padded to 64 bits, longer codes are
+	// numbered lower
+	d.base = make([]uint64, n)
+	for i := n - 2; i >= 0; i-- {
+		d.base[i] = (d.base[i+1] + uint64(d.lowest[i]) - uint64(d.lowest[i+1])) / 2
+	}
+	for i := range d.base {
+		d.base[i] <<= uint(64 - i - d.minLen)
+	}
+
+	symbols := int(c.uint16())
+	d.tree = c.take(3 * symbols)
+	if symbols%2 == 1 {
+		c.uint8()
+	}
+	if c.err != nil {
+		return
+	}
+
+	d.symLen = make([]int, symbols)
+	visited := make([]bool, symbols)
+	for s := range d.symLen {
+		if !visited[s] && !d.setSymLen(s, visited) {
+			c.err = ErrInvalidTable
+			return
+		}
+	}
+}
+
+// a symbol is a value or a pair of symbols
+func (d *pairs) left(s int) int {
+	return int(d.tree[3*s+1]&0xf)<<8 | int(d.tree[3*s])
+}
+
+func (d *pairs) right(s int) int {
+	return int(d.tree[3*s+2])<<4 | int(d.tree[3*s+1]>>4)
+}
+
+func (d *pairs) setSymLen(s int, visited []bool) bool {
+	visited[s] = true
+	r := d.right(s)
+	if r == 0xfff {
+		return true
+	}
+
+	l := d.left(s)
+	for _, child := range []int{l, r} {
+		if child >= len(d.symLen) {
+			return false
+		}
+		if !visited[child] && !d.setSymLen(child, visited) {
+			return false
+		}
+	}
+	d.symLen[s] = d.symLen[l] + d.symLen[r] + 1
+
+	return true
+}
+
+/*
+	The value at idx. The sparse index gives a block near it, which is
+	walked to the block that holds idx and decoded symbol by symbol up to
+	the one that expands to it
+*/
+func (d *pairs) value(idx uint64) (int, error) {
+	if d.flags&flagSingleValue != 0 {
+		return d.single, nil
+	}
+
+	k := idx / d.span
+	if 6*(k+1) > uint64(len(d.sparse)) {
+		return 0, ErrInvalidTable
+	}
+	block := int64(binary.LittleEndian.Uint32(d.sparse[6*k:]))
+	offset := int64(binary.LittleEndian.Uint16(d.sparse[6*k+4:]))
+	offset += int64(idx%d.span) - int64(d.span/2)
+
+	length := func(b int64) (int64, bool) {
+		if b < 0 || 2*(b+1) > int64(len(d.blockLengths)) {
+			return 0, false
+		}
+		return int64(binary.LittleEndian.Uint16(d.blockLengths[2*b:])), true
+	}
+	for offset < 0 {
+		block--
+		n, ok := length(block)
+		if !ok {
+			return 0, ErrInvalidTable
+		}
+		offset += n + 1
+	}
+	for {
+		n, ok := length(block)
+		if !ok {
+			return 0, ErrInvalidTable
+		}
+		if offset <= n {
+			break
+		}
+		offset -= n + 1
+		block++
+	}
+
+	start := uint64(block) * d.blockSize
+	if block >= int64(d.blocks) || start >= uint64(len(d.data)) {
+		return 0, ErrInvalidTable
+	}
+	ptr := start
+	// reads past the end of the data are zeros
+	word := func() uint64 {
+		var w uint64
+		for i := uint64(0); i < 4; i++ {
+			w <<= 8
+			if ptr+i < uint64(len(d.data)) {
+				w |= uint64(d.data[ptr+i])
+			}
+		}
+		ptr += 4
+		return w
+	}
+
+	buf := word() << 32
+	buf |= word()
+	bits := 64
+
+	var sym int
+	for {
+		l := 0
+		for l < len(d.base)-1 && buf < d.base[l] {
+			l++
+		}
+		if buf < d.base[l] {
+			return 0, ErrInvalidTable
+		}
+
+		sym = int((buf-d.base[l])>>uint(64-l-d.minLen)) + int(d.lowest[l])
+		if sym >= len(d.symLen) {
+			return 0, ErrInvalidTable
+		}
+		if offset < int64(d.symLen[sym])+1 {
+			break
+		}
+		offset -= int64(d.symLen[sym]) + 1
+
+		l += d.minLen
+		buf <<= uint(l)
+		bits -= l
+		if bits <= 32 {
+			bits += 32
+			buf |= word() << uint(64-bits)
+		}
+	}
+
+	for d.symLen[sym] != 0 {
+		left := d.left(sym)
+		if offset < int64(d.symLen[left])+1 {
+			sym = left
+		} else {
+			offset -= int64(d.symLen[left]) + 1
+			sym = d.right(sym)
+		}
+	}
+
+	return d.left(sym), nil
+}
@@ -0,0 +1,542 @@
+package tablebase
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+/*
+	Probes Syzygy endgame tables kept in a local directory, the WDL tables
+	(.rtbw) for the result of a position and the DTZ tables (.rtbz) for the
+	distance to the next capture or pawn move. A table is read the first
+	time a position of its material is probed and kept in memory
+
+	Positions with castling rights are not covered, and neither are those
+	whose table or the tables of their captures are not in the directory.
+	Like Syzygy the results count the 50 move rule from a clock of 0, a win
+	that needs more than 50 moves without a capture or pawn move is cursed
+*/
+
+const (
+	// the most pieces Syzygy tables exist for, kings included
+	MaxPieces = 7
+
+	// the label of results built from a table
+	Label = "tablebase"
+)
+
+var (
+	ErrNotCovered = errors.New("position not covered by the tablebase")
+	ErrMaxPieces  = fmt.Errorf("tablebases are limited to %d pieces", MaxPieces)
+)
+
+// WDL is the result of a position for the side to move
+type WDL int
+
+const (
+	Loss WDL = iota - 2
+	// a loss the 50 move rule saves
+	BlessedLoss
+	Draw
+	// a win the 50 move rule spoils
+	CursedWin
+	Win
+)
+
+func (w WDL) String() string {
+	switch w {
+	case Win:
+		return "win"
+	case CursedWin:
+		return "cursed win"
+	case BlessedLoss:
+		return "blessed loss"
+	case Loss:
+		return "loss"
+	}
+
+	return "draw"
+}
+
+type Tablebase struct {
+	dir       string
+	maxPieces int
+
+	mu     sync.Mutex
+	tables map[string]*tableLoad
+}
+
+// a table read once, by the first probe of its material
+type tableLoad struct {
+	once  sync.Once
+	table *table
+	err   error
+}
+
+/*
+	Tables are read from dir. Positions with more than maxPieces pieces,
+	kings included, are not covered
+*/
+func Open(dir string, maxPieces int) (*Tablebase, error) {
+	if maxPieces > MaxPieces {
+		return nil, ErrMaxPieces
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	return &Tablebase{
+		dir:       dir,
+		maxPieces: maxPieces,
+		tables:    make(map[string]*tableLoad),
+	}, nil
+}
+
+// Returns the result of the position, ErrNotCovered if the tables do not have it
+func (tb *Tablebase) ProbeWDL(pos *chess.Position) (WDL, error) {
+	err := tb.covers(pos)
+	if err != nil {
+		return Draw, err
+	}
+
+	wdl, _, err := tb.search(pos, false)
+	return wdl, err
+}
+
+/*
+	Returns the plies to the next capture or pawn move, or to mate, with
+	the winner hurrying and the loser delaying. Positive is a win for the
+	side to move, negative a loss and 0 a draw, -1 is checkmated. Cursed
+	wins and blessed losses count 100 more. Tables that store moves instead
+	of plies may give one ply more than it takes
+*/
+func (tb *Tablebase) ProbeDTZ(pos *chess.Position) (int, error) {
+	err := tb.covers(pos)
+	if err != nil {
+		return 0, err
+	}
+
+	return tb.dtz(pos)
+}
+
+func (tb *Tablebase) covers(pos *chess.Position) error {
+	for _, c := range []chess.Color{chess.White, chess.Black} {
+		if pos.CastleRights().CanCastle(c, chess.KingSide) || pos.CastleRights().CanCastle(c, chess.QueenSide) {
+			return ErrNotCovered
+		}
+	}
+
+	kings, n := 0, 0
+	for _, p := range pos.Board().SquareMap() {
+		n++
+		if p.Type() == chess.King {
+			kings++
+		}
+	}
+	if n > tb.maxPieces || kings != 2 {
+		return ErrNotCovered
+	}
+
+	return nil
+}
+
+// how a search found its result
+type probeState int
+
+const (
+	probeOK probeState = iota
+	// a capture or pawn move is best, DTZ tables do not store the position
+	probeZeroing
+	// the DTZ table stores the other side to move
+	probeChangeSTM
+)
+
+/*
+	The result of the position, searching captures first, and pawn moves
+	too with zeroing. Tables do not know en passant, and a table may store
+	any result for a position that a capture does better in
+*/
+func (tb *Tablebase) search(pos *chess.Position, zeroing bool) (WDL, probeState, error) {
+	moves := pos.ValidMoves()
+	best, searched := Loss, 0
+	for _, m := range moves {
+		if !isCapture(m) && (!zeroing || !isPawnMove(pos, m)) {
+			continue
+		}
+		searched++
+
+		v, _, err := tb.search(pos.Update(m), false)
+		if err != nil {
+			return Draw, probeOK, err
+		}
+		if -v > best {
+			best = -v
+			if best == Win {
+				return best, probeZeroing, nil
+			}
+		}
+	}
+
+	// every move was searched, the table is not needed
+	all := searched > 0 && searched == len(moves)
+	wdl := best
+	if !all {
+		v, _, err := tb.probeTable(pos, false, Draw)
+		if err != nil {
+			return Draw, probeOK, err
+		}
+		wdl = WDL(v)
+	}
+
+	if best >= wdl {
+		if best > Draw || all {
+			return best, probeZeroing, nil
+		}
+		return best, probeOK, nil
+	}
+
+	return wdl, probeOK, nil
+}
+
+func (tb *Tablebase) dtz(pos *chess.Position) (int, error) {
+	wdl, state, err := tb.search(pos, true)
+	if err != nil || wdl == Draw {
+		return 0, err
+	}
+	if state == probeZeroing {
+		return beforeZeroing(wdl), nil
+	}
+
+	v, state, err := tb.probeTable(pos, true, wdl)
+	if err != nil {
+		return 0, err
+	}
+	if state != probeChangeSTM {
+		if wdl == CursedWin || wdl == BlessedLoss {
+			v += 100
+		}
+		return v * sign(int(wdl)), nil
+	}
+
+	// the table has the other side to move, one ply more than its best
+	best := 0xffff
+	for _, m := range pos.ValidMoves() {
+		zeroing := isCapture(m) || isPawnMove(pos, m)
+		after := pos.Update(m)
+
+		var v int
+		if zeroing {
+			w, _, err := tb.search(after, false)
+			if err != nil {
+				return 0, err
+			}
+			v = -beforeZeroing(w)
+		} else {
+			v, err = tb.dtz(after)
+			if err != nil {
+				return 0, err
+			}
+			v = -v
+		}
+
+		if v == 1 && after.Status() == chess.Checkmate {
+			best = 1
+		}
+		if !zeroing {
+			v += sign(v)
+		}
+		if v < best && sign(v) == sign(int(wdl)) {
+			best = v
+		}
+	}
+
+	// no moves is checkmate
+	if best == 0xffff {
+		return -1, nil
+	}
+	return best, nil
+}
+
+// the DTZ of a position whose best move captures or moves a pawn
+func beforeZeroing(wdl WDL) int {
+	switch wdl {
+	case Win:
+		return 1
+	case CursedWin:
+		return 101
+	case BlessedLoss:
+		return -101
+	case Loss:
+		return -1
+	}
+
+	return 0
+}
+
+func sign(v int) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+
+	return 0
+}
+
+func isCapture(m *chess.Move) bool {
+	return m.HasTag(chess.Capture) || m.HasTag(chess.EnPassant)
+}
+
+func isPawnMove(pos *chess.Position, m *chess.Move) bool {
+	return pos.Board().Piece(m.S1()).Type() == chess.Pawn
+}
+
+/*
+	The value the table of the position stores for it, a WDL or, with dtz,
+	the DTZ of a position with the result wdl
+*/
+func (tb *Tablebase) probeTable(pos *chess.Position, dtz bool, wdl WDL) (int, probeState, error) {
+	var letters [2]strings.Builder
+	pieces, sqs := []uint8{}, []int{}
+	for sq, p := range pos.Board().SquareMap() {
+		code := 7 - uint8(p.Type())
+		color := 0
+		if p.Color() == chess.Black {
+			code |= blackBit
+			color = 1
+		}
+		letters[color].WriteByte(pieceLetters[p.Type()])
+		pieces = append(pieces, code)
+		sqs = append(sqs, int(sq))
+	}
+	if len(pieces) == 2 {
+		return 0, probeOK, nil
+	}
+
+	name, blackStronger := tableName(letters[0].String(), letters[1].String())
+	t, err := tb.table(name, dtz)
+	if err != nil {
+		return 0, probeOK, err
+	}
+
+	// tables are for white as the stronger side, and only white to move if
+	// both sides are the same
+	flip := blackStronger || (t.symmetric && pos.Turn() == chess.Black)
+	stm := 0
+	if (pos.Turn() == chess.Black) != flip {
+		stm = 1
+	}
+	if flip {
+		for i := range pieces {
+			pieces[i] ^= blackBit
+			sqs[i] ^= 56
+		}
+	}
+
+	file := t.fileOf(pieces, sqs)
+	d := t.side(stm, file)
+	if dtz && int(d.flags&flagSTM) != stm && (!t.symmetric || t.pawns) {
+		return 0, probeChangeSTM, nil
+	}
+
+	v, err := d.value(t.index(&d.layout, pieces, sqs))
+	if err != nil {
+		return 0, probeOK, fmt.Errorf("%w -- %s", err, name)
+	}
+	if !dtz {
+		return v - 2, probeOK, nil
+	}
+
+	v, err = t.dtzScore(d, v, wdl)
+	return v, probeOK, err
+}
+
+// where the values of each result are in the dtz map of a file
+var dtzMapOf = map[WDL]int{Win: 0, Loss: 1, CursedWin: 2, BlessedLoss: 3}
+
+func (t *table) dtzScore(d *pairs, v int, wdl WDL) (int, error) {
+	if d.flags&flagMapped != 0 {
+		i := d.mapIdx[dtzMapOf[wdl]] + v
+		switch {
+		case d.flags&flagWide != 0 && 2*i+2 <= len(t.dtzMap):
+			v = int(binary.LittleEndian.Uint16(t.dtzMap[2*i:]))
+		case d.flags&flagWide == 0 && i < len(t.dtzMap):
+			v = int(t.dtzMap[i])
+		default:
+			return 0, fmt.Errorf("%w -- %s", ErrInvalidTable, t.name)
+		}
+	}
+
+	// moves are counted as plies
+	if (wdl == Win && d.flags&flagWinPlies == 0) || (wdl == Loss && d.flags&flagLossPlies == 0) ||
+		wdl == CursedWin || wdl == BlessedLoss {
+		v *= 2
+	}
+
+	return v + 1, nil
+}
+
+/*
+	The WDL or DTZ table of a material, named like KRvK with white as the
+	stronger side. sides has the positions with white and black to move,
+	WDL tables of symmetric material and DTZ tables store only one of them.
+	Tables with pawns have one for each file of the lead pawn
+*/
+type table struct {
+	name string
+	dtz  bool
+
+	// the pieces with the colors of the name
+	pieces    []uint8
+	count     int
+	symmetric bool
+	pawns     bool
+	// a piece other than a king that its color has only one of
+	unique bool
+	// the pawns of the lead color, the one with fewer, then the others
+	pawnCount [2]int
+
+	sides  [2][4]*pairs
+	dtzMap []byte
+}
+
+func newTable(name string, dtz bool) (*table, error) {
+	colors := strings.Split(name, "v")
+	if len(colors) != 2 || colors[0] == "" || colors[1] == "" {
+		return nil, fmt.Errorf("invalid material %q", name)
+	}
+
+	t := &table{name: name, dtz: dtz, symmetric: colors[0] == colors[1]}
+	var pawns [2]int
+	for color, side := range colors {
+		var counts [7]int
+		for _, r := range side {
+			k := strings.IndexRune(pieceLetters, r)
+			if k < 1 {
+				return nil, fmt.Errorf("invalid material %q", name)
+			}
+			counts[k]++
+
+			code := 7 - uint8(k)
+			if color == 1 {
+				code |= blackBit
+			}
+			t.pieces = append(t.pieces, code)
+		}
+
+		if counts[chess.King] != 1 {
+			return nil, fmt.Errorf("invalid material %q", name)
+		}
+		for k, n := range counts {
+			if k != int(chess.King) && n == 1 {
+				t.unique = true
+			}
+		}
+		pawns[color] = counts[chess.Pawn]
+	}
+
+	t.count = len(t.pieces)
+	if t.count > MaxPieces {
+		return nil, ErrMaxPieces
+	}
+	t.pawns = pawns[0]+pawns[1] > 0
+	t.pawnCount = pawns
+	if pawns[1] > 0 && (pawns[0] == 0 || pawns[1] < pawns[0]) {
+		t.pawnCount = [2]int{pawns[1], pawns[0]}
+	}
+
+	return t, nil
+}
+
+func (t *table) side(stm, file int) *pairs {
+	if t.dtz || t.symmetric {
+		stm = 0
+	}
+
+	return t.sides[stm][file]
+}
+
+const pieceLetters = " KQRBNP"
+
+/*
+	The name of the table of a material from the pieces of each color, the
+	stronger side first. Reports whether that is black
+*/
+func tableName(white, black string) (string, bool) {
+	order := func(side string) string {
+		b := []byte(side)
+		sort.Slice(b, func(i, j int) bool {
+			return strings.IndexByte(pieceLetters, b[i]) < strings.IndexByte(pieceLetters, b[j])
+		})
+		return string(b)
+	}
+	white, black = order(white), order(black)
+
+	// letters are in the order of pieceLetters, so the stronger pieces
+	// compare lower
+	ranked := func(side string) string {
+		return strings.NewReplacer("Q", "2", "R", "3", "B", "4", "N", "5", "P", "6", "K", "1").Replace(side)
+	}
+	if len(white) < len(black) || (len(white) == len(black) && ranked(black) < ranked(white)) {
+		return black + "v" + white, true
+	}
+
+	return white + "v" + black, false
+}
+
+/*
+	Returns the table of material, reading it first if no probe did yet.
+	Only probes of the same table wait for the read, tb.mu is held just to
+	find it
+*/
+func (tb *Tablebase) table(name string, dtz bool) (*table, error) {
+	file := name + wdlExt
+	if dtz {
+		file = name + dtzExt
+	}
+
+	tb.mu.Lock()
+	l, ok := tb.tables[file]
+	if !ok {
+		l = &tableLoad{}
+		tb.tables[file] = l
+	}
+	tb.mu.Unlock()
+
+	l.once.Do(func() {
+		l.table, l.err = tb.load(name, dtz, filepath.Join(tb.dir, file))
+	})
+
+	return l.table, l.err
+}
+
+func (tb *Tablebase) load(name string, dtz bool, path string) (*table, error) {
+	t, err := newTable(name, dtz)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.read(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w -- no table %s", ErrNotCovered, filepath.Base(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
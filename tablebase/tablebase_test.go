@@ -0,0 +1,236 @@
+package tablebase
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	chess "github.com/garlicgarrison/go-chess"
+)
+
+/*
+	Probes are checked against the official Syzygy tables of KQvK, KRvK,
+	KBvK, KNvK and KPvK, .rtbw and .rtbz, kept in testdata. They are a few
+	KB each, from https://tablebase.lichess.ovh/tables/standard/3-4-5/ or
+	any other mirror. Tests that need a table that is not there are skipped
+*/
+const tables = "testdata"
+
+func position(t *testing.T, fen string) *chess.Position {
+	f, err := chess.FEN(fen)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return chess.NewGame(f).Position()
+}
+
+// opens testdata, skipping the test if a table of names is missing
+func open(t *testing.T, maxPieces int, names ...string) *Tablebase {
+	for _, name := range names {
+		for _, ext := range []string{wdlExt, dtzExt} {
+			_, err := os.Stat(filepath.Join(tables, name+ext))
+			if err != nil {
+				t.Skipf("no official %s%s in %s", name, ext, tables)
+			}
+		}
+	}
+
+	tb, err := Open(tables, maxPieces)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	return tb
+}
+
+func TestProbeWDL(t *testing.T) {
+	tb := open(t, 3, "KQvK", "KRvK", "KBvK", "KNvK", "KPvK")
+
+	tests := []struct {
+		fen string
+		wdl WDL
+	}{
+		{"k7/8/2K5/8/8/8/8/7R w - - 0 1", Win},
+		{"1k6/8/2K5/8/8/8/8/7R b - - 0 1", Loss},
+		{"2k4R/8/2K5/8/8/8/8/8 b - - 0 1", Loss},
+		{"k7/8/2K5/8/8/8/8/7Q w - - 0 1", Win},
+		// black has the rook, the table is read with the colors flipped
+		{"8/8/8/8/8/2k5/8/K6r w - - 0 1", Loss},
+		{"8/8/8/8/8/2k5/8/K6r b - - 0 1", Win},
+		// the king takes the rook
+		{"8/8/8/8/8/8/1r6/K1k5 w - - 0 1", Draw},
+		// stalemate
+		{"4k3/4P3/4K3/8/8/8/8/8 b - - 0 1", Draw},
+		{"4k3/8/4K3/4P3/8/8/8/8 w - - 0 1", Win},
+		{"4k3/8/4K3/4P3/8/8/8/8 b - - 0 1", Loss},
+		{"7k/8/8/8/8/8/7P/7K w - - 0 1", Draw},
+		{"4k3/8/8/8/8/8/8/4KN2 w - - 0 1", Draw},
+		{"4k3/8/8/8/8/8/8/4KB2 b - - 0 1", Draw},
+		{"4k3/8/8/8/8/8/8/4K3 w - - 0 1", Draw},
+		// taking the knight wins without the KRvKN table
+		{"4k3/8/8/8/8/8/n7/R3K3 w - - 0 1", Win},
+	}
+	for _, test := range tests {
+		wdl, err := tb.ProbeWDL(position(t, test.fen))
+		if err != nil {
+			t.Fatalf("%s -- %s", test.fen, err)
+		}
+		if wdl != test.wdl {
+			t.Fatalf("%s -- expected %s, got %s", test.fen, test.wdl, wdl)
+		}
+	}
+}
+
+func TestProbeDTZ(t *testing.T) {
+	tb := open(t, 3, "KRvK", "KPvK")
+
+	// plies to the zeroing move or mate, tables that store moves may give
+	// one more
+	tests := map[string]int{
+		// Kb6 Kb8 Rh8
+		"k7/8/2K5/8/8/8/8/7R w - - 0 1": 3,
+		// Ka8 lasts longest
+		"1k6/8/2K5/8/8/8/8/7R b - - 0 1": -4,
+		"2k4R/8/2K5/8/8/8/8/8 b - - 0 1": -1,
+		// the promotion zeroes, the blocked pawn has to wait for the king
+		"8/4P3/8/8/8/8/k7/4K3 w - - 0 1":  1,
+		"4k3/8/4K3/4P3/8/8/8/8 w - - 0 1": 3,
+		"7k/8/8/8/8/8/7P/7K w - - 0 1":    0,
+	}
+	for fen, want := range tests {
+		dtz, err := tb.ProbeDTZ(position(t, fen))
+		if err != nil {
+			t.Fatalf("%s -- %s", fen, err)
+		}
+
+		ok := dtz == want
+		if want > 1 {
+			ok = dtz == want || dtz == want+1
+		}
+		if want < -1 {
+			ok = dtz == want || dtz == want-1
+		}
+		if !ok {
+			t.Fatalf("%s -- expected a DTZ of %d, got %d", fen, want, dtz)
+		}
+	}
+}
+
+func TestNotCovered(t *testing.T) {
+	tb, err := Open(t.TempDir(), 3)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	for _, fen := range []string{
+		// castling rights
+		"4k3/8/8/8/8/8/8/R3K3 w Q - 0 1",
+		// more than 3 pieces
+		"4k3/8/8/8/8/8/8/RR2K3 w - - 0 1",
+		// no KRvK table in the directory
+		"k7/8/2K5/8/8/8/8/7R w - - 0 1",
+	} {
+		_, err := tb.ProbeWDL(position(t, fen))
+		if !errors.Is(err, ErrNotCovered) {
+			t.Fatalf("%s -- expected ErrNotCovered, got %v", fen, err)
+		}
+	}
+
+	_, err = Open(t.TempDir(), MaxPieces+1)
+	if !errors.Is(err, ErrMaxPieces) {
+		t.Fatalf("expected ErrMaxPieces, got %v", err)
+	}
+}
+
+func TestTableName(t *testing.T) {
+	tests := []struct {
+		white, black, name string
+		swapped            bool
+	}{
+		{"KR", "K", "KRvK", false},
+		{"K", "KR", "KRvK", true},
+		{"KN", "KR", "KRvKN", true},
+		{"KNR", "K", "KRNvK", false},
+		{"KP", "KP", "KPvKP", false},
+		{"KB", "KNN", "KNNvKB", true},
+	}
+	for _, test := range tests {
+		name, swapped := tableName(test.white, test.black)
+		if name != test.name || swapped != test.swapped {
+			t.Fatalf("%sv%s -- expected %s %v, got %s %v", test.white, test.black, test.name, test.swapped, name, swapped)
+		}
+	}
+}
+
+// a directory with a KRvK table cut short and a KQvK one of the wrong kind
+func invalidTables(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"KRvK.rtbw": append(append([]byte{}, wdlMagic...), fileSplit),
+		"KQvK.rtbw": append(append([]byte{}, dtzMagic...), fileSplit),
+	}
+	for name, b := range files {
+		err := os.WriteFile(filepath.Join(dir, name), b, 0644)
+		if err != nil {
+			t.Fatalf("err -- %s", err)
+		}
+	}
+
+	return dir
+}
+
+func TestInvalidTable(t *testing.T) {
+	dir := invalidTables(t)
+	tb, err := Open(dir, 3)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	for _, fen := range []string{"k7/8/2K5/8/8/8/8/7R w - - 0 1", "k7/8/2K5/8/8/8/8/7Q w - - 0 1"} {
+		_, err := tb.ProbeWDL(position(t, fen))
+		if !errors.Is(err, ErrInvalidTable) {
+			t.Fatalf("%s -- expected ErrInvalidTable, got %v", fen, err)
+		}
+	}
+
+	_, err = Open(filepath.Join(dir, "KRvK.rtbw"), 3)
+	if err == nil {
+		t.Fatalf("expected a file not to open as a directory")
+	}
+}
+
+func TestConcurrentProbes(t *testing.T) {
+	tb, err := Open(invalidTables(t), 3)
+	if err != nil {
+		t.Fatalf("err -- %s", err)
+	}
+
+	// probes of two materials at once, each table is read by one of them
+	fens := []string{"k7/8/2K5/8/8/8/8/7R w - - 0 1", "k7/8/2K5/8/8/8/8/7Q w - - 0 1"}
+	errs := make(chan error, 4*len(fens))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, fen := range fens {
+			wg.Add(1)
+			go func(pos *chess.Position) {
+				defer wg.Done()
+				_, err := tb.ProbeWDL(pos)
+				errs <- err
+			}(position(t, fen))
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, ErrInvalidTable) {
+			t.Fatalf("expected ErrInvalidTable, got %v", err)
+		}
+	}
+	if len(tb.tables) != 2 {
+		t.Fatalf("expected 2 tables, got %d", len(tb.tables))
+	}
+}
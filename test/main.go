@@ -9,13 +9,12 @@ import (
 	"github.com/garlicgarrison/chess-puzzle-gen/beautify"
 	"github.com/garlicgarrison/chess-puzzle-gen/puzzlegen"
 	"github.com/garlicgarrison/chess-puzzle-gen/stockpool"
-	"github.com/garlicgarrison/go-chess"
 	"gopkg.in/yaml.v2"
 )
 
 func main() {
 	// initialize stockfish pool
-	pool, err := stockpool.NewStockPool("stockfish", 1, 8, 10)
+	pool, err := stockpool.NewStockPool("stockfish", 1, 8)
 	if err != nil {
 		panic(err)
 	}
@@ -34,12 +33,13 @@ func main() {
 
 	// initilialize mate generator
 	gen := puzzlegen.NewMatePuzzleGenerator(&puzzlegen.Cfg{
-		puzzlegen.AnalysisConfig{
+		AnalysisConfig: puzzlegen.AnalysisConfig{
 			Depth:   14,
 			MultiPV: 2,
 		},
-		config,
-	}, pool, func(s string, i int, g *chess.Game) {}, 10)
+		PuzzleConfig: config,
+	}, pool, func(puzzlegen.Puzzle) {}, 10)
+	defer gen.Close()
 
 	beautify := beautify.NewAnnealer(beautify.AnnealConfig{
 		InitTemp:        200,